@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	web "github.com/rqure/qlib/pkg/web/go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrNoCredentials = errors.New("no credentials provided")
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+const (
+	AuthMethodAnonymous = "anonymous"
+	AuthMethodApiKey    = "apikey"
+	AuthMethodBasic     = "basic"
+	AuthMethodBearer    = "bearer"
+)
+
+type Principal struct {
+	Name   string
+	Method string
+	Roles  []string
+}
+
+func NewAnonymousPrincipal() *Principal {
+	return &Principal{
+		Name:   "anonymous",
+		Method: AuthMethodAnonymous,
+	}
+}
+
+// AuthenticatedClient is implemented by clients that know which principal they act for
+type AuthenticatedClient interface {
+	Principal() *Principal
+}
+
+// principalOf returns the principal behind client, falling back to the anonymous principal
+// for clients that were not authenticated by the gateway (e.g. websocket clients).
+func principalOf(client web.Client) *Principal {
+	if c, ok := client.(AuthenticatedClient); ok {
+		if principal := c.Principal(); principal != nil {
+			return principal
+		}
+	}
+
+	return NewAnonymousPrincipal()
+}
+
+// Authenticator resolves the principal behind the credentials carried by an HTTP request.
+// It returns ErrNoCredentials when the request carries no credentials it understands, so
+// that authenticators can be chained.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+	Challenge() string
+}
+
+type ChainAuthenticator struct {
+	authenticators []Authenticator
+}
+
+func NewChainAuthenticator(authenticators ...Authenticator) *ChainAuthenticator {
+	return &ChainAuthenticator{
+		authenticators: authenticators,
+	}
+}
+
+func (a *ChainAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range a.authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+
+		return principal, err
+	}
+
+	return nil, ErrNoCredentials
+}
+
+func (a *ChainAuthenticator) Challenge() string {
+	challenges := []string{}
+	for _, authenticator := range a.authenticators {
+		challenges = append(challenges, authenticator.Challenge())
+	}
+
+	return strings.Join(challenges, ", ")
+}
+
+func (a *ChainAuthenticator) Len() int {
+	return len(a.authenticators)
+}
+
+// ApiKeyAuthenticator accepts static keys sent as 'X-API-Key: <key>' or 'Authorization: ApiKey <key>'.
+// Keys are loaded from a file with one 'principal:key[:role1,role2]' entry per line.
+type ApiKeyAuthenticator struct {
+	principals map[[sha256.Size]byte]*Principal
+}
+
+func NewApiKeyAuthenticator(path string) (*ApiKeyAuthenticator, error) {
+	a := &ApiKeyAuthenticator{
+		principals: make(map[[sha256.Size]byte]*Principal),
+	}
+
+	err := readCredentialFile(path, func(parts []string) error {
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New("expected 'principal:key[:roles]'")
+		}
+
+		principal := &Principal{
+			Name:   parts[0],
+			Method: AuthMethodApiKey,
+		}
+
+		if len(parts) > 2 {
+			principal.Roles = splitList(parts[2])
+		}
+
+		a.principals[sha256.Sum256([]byte(parts[1]))] = principal
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *ApiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "ApiKey") {
+			return nil, ErrNoCredentials
+		}
+		key = strings.TrimSpace(value)
+	}
+
+	principal, ok := a.principals[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return principal, nil
+}
+
+func (a *ApiKeyAuthenticator) Challenge() string {
+	return `ApiKey realm="qwebgateway"`
+}
+
+// BasicAuthenticator verifies HTTP basic credentials against an htpasswd style file.
+// Supported hash formats are bcrypt ($2a$, $2b$, $2y$) and {SHA}.
+type BasicAuthenticator struct {
+	hashes map[string]string
+	dummy  []byte
+}
+
+func NewBasicAuthenticator(path string) (*BasicAuthenticator, error) {
+	a := &BasicAuthenticator{
+		hashes: make(map[string]string),
+	}
+
+	err := readCredentialFile(path, func(parts []string) error {
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New("expected 'user:hash'")
+		}
+
+		if !strings.HasPrefix(parts[1], "$2") && !strings.HasPrefix(parts[1], "{SHA}") {
+			return fmt.Errorf("unsupported hash format for user '%s'", parts[0])
+		}
+
+		a.hashes[parts[0]] = parts[1]
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.dummy, err = bcrypt.GenerateFromPassword([]byte(path), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	hash, ok := a.hashes[user]
+	if !ok {
+		// Burn roughly the same time as a real comparison so user names cannot be probed
+		bcrypt.CompareHashAndPassword(a.dummy, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := strings.TrimPrefix(hash, "{SHA}")
+		if subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(expected)) != 1 {
+			return nil, ErrInvalidCredentials
+		}
+	} else if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Principal{
+		Name:   user,
+		Method: AuthMethodBasic,
+	}, nil
+}
+
+func (a *BasicAuthenticator) Challenge() string {
+	return `Basic realm="qwebgateway"`
+}
+
+type JwtAuthenticatorConfig struct {
+	// KeysFile is either a JWKS document or one or more PEM encoded public keys
+	KeysFile   string
+	Issuer     string
+	Audience   string
+	RolesClaim string
+
+	// AllowNoExpiry accepts tokens without an 'exp' claim, which never expire
+	AllowNoExpiry bool
+}
+
+// JwtAuthenticator verifies bearer tokens signed with RS256/384/512 or ES256/384/512
+// against locally configured public keys.
+type JwtAuthenticator struct {
+	config JwtAuthenticatorConfig
+	keys   map[string]crypto.PublicKey
+}
+
+func NewJwtAuthenticator(config JwtAuthenticatorConfig) (*JwtAuthenticator, error) {
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+
+	a := &JwtAuthenticator{
+		config: config,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+
+	content, err := os.ReadFile(config.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		err = a.loadJwks(content)
+	} else {
+		err = a.loadPem(content)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in '%s'", config.KeysFile)
+	}
+
+	return a, nil
+}
+
+func (a *JwtAuthenticator) loadJwks(content []byte) error {
+	jwks := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return err
+	}
+
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+
+	for _, jwk := range jwks.Keys {
+		switch jwk.Kty {
+		case "RSA":
+			a.keys[jwk.Kid] = &rsa.PublicKey{
+				N: decode(jwk.N),
+				E: int(decode(jwk.E).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return fmt.Errorf("unsupported curve '%s' for key '%s'", jwk.Crv, jwk.Kid)
+			}
+
+			a.keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     decode(jwk.X),
+				Y:     decode(jwk.Y),
+			}
+		default:
+			return fmt.Errorf("unsupported key type '%s' for key '%s'", jwk.Kty, jwk.Kid)
+		}
+	}
+
+	return nil
+}
+
+func (a *JwtAuthenticator) loadPem(content []byte) error {
+	for i := 0; ; i++ {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// PEM keys carry no key id; tokens without a 'kid' header are checked against all of them
+		a.keys[fmt.Sprintf("pem-%d", i)] = key
+	}
+}
+
+func (a *JwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJwtSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Tokens naming a key are only checked against that key
+	candidates := []crypto.PublicKey{}
+	if header.Kid == "" {
+		for _, key := range a.keys {
+			candidates = append(candidates, key)
+		}
+	} else if key, ok := a.keys[header.Kid]; ok {
+		candidates = append(candidates, key)
+	} else {
+		return nil, ErrInvalidCredentials
+	}
+
+	verified := false
+	for _, key := range candidates {
+		if verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], signature) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, ErrInvalidCredentials
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJwtSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0)) {
+			return nil, ErrInvalidCredentials
+		}
+	} else if !a.config.AllowNoExpiry {
+		return nil, ErrInvalidCredentials
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if a.config.Issuer != "" && claims["iss"] != a.config.Issuer {
+		return nil, ErrInvalidCredentials
+	}
+
+	if a.config.Audience != "" && !jwtClaimContains(claims["aud"], a.config.Audience) {
+		return nil, ErrInvalidCredentials
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	principal := &Principal{
+		Name:   subject,
+		Method: AuthMethodBearer,
+	}
+
+	switch roles := claims[a.config.RolesClaim].(type) {
+	case string:
+		principal.Roles = splitList(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, s)
+			}
+		}
+	}
+
+	return principal, nil
+}
+
+func (a *JwtAuthenticator) Challenge() string {
+	return `Bearer realm="qwebgateway"`
+}
+
+func decodeJwtSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed string, signature []byte) bool {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+
+	return false
+}
+
+func jwtClaimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if v == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func readCredentialFile(path string, fn func(parts []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := fn(strings.SplitN(line, ":", 3)); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func newTestRequest(headers map[string]string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/make-client-id", nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+
+	return r
+}
+
+func checkPrincipal(t *testing.T, principal *Principal, err error, wantErr error, wantName string, wantRoles []string) {
+	t.Helper()
+
+	if wantErr != nil {
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("expected error %v, got principal %v and error %v", wantErr, principal, err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if principal.Name != wantName {
+		t.Errorf("expected principal '%s', got '%s'", wantName, principal.Name)
+	}
+
+	if len(wantRoles) > 0 || len(principal.Roles) > 0 {
+		if !slices.Equal(principal.Roles, wantRoles) {
+			t.Errorf("expected roles %v, got %v", wantRoles, principal.Roles)
+		}
+	}
+}
+
+func TestApiKeyAuthenticator(t *testing.T) {
+	path := writeTestFile(t, "keys", "# principal:key:roles\nalice:alice-key:admin, viewer\n\nbob:bob-key\n")
+
+	a, err := NewApiKeyAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		wantErr   error
+		wantName  string
+		wantRoles []string
+	}{
+		{"X-API-Key header", map[string]string{"X-API-Key": "alice-key"}, nil, "alice", []string{"admin", "viewer"}},
+		{"Authorization header", map[string]string{"Authorization": "ApiKey bob-key"}, nil, "bob", nil},
+		{"scheme is case insensitive", map[string]string{"Authorization": "apikey bob-key"}, nil, "bob", nil},
+		{"unknown key", map[string]string{"X-API-Key": "mallory-key"}, ErrInvalidCredentials, "", nil},
+		{"key of another principal's name", map[string]string{"X-API-Key": "alice"}, ErrInvalidCredentials, "", nil},
+		{"no credentials", nil, ErrNoCredentials, "", nil},
+		{"other scheme", map[string]string{"Authorization": "Bearer alice-key"}, ErrNoCredentials, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := a.Authenticate(newTestRequest(tt.headers))
+			checkPrincipal(t, principal, err, tt.wantErr, tt.wantName, tt.wantRoles)
+		})
+	}
+}
+
+func TestApiKeyAuthenticatorRejectsMalformedFile(t *testing.T) {
+	for _, content := range []string{"alice\n", "alice:\n", ":key\n"} {
+		if _, err := NewApiKeyAuthenticator(writeTestFile(t, "keys", content)); err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha1.Sum([]byte("bob-password"))
+	shaHash := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+
+	a, err := NewBasicAuthenticator(writeTestFile(t, "htpasswd", "alice:"+string(bcryptHash)+"\nbob:"+shaHash+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic := func(user string, password string) map[string]string {
+		return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))}
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantErr  error
+		wantName string
+	}{
+		{"bcrypt", basic("alice", "alice-password"), nil, "alice"},
+		{"sha", basic("bob", "bob-password"), nil, "bob"},
+		{"wrong bcrypt password", basic("alice", "bob-password"), ErrInvalidCredentials, ""},
+		{"wrong sha password", basic("bob", "alice-password"), ErrInvalidCredentials, ""},
+		{"unknown user", basic("mallory", "alice-password"), ErrInvalidCredentials, ""},
+		{"no credentials", nil, ErrNoCredentials, ""},
+		{"other scheme", map[string]string{"Authorization": "ApiKey alice-password"}, ErrNoCredentials, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := a.Authenticate(newTestRequest(tt.headers))
+			checkPrincipal(t, principal, err, tt.wantErr, tt.wantName, nil)
+		})
+	}
+}
+
+func TestBasicAuthenticatorRejectsUnsupportedHashes(t *testing.T) {
+	for _, content := range []string{"alice:$apr1$salt$hash\n", "alice:plaintext\n", "alice\n"} {
+		if _, err := NewBasicAuthenticator(writeTestFile(t, "htpasswd", content)); err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+}
+
+// signJwt returns a token for claims, signed by key with alg, or with a garbage signature if
+// key is nil
+func signJwt(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	if key == nil {
+		return signed + "." + base64.RawURLEncoding.EncodeToString([]byte("signature"))
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJwtAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := writeTestFile(t, "keys.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "EC",
+				"kid": "ec-key",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := writeTestFile(t, "keys.json", string(jwks))
+
+	pemAuthenticator, err := NewJwtAuthenticator(JwtAuthenticatorConfig{KeysFile: pemFile, Issuer: "issuer", Audience: "gateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksAuthenticator, err := NewJwtAuthenticator(JwtAuthenticatorConfig{KeysFile: jwksFile, RolesClaim: "groups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noExpiryAuthenticator, err := NewJwtAuthenticator(JwtAuthenticatorConfig{KeysFile: pemFile, Issuer: "issuer", Audience: "gateway", AllowNoExpiry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "alice",
+			"iss":   "issuer",
+			"aud":   "gateway",
+			"exp":   now + 60,
+			"roles": []string{"operator", "viewer"},
+		}
+
+		for key, value := range overrides {
+			if value == nil {
+				delete(c, key)
+			} else {
+				c[key] = value
+			}
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		authenticator *JwtAuthenticator
+		token         string
+		wantErr       error
+		wantRoles     []string
+	}{
+		{"RS256", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(nil)), nil, []string{"operator", "viewer"}},
+		{"audience list", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "gateway"}})), nil, []string{"operator", "viewer"}},
+		{"no expiry", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"exp": nil})), ErrInvalidCredentials, nil},
+		{"no expiry allowed", noExpiryAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"exp": nil})), nil, []string{"operator", "viewer"}},
+		{"PEM key with key id", pemAuthenticator, signJwt(t, "RS256", "rsa-key", rsaKey, claims(nil)), ErrInvalidCredentials, nil},
+		{"expired", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"exp": now - 60})), ErrInvalidCredentials, nil},
+		{"not yet valid", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"nbf": now + 60})), ErrInvalidCredentials, nil},
+		{"wrong issuer", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"iss": "other"})), ErrInvalidCredentials, nil},
+		{"wrong audience", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"aud": "other"})), ErrInvalidCredentials, nil},
+		{"no subject", pemAuthenticator, signJwt(t, "RS256", "", rsaKey, claims(map[string]interface{}{"sub": nil})), ErrInvalidCredentials, nil},
+		{"unknown key", pemAuthenticator, signJwt(t, "RS256", "", otherKey, claims(nil)), ErrInvalidCredentials, nil},
+		{"bad signature", pemAuthenticator, signJwt(t, "RS256", "", nil, claims(nil)), ErrInvalidCredentials, nil},
+		{"unsigned", pemAuthenticator, signJwt(t, "none", "", nil, claims(nil)), ErrInvalidCredentials, nil},
+		{"algorithm of another key type", pemAuthenticator, signJwt(t, "ES256", "", rsaKey, claims(nil)), ErrInvalidCredentials, nil},
+		{"malformed", pemAuthenticator, "not-a-token", ErrInvalidCredentials, nil},
+		{"ES256 with key id", jwksAuthenticator, signJwt(t, "ES256", "ec-key", ecKey, claims(map[string]interface{}{"groups": "engineer, viewer"})), nil, []string{"engineer", "viewer"}},
+		{"ES256 without key id", jwksAuthenticator, signJwt(t, "ES256", "", ecKey, claims(nil)), nil, nil},
+		{"ES256 signed by another key", jwksAuthenticator, signJwt(t, "RS256", "ec-key", rsaKey, claims(nil)), ErrInvalidCredentials, nil},
+		{"unknown key id", jwksAuthenticator, signJwt(t, "ES256", "other-key", ecKey, claims(nil)), ErrInvalidCredentials, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := tt.authenticator.Authenticate(newTestRequest(map[string]string{"Authorization": "Bearer " + tt.token}))
+			checkPrincipal(t, principal, err, tt.wantErr, "alice", tt.wantRoles)
+		})
+	}
+
+	if _, err := pemAuthenticator.Authenticate(newTestRequest(map[string]string{"X-API-Key": "alice-key"})); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected %v without a bearer token, got %v", ErrNoCredentials, err)
+	}
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	keys, err := NewApiKeyAuthenticator(writeTestFile(t, "keys", "alice:alice-key\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bob-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic, err := NewBasicAuthenticator(writeTestFile(t, "htpasswd", "bob:"+string(bcryptHash)+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewChainAuthenticator(keys, basic)
+
+	principal, err := a.Authenticate(newTestRequest(map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:bob-password"))}))
+	checkPrincipal(t, principal, err, nil, "bob", nil)
+
+	// Invalid credentials for one authenticator are not retried with the next
+	principal, err = a.Authenticate(newTestRequest(map[string]string{"X-API-Key": "bob-password"}))
+	checkPrincipal(t, principal, err, ErrInvalidCredentials, "", nil)
+
+	principal, err = a.Authenticate(newTestRequest(nil))
+	checkPrincipal(t, principal, err, ErrNoCredentials, "", nil)
+}
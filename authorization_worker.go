@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/app"
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	"github.com/rqure/qlib/pkg/signalslots"
+	"github.com/rqure/qlib/pkg/signalslots/signal"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// AuthorizationWorker sits between the message sources (websocket and REST API) and the
+// workers that handle them. Messages are only forwarded through Received once the policy
+// permits the client's principal to perform them.
+//
+// Every message forwarded is guaranteed a response: messages that cannot be decoded, that
+// need the store while it is disconnected, that no worker handles, or whose handler panics
+// are answered with a WebGatewayError.
+type AuthorizationWorker struct {
+	Received signalslots.Signal
+
+	store            data.Store
+	isStoreConnected bool
+	policy           *Policy
+}
+
+func NewAuthorizationWorker(store data.Store, policy *Policy) *AuthorizationWorker {
+	return &AuthorizationWorker{
+		Received:         signal.New(),
+		store:            store,
+		isStoreConnected: false,
+		policy:           policy,
+	}
+}
+
+func (w *AuthorizationWorker) Init(context.Context, app.Handle) {
+
+}
+
+func (w *AuthorizationWorker) Deinit(context.Context) {
+
+}
+
+func (w *AuthorizationWorker) DoWork(context.Context) {
+
+}
+
+func (w *AuthorizationWorker) OnStoreConnected(context.Context) {
+	w.isStoreConnected = true
+}
+
+func (w *AuthorizationWorker) OnStoreDisconnected() {
+	w.isStoreConnected = false
+}
+
+func (w *AuthorizationWorker) OnNewClientMessage(ctx context.Context, args ...interface{}) {
+	client := args[0].(web.Client)
+	msg := args[1].(web.Message)
+
+	if msg.Payload == nil {
+		log.Warn("Rejected request from client %s: missing payload", client.Id())
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "request has no payload")
+		return
+	}
+
+	if _, err := msg.Payload.UnmarshalNew(); errors.Is(err, protoregistry.NotFound) {
+		log.Warn("Rejected request from client %s: unknown payload type '%s'", client.Id(), msg.Payload.TypeUrl)
+		writeGatewayError(client, msg, GatewayErrorUnknownType, "unknown payload type '%s'", msg.Payload.TypeUrl)
+		return
+	} else if err != nil {
+		log.Warn("Rejected request from client %s: %v", client.Id(), err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode payload '%s': %v", msg.Payload.TypeUrl, err)
+		return
+	}
+
+	if !w.isStoreConnected && !msg.Payload.MessageIs(&protobufs.WebRuntimeGetDatabaseConnectionStatusRequest{}) {
+		log.Warn("Rejected request from client %s: database is not connected", client.Id())
+		writeGatewayError(client, msg, GatewayErrorStoreDisconnected, "database is not connected")
+		return
+	}
+
+	principal := principalOf(client)
+
+	for _, access := range w.accessesOf(ctx, msg) {
+		if err := w.policy.Authorize(principal, access); err != nil {
+			log.Warn("Denied request from client %s: %v", client.Id(), err)
+			writeGatewayError(client, msg, GatewayErrorPermissionDenied, "%v", err)
+			return
+		}
+	}
+
+	w.dispatch(ctx, &respondingClient{Client: client}, msg)
+}
+
+func (w *AuthorizationWorker) dispatch(ctx context.Context, client *respondingClient, msg web.Message) {
+	payloadType := msg.Payload.TypeUrl
+	if name := gatewayMessageType(msg.Payload); name != "" {
+		payloadType = name
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("Recovered from panic while handling %s from client %s: %v\n%s", payloadType, client.Id(), err, debug.Stack())
+
+			if !client.responded {
+				writeGatewayError(client, msg, GatewayErrorInternal, "internal error while handling '%s'", payloadType)
+			}
+		}
+	}()
+
+	w.Received.Emit(ctx, client, msg)
+
+	if client.responded {
+		return
+	}
+
+	// A handler for a known request that returns without answering failed in a way it
+	// didn't report, which is not the client's fault
+	if isApiRequest(msg.Payload) {
+		log.Error("No response to %s from client %s", payloadType, client.Id())
+		writeGatewayError(client, msg, GatewayErrorInternal, "'%s' could not be handled", payloadType)
+		return
+	}
+
+	log.Warn("Rejected request from client %s: no handler for '%s'", client.Id(), payloadType)
+	writeGatewayError(client, msg, GatewayErrorUnknownType, "unsupported payload type '%s'", payloadType)
+}
+
+// accessesOf lists every access a message requires. Messages that cannot be decoded are
+// checked by payload type alone and left for the handling worker to reject.
+func (w *AuthorizationWorker) accessesOf(ctx context.Context, msg web.Message) []*Access {
+	name := gatewayMessageType(msg.Payload)
+	if name == "" {
+		name = string(msg.Payload.MessageName().Name())
+	}
+
+	operation := OperationWrite
+	if strings.Contains(name, "Get") || strings.HasSuffix(name, "ExistsRequest") {
+		operation = OperationRead
+	}
+
+	access := &Access{
+		Payload:   name,
+		Operation: operation,
+	}
+
+	switch {
+	case msg.Payload.MessageIs(&protobufs.WebConfigCreateEntityRequest{}):
+		req := new(protobufs.WebConfigCreateEntityRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			access.EntityType = req.Type
+			access.Ancestors = w.ancestorsOf(ctx, req.ParentId)
+		}
+	case msg.Payload.MessageIs(&protobufs.WebConfigDeleteEntityRequest{}):
+		req := new(protobufs.WebConfigDeleteEntityRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			return []*Access{w.newEntityAccess(ctx, name, access.Operation, req.Id, "")}
+		}
+	case msg.Payload.MessageIs(&protobufs.WebConfigGetEntityRequest{}):
+		req := new(protobufs.WebConfigGetEntityRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			return []*Access{w.newEntityAccess(ctx, name, access.Operation, req.Id, "")}
+		}
+	case msg.Payload.MessageIs(&protobufs.WebConfigGetEntitySchemaRequest{}):
+		req := new(protobufs.WebConfigGetEntitySchemaRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			access.EntityType = req.Type
+		}
+	case msg.Payload.MessageIs(&protobufs.WebConfigSetEntitySchemaRequest{}):
+		req := new(protobufs.WebConfigSetEntitySchemaRequest)
+		if msg.Payload.UnmarshalTo(req) == nil && req.Schema != nil {
+			access.EntityType = req.Schema.Name
+		}
+	case msg.Payload.MessageIs(&protobufs.WebConfigCreateSnapshotRequest{}):
+		access.Operation = OperationRead
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeGetEntitiesRequest{}):
+		req := new(protobufs.WebRuntimeGetEntitiesRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			access.EntityType = req.EntityType
+		}
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeFieldExistsRequest{}):
+		req := new(protobufs.WebRuntimeFieldExistsRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			access.EntityType = req.EntityType
+			access.Field = req.FieldName
+		}
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeEntityExistsRequest{}):
+		req := new(protobufs.WebRuntimeEntityExistsRequest)
+		if msg.Payload.UnmarshalTo(req) == nil {
+			access.EntityId = req.EntityId
+		}
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeRegisterNotificationRequest{}):
+		req := new(protobufs.WebRuntimeRegisterNotificationRequest)
+		if msg.Payload.UnmarshalTo(req) != nil {
+			break
+		}
+
+		accesses := []*Access{}
+		for _, cfg := range req.Requests {
+			// The remaining fields of a field path are authorized by the RuntimeWorker as it
+			// resolves them, and every notification is authorized again as it is delivered
+			a := w.newEntityAccess(ctx, name, OperationRead, cfg.Id, firstFieldOf(cfg.Field))
+			if cfg.Type != "" {
+				a.EntityType = cfg.Type
+			}
+
+			accesses = append(accesses, a)
+
+			// Context fields are delivered with every notification, so they are read as well. Those
+			// of a field path belong to the entity it resolves to, and are left to the RuntimeWorker.
+			if isFieldPath(cfg.Field) {
+				continue
+			}
+
+			for _, field := range cfg.ContextFields {
+				contextAccess := *a
+				contextAccess.Field = firstFieldOf(field)
+				accesses = append(accesses, &contextAccess)
+			}
+		}
+
+		if len(accesses) > 0 {
+			return accesses
+		}
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeUnregisterNotificationRequest{}):
+		access.Operation = OperationRead
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeGetNotificationsRequest{}):
+		access.Operation = OperationRead
+	case msg.Payload.MessageIs(&protobufs.WebRuntimeDatabaseRequest{}):
+		// Database requests are authorized per field by the RuntimeWorker, so that denied
+		// fields can be reported individually without failing the whole request
+		return []*Access{}
+	case name == WebGatewayGetEntitiesRequestType:
+		req := new(WebGatewayGetEntitiesRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) == nil {
+			access.EntityType = req.EntityType
+		}
+	case name == WebGatewayGetEntityTreeRequestType:
+		req := new(WebGatewayGetEntityTreeRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) == nil && req.RootId != "" {
+			return []*Access{w.newEntityAccess(ctx, name, access.Operation, req.RootId, "")}
+		}
+	case name == WebGatewayFindEntitiesRequestType:
+		access.Operation = OperationRead
+
+		req := new(WebGatewayFindEntitiesRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) == nil && req.AncestorId != "" {
+			return []*Access{w.newEntityAccess(ctx, name, access.Operation, req.AncestorId, "")}
+		}
+	case name == WebGatewayRenameEntityRequestType:
+		req := new(WebGatewayRenameEntityRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) == nil {
+			return []*Access{w.newEntityAccess(ctx, name, access.Operation, req.Id, "")}
+		}
+	case name == WebGatewayMoveEntityRequestType:
+		req := new(WebGatewayMoveEntityRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) != nil {
+			break
+		}
+
+		// The entity must be writable both where it is and where it is moved to
+		from := w.newEntityAccess(ctx, name, access.Operation, req.Id, "")
+		to := &Access{
+			Payload:    name,
+			Operation:  access.Operation,
+			EntityType: from.EntityType,
+			EntityId:   req.Id,
+			Ancestors:  append([]string{req.Id}, w.ancestorsOf(ctx, req.ParentId)...),
+		}
+
+		return []*Access{from, to}
+	case name == WebGatewayCloneEntityRequestType:
+		req := new(WebGatewayCloneEntityRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) != nil {
+			break
+		}
+
+		// Like WebConfigCreateEntityRequest, the copy is checked by its type and new parent
+		from := w.newEntityAccess(ctx, name, OperationRead, req.Id, "")
+		to := &Access{
+			Payload:    name,
+			Operation:  access.Operation,
+			EntityType: from.EntityType,
+			Ancestors:  w.ancestorsOf(ctx, req.ParentId),
+		}
+
+		return []*Access{from, to}
+	case name == WebGatewayCreateSnapshotRequestType:
+		access.Operation = OperationRead
+
+		req := new(WebGatewayCreateSnapshotRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) == nil && req.RootId != "" {
+			return []*Access{w.newEntityAccess(ctx, name, access.Operation, req.RootId, "")}
+		}
+	case name == WebGatewayMergeSnapshotRequestType:
+		req := new(WebGatewayMergeSnapshotRequest)
+		if unmarshalGatewayPayload(msg.Payload, req) != nil {
+			break
+		}
+
+		ss := new(protobufs.DatabaseSnapshot)
+		if protojson.Unmarshal(req.Snapshot, ss) != nil {
+			break
+		}
+
+		if req.ParentId != "" {
+			access = w.newEntityAccess(ctx, name, access.Operation, req.ParentId, "")
+		}
+
+		return append([]*Access{access}, w.mergeAccesses(ctx, name, reparentSnapshot(ss, req.ParentId))...)
+	case name == WebGatewayPreviewRestoreRequestType, name == WebGatewayDiffSnapshotsRequestType,
+		name == WebGatewayListBackupsRequestType, name == WebGatewayDownloadBackupRequestType:
+		access.Operation = OperationRead
+	case name == WebGatewayConditionalWriteRequestType:
+		// Authorized per field by the RuntimeWorker, like WebRuntimeDatabaseRequest
+		return []*Access{}
+	}
+
+	return []*Access{access}
+}
+
+// respondingClient records whether a handler responded to the message it was passed with
+type respondingClient struct {
+	web.Client
+	responded bool
+}
+
+func (c *respondingClient) Write(msg web.Message) {
+	c.responded = true
+	c.Client.Write(msg)
+}
+
+func (c *respondingClient) Principal() *Principal {
+	return principalOf(c.Client)
+}
+
+func (w *AuthorizationWorker) newEntityAccess(ctx context.Context, payload string, operation string, entityId string, field string) *Access {
+	if !w.isStoreConnected {
+		return &Access{
+			Payload:   payload,
+			Operation: operation,
+			EntityId:  entityId,
+			Field:     field,
+		}
+	}
+
+	return newEntityAccess(ctx, w.store, payload, operation, entityId, field)
+}
+
+// mergeAccesses lists the writes of merging ss: its schemas, and each of its entities and
+// fields where the merge puts them. Entities that already exist are moved by the merge, so
+// they must be writable where they are as well.
+func (w *AuthorizationWorker) mergeAccesses(ctx context.Context, payload string, ss *protobufs.DatabaseSnapshot) []*Access {
+	accesses := []*Access{}
+	for _, sch := range ss.EntitySchemas {
+		accesses = append(accesses, &Access{Payload: payload, Operation: OperationWrite, EntityType: sch.Name})
+	}
+
+	ancestors := snapshotAncestors(ss, func(id string) []string {
+		return w.ancestorsOf(ctx, id)
+	})
+
+	entityAccesses := map[string]*Access{}
+	for _, ent := range ss.Entities {
+		entityAccesses[ent.Id] = &Access{
+			Payload:    payload,
+			Operation:  OperationWrite,
+			EntityType: ent.Type,
+			EntityId:   ent.Id,
+			Ancestors:  ancestors[ent.Id],
+		}
+		accesses = append(accesses, entityAccesses[ent.Id])
+
+		if current := w.newEntityAccess(ctx, payload, OperationWrite, ent.Id, ""); current.EntityType != "" {
+			accesses = append(accesses, current)
+		}
+	}
+
+	for _, field := range ss.Fields {
+		entityAccess, ok := entityAccesses[field.Id]
+		if !ok {
+			entityAccess = w.newEntityAccess(ctx, payload, OperationWrite, field.Id, "")
+		}
+
+		fieldAccess := *entityAccess
+		fieldAccess.Field = field.Name
+		accesses = append(accesses, &fieldAccess)
+	}
+
+	return accesses
+}
+
+func (w *AuthorizationWorker) ancestorsOf(ctx context.Context, entityId string) []string {
+	if !w.isStoreConnected {
+		return []string{}
+	}
+
+	return ancestorsOf(ctx, w.store, entityId)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rqure/qlib/pkg/app"
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/snapshot"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const DefaultBackupInterval = time.Hour
+const DefaultBackupKeepHourly = 24
+const DefaultBackupKeepDaily = 7
+const DefaultBackupKeepWeekly = 4
+
+// Backups are stored as 'snapshot-<UTC time>.json.gz'. Other files in the backup directory
+// are left alone.
+const (
+	BackupFilePrefix = "snapshot-"
+	BackupFileSuffix = ".json.gz"
+	BackupTimeLayout = "20060102T150405Z"
+)
+
+type BackupConfig struct {
+	// Directory holds the backups. Backups are disabled if it is empty.
+	Directory string
+
+	// Interval is the time between backups. Backups are taken at multiples of Interval, which
+	// are aligned to midnight UTC when Interval divides a day, e.g. on the hour for an hourly
+	// interval.
+	Interval time.Duration
+
+	// KeepHourly, KeepDaily and KeepWeekly are the number of most recent hours, days and weeks
+	// for which the newest backup is kept
+	KeepHourly int
+	KeepDaily  int
+	KeepWeekly int
+}
+
+func NewDefaultBackupConfig() BackupConfig {
+	return BackupConfig{
+		Interval:   DefaultBackupInterval,
+		KeepHourly: DefaultBackupKeepHourly,
+		KeepDaily:  DefaultBackupKeepDaily,
+		KeepWeekly: DefaultBackupKeepWeekly,
+	}
+}
+
+func (c BackupConfig) Validate() error {
+	if c.Interval < time.Minute {
+		return fmt.Errorf("backup interval must be at least a minute")
+	}
+
+	if c.KeepHourly < 0 || c.KeepDaily < 0 || c.KeepWeekly < 0 {
+		return fmt.Errorf("backup retention counts must not be negative")
+	}
+
+	if c.KeepHourly+c.KeepDaily+c.KeepWeekly == 0 {
+		return fmt.Errorf("backup retention must keep at least one backup")
+	}
+
+	return nil
+}
+
+// BackupWorker takes a snapshot of the database every Interval, writes it to the backup
+// directory and removes the backups that fall outside of the retention policy. The snapshot
+// is taken on the worker goroutine, like every other use of the store, while it is encoded,
+// compressed and written in the background, one backup at a time.
+// Stored backups can be listed, downloaded and restored with gateway messages.
+type BackupWorker struct {
+	store            data.Store
+	policy           *Policy
+	isStoreConnected bool
+	config           BackupConfig
+	nextBackup       time.Time
+
+	// backupDone is set while a backup runs, and is closed once it is over
+	backupDone chan struct{}
+}
+
+func NewBackupWorker(store data.Store, policy *Policy, config BackupConfig) *BackupWorker {
+	return &BackupWorker{
+		store:            store,
+		policy:           policy,
+		isStoreConnected: false,
+		config:           config,
+	}
+}
+
+func (w *BackupWorker) Init(context.Context, app.Handle) {
+	if !w.isEnabled() {
+		log.Info("No backup directory configured. Scheduled backups are disabled.")
+		return
+	}
+
+	if err := os.MkdirAll(w.config.Directory, 0o755); err != nil {
+		log.Error("Could not create backup directory '%s': %v", w.config.Directory, err)
+	}
+
+	w.nextBackup = w.scheduleAfter(time.Now())
+	log.Info("Backing up to '%s' every %v, next at %v", w.config.Directory, w.config.Interval, w.nextBackup)
+}
+
+func (w *BackupWorker) Deinit(context.Context) {
+	// Let a running backup finish rather than leave a temporary file behind
+	if w.backupDone != nil {
+		<-w.backupDone
+	}
+}
+
+func (w *BackupWorker) DoWork(ctx context.Context) {
+	if !w.isEnabled() || !w.isStoreConnected || time.Now().Before(w.nextBackup) {
+		return
+	}
+
+	if w.isBackingUp() {
+		log.Warn("Skipping the backup due at %v, the previous backup is still running", w.nextBackup)
+		w.nextBackup = w.scheduleAfter(time.Now())
+		return
+	}
+
+	w.nextBackup = w.scheduleAfter(time.Now())
+
+	// The store is only used from the worker goroutine. Taking the snapshot blocks it, but
+	// encoding, compressing and writing the snapshot, which take longer, do not.
+	ss := snapshot.ToPb(w.store.CreateSnapshot(ctx))
+
+	done := make(chan struct{})
+	w.backupDone = done
+
+	go func() {
+		defer close(done)
+
+		if name, err := w.backup(ss); err != nil {
+			log.Error("Could not back up the database: %v", err)
+		} else {
+			log.Info("Backed up the database to '%s'", name)
+		}
+
+		if err := w.prune(); err != nil {
+			log.Error("Could not remove expired backups: %v", err)
+		}
+	}()
+}
+
+// isBackingUp reports whether a backup is running in the background
+func (w *BackupWorker) isBackingUp() bool {
+	if w.backupDone == nil {
+		return false
+	}
+
+	select {
+	case <-w.backupDone:
+		w.backupDone = nil
+		return false
+	default:
+		return true
+	}
+}
+
+func (w *BackupWorker) OnStoreConnected(context.Context) {
+	w.isStoreConnected = true
+}
+
+func (w *BackupWorker) OnStoreDisconnected() {
+	w.isStoreConnected = false
+}
+
+func (w *BackupWorker) OnNewClientMessage(ctx context.Context, args ...interface{}) {
+	client := args[0].(web.Client)
+	msg := args[1].(web.Message)
+
+	if gatewayMessageType(msg.Payload) == WebGatewayListBackupsRequestType {
+		w.onGatewayListBackupsRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayDownloadBackupRequestType {
+		w.onGatewayDownloadBackupRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayRestoreBackupRequestType {
+		w.onGatewayRestoreBackupRequest(ctx, client, msg)
+	}
+}
+
+func (w *BackupWorker) onGatewayListBackupsRequest(_ context.Context, client web.Client, msg web.Message) {
+	if !w.isEnabled() {
+		writeGatewayError(client, msg, GatewayErrorRequestFailed, "backups are not configured")
+		return
+	}
+
+	backups, err := w.listBackups()
+	if err != nil {
+		log.Error("Could not list backups: %v", err)
+		writeGatewayError(client, msg, GatewayErrorInternal, "could not list backups: %v", err)
+		return
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayListBackupsResponseType, &WebGatewayListBackupsResponse{Backups: backups})
+}
+
+func (w *BackupWorker) onGatewayDownloadBackupRequest(_ context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayDownloadBackupRequest)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayDownloadBackupRequestType, err)
+		return
+	}
+
+	b, ok := w.readBackupOrError(client, msg, req.Name)
+	if !ok {
+		return
+	}
+
+	// Like WebGatewayCreateSnapshotRequest, only what the principal may read is returned
+	ss := new(protobufs.DatabaseSnapshot)
+	if err := protojson.Unmarshal(b, ss); err != nil {
+		log.Error("Could not decode backup '%s': %v", req.Name, err)
+		writeGatewayError(client, msg, GatewayErrorInternal, "could not decode backup '%s': %v", req.Name, err)
+		return
+	}
+
+	b, err := protojson.Marshal(permittedSnapshot(w.policy, principalOf(client), WebGatewayDownloadBackupRequestType, ss))
+	if err != nil {
+		log.Error("Could not marshal snapshot: %v", err)
+		writeGatewayError(client, msg, GatewayErrorInternal, "could not encode snapshot: %v", err)
+		return
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayDownloadBackupResponseType, &WebGatewayDownloadBackupResponse{
+		Name:     req.Name,
+		Snapshot: b,
+	})
+}
+
+func (w *BackupWorker) onGatewayRestoreBackupRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayRestoreBackupRequest)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayRestoreBackupRequestType, err)
+		return
+	}
+
+	b, ok := w.readBackupOrError(client, msg, req.Name)
+	if !ok {
+		return
+	}
+
+	ss := new(protobufs.DatabaseSnapshot)
+	if err := protojson.Unmarshal(b, ss); err != nil {
+		log.Error("Could not decode backup '%s': %v", req.Name, err)
+		writeGatewayError(client, msg, GatewayErrorInternal, "could not decode backup '%s': %v", req.Name, err)
+		return
+	}
+
+	log.Info("Restoring backup '%s'", req.Name)
+	w.store.RestoreSnapshot(ctx, snapshot.FromPb(ss))
+
+	writeGatewayResponse(client, msg, WebGatewayRestoreBackupResponseType, &WebGatewayRestoreBackupResponse{
+		Name:     req.Name,
+		Schemas:  len(ss.EntitySchemas),
+		Entities: len(ss.Entities),
+		Fields:   len(ss.Fields),
+	})
+	triggerSchemaUpdate(ctx, w.store)
+}
+
+// readBackupOrError reads the backup name. If it cannot be read, the error is written to
+// client and false is returned.
+func (w *BackupWorker) readBackupOrError(client web.Client, msg web.Message, name string) ([]byte, bool) {
+	if !w.isEnabled() {
+		writeGatewayError(client, msg, GatewayErrorRequestFailed, "backups are not configured")
+		return nil, false
+	}
+
+	if _, ok := parseBackupName(name); !ok {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "backup '%s' does not exist", name)
+		return nil, false
+	}
+
+	b, err := w.readBackup(name)
+	if errors.Is(err, os.ErrNotExist) {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "backup '%s' does not exist", name)
+		return nil, false
+	} else if err != nil {
+		log.Error("Could not read backup '%s': %v", name, err)
+		writeGatewayError(client, msg, GatewayErrorInternal, "could not read backup '%s': %v", name, err)
+		return nil, false
+	}
+
+	return b, true
+}
+
+func (w *BackupWorker) isEnabled() bool {
+	return w.config.Directory != ""
+}
+
+// scheduleAfter returns the first multiple of the backup interval after t. Multiples are
+// counted from the zero time, so they fall on midnight UTC only for intervals that divide a day.
+func (w *BackupWorker) scheduleAfter(t time.Time) time.Time {
+	return t.Truncate(w.config.Interval).Add(w.config.Interval)
+}
+
+// backup writes ss to the backup directory and returns its name. The snapshot is written to a
+// temporary file first, so a backup is never left half written.
+func (w *BackupWorker) backup(ss *protobufs.DatabaseSnapshot) (string, error) {
+	b, err := protojson.Marshal(ss)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(w.config.Directory, ".snapshot-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(b); err != nil {
+		return "", err
+	}
+
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	name := backupName(time.Now())
+	if err := os.Rename(f.Name(), filepath.Join(w.config.Directory, name)); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// listBackups returns the backups in the backup directory, newest first
+func (w *BackupWorker) listBackups() ([]WebGatewayBackup, error) {
+	entries, err := os.ReadDir(w.config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []WebGatewayBackup{}
+	for _, entry := range entries {
+		t, ok := parseBackupName(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+
+		backups = append(backups, WebGatewayBackup{Name: entry.Name(), Time: t, Size: info.Size()})
+	}
+
+	slices.SortFunc(backups, func(a WebGatewayBackup, b WebGatewayBackup) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	return backups, nil
+}
+
+func (w *BackupWorker) readBackup(name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(w.config.Directory, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// prune removes the backups that are not retained
+func (w *BackupWorker) prune() error {
+	backups, err := w.listBackups()
+	if err != nil {
+		return err
+	}
+
+	retained := retainedBackups(backups, w.config)
+	for _, b := range backups {
+		if retained[b.Name] {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(w.config.Directory, b.Name)); err != nil {
+			return err
+		}
+
+		log.Info("Removed expired backup '%s'", b.Name)
+	}
+
+	return nil
+}
+
+// retainedBackups returns the names of the backups to keep: the newest backup of each of the
+// KeepHourly most recent hours, KeepDaily most recent days and KeepWeekly most recent weeks
+// that have a backup. backups must be sorted newest first.
+func retainedBackups(backups []WebGatewayBackup, config BackupConfig) map[string]bool {
+	periods := []struct {
+		keep   int
+		period func(time.Time) string
+	}{
+		{config.KeepHourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{config.KeepDaily, func(t time.Time) string { return t.Format("20060102") }},
+		{config.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+	}
+
+	retained := map[string]bool{}
+	for _, p := range periods {
+		seen := map[string]bool{}
+		for _, b := range backups {
+			key := p.period(b.Time.UTC())
+			if seen[key] {
+				continue
+			}
+
+			if len(seen) == p.keep {
+				break
+			}
+
+			seen[key] = true
+			retained[b.Name] = true
+		}
+	}
+
+	return retained
+}
+
+func backupName(t time.Time) string {
+	return BackupFilePrefix + t.UTC().Format(BackupTimeLayout) + BackupFileSuffix
+}
+
+// parseBackupName returns the time of the backup name, or false if name does not name a backup
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, BackupFilePrefix) || !strings.HasSuffix(name, BackupFileSuffix) {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(BackupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, BackupFilePrefix), BackupFileSuffix))
+	if err != nil || backupName(t) != name {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
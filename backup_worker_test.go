@@ -0,0 +1,161 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestRetainedBackups(t *testing.T) {
+	at := func(value string) time.Time {
+		v, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return v
+	}
+
+	newBackups := func(times ...string) []WebGatewayBackup {
+		backups := []WebGatewayBackup{}
+		for _, value := range times {
+			backups = append(backups, WebGatewayBackup{Name: value, Time: at(value)})
+		}
+
+		return backups
+	}
+
+	tests := []struct {
+		name     string
+		config   BackupConfig
+		backups  []WebGatewayBackup
+		expected []string
+	}{
+		{
+			"no backups",
+			BackupConfig{KeepHourly: 24, KeepDaily: 7, KeepWeekly: 4},
+			newBackups(),
+			[]string{},
+		},
+		{
+			"newest of each hour",
+			BackupConfig{KeepHourly: 2},
+			newBackups("2024-07-04T10:30:00Z", "2024-07-04T10:00:00Z", "2024-07-04T09:45:00Z", "2024-07-04T08:00:00Z"),
+			[]string{"2024-07-04T10:30:00Z", "2024-07-04T09:45:00Z"},
+		},
+		{
+			"hours without backups are not counted",
+			BackupConfig{KeepHourly: 2},
+			newBackups("2024-07-04T10:00:00Z", "2024-07-04T06:00:00Z", "2024-07-04T05:00:00Z"),
+			[]string{"2024-07-04T10:00:00Z", "2024-07-04T06:00:00Z"},
+		},
+		{
+			"newest of each day",
+			BackupConfig{KeepDaily: 2},
+			newBackups("2024-07-03T01:00:00Z", "2024-07-03T00:00:00Z", "2024-07-02T23:00:00Z", "2024-07-01T12:00:00Z"),
+			[]string{"2024-07-03T01:00:00Z", "2024-07-02T23:00:00Z"},
+		},
+		{
+			"days are in UTC",
+			BackupConfig{KeepDaily: 1},
+			newBackups("2024-07-03T01:00:00+02:00", "2024-07-02T20:00:00Z"),
+			[]string{"2024-07-03T01:00:00+02:00"},
+		},
+		{
+			"newest of each week",
+			BackupConfig{KeepWeekly: 2},
+			// 2024-07-01 is a Monday
+			newBackups("2024-07-03T00:00:00Z", "2024-07-01T00:00:00Z", "2024-06-30T23:00:00Z", "2024-06-24T00:00:00Z", "2024-06-17T00:00:00Z"),
+			[]string{"2024-07-03T00:00:00Z", "2024-06-30T23:00:00Z"},
+		},
+		{
+			"weeks across years",
+			BackupConfig{KeepWeekly: 2},
+			// 2024-12-30 belongs to the first week of 2025
+			newBackups("2025-01-02T00:00:00Z", "2024-12-30T00:00:00Z", "2024-12-29T00:00:00Z"),
+			[]string{"2025-01-02T00:00:00Z", "2024-12-29T00:00:00Z"},
+		},
+		{
+			"rules combine",
+			BackupConfig{KeepHourly: 1, KeepDaily: 2, KeepWeekly: 1},
+			newBackups("2024-07-02T10:00:00Z", "2024-07-02T09:00:00Z", "2024-07-01T20:00:00Z", "2024-07-01T19:00:00Z"),
+			[]string{"2024-07-02T10:00:00Z", "2024-07-01T20:00:00Z"},
+		},
+		{
+			"fewer backups than kept",
+			BackupConfig{KeepHourly: 24},
+			newBackups("2024-07-02T10:00:00Z", "2024-07-02T09:00:00Z"),
+			[]string{"2024-07-02T10:00:00Z", "2024-07-02T09:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := map[string]bool{}
+			for _, name := range tt.expected {
+				expected[name] = true
+			}
+
+			retained := retainedBackups(tt.backups, tt.config)
+			if !maps.Equal(retained, expected) {
+				t.Errorf("expected %v to be retained, got %v", expected, retained)
+			}
+		})
+	}
+}
+
+func TestParseBackupName(t *testing.T) {
+	tests := []struct {
+		name     string
+		backup   string
+		expected time.Time
+		ok       bool
+	}{
+		{"backup", "snapshot-20240704T220000Z.json.gz", time.Date(2024, 7, 4, 22, 0, 0, 0, time.UTC), true},
+		{"round trip", backupName(time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC+2", 2*60*60))), time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC), true},
+		{"missing prefix", "20240704T220000Z.json.gz", time.Time{}, false},
+		{"other prefix", "backup-20240704T220000Z.json.gz", time.Time{}, false},
+		{"missing suffix", "snapshot-20240704T220000Z.json", time.Time{}, false},
+		{"temporary file", ".snapshot-123.tmp", time.Time{}, false},
+		{"invalid time", "snapshot-20241304T220000Z.json.gz", time.Time{}, false},
+		{"partial time", "snapshot-20240704.json.gz", time.Time{}, false},
+		{"path", "../snapshot-20240704T220000Z.json.gz", time.Time{}, false},
+		{"empty", "", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, ok := parseBackupName(tt.backup)
+			if ok != tt.ok {
+				t.Fatalf("expected ok to be %v", tt.ok)
+			}
+
+			if !parsed.Equal(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestScheduleAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		now      time.Time
+		expected time.Time
+	}{
+		{"hourly", time.Hour, time.Date(2024, 7, 4, 10, 30, 0, 0, time.UTC), time.Date(2024, 7, 4, 11, 0, 0, 0, time.UTC)},
+		{"on the hour", time.Hour, time.Date(2024, 7, 4, 10, 0, 0, 0, time.UTC), time.Date(2024, 7, 4, 11, 0, 0, 0, time.UTC)},
+		{"every six hours", 6 * time.Hour, time.Date(2024, 7, 4, 23, 59, 0, 0, time.UTC), time.Date(2024, 7, 5, 0, 0, 0, 0, time.UTC)},
+		{"every fifteen minutes", 15 * time.Minute, time.Date(2024, 7, 4, 10, 16, 0, 0, time.UTC), time.Date(2024, 7, 4, 10, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewBackupWorker(nil, NewDefaultPolicy(), BackupConfig{Interval: tt.interval})
+			if next := w.scheduleAfter(tt.now); !next.Equal(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, next)
+			}
+		})
+	}
+}
@@ -2,28 +2,33 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"sort"
 	"unicode"
 
 	"github.com/rqure/qlib/pkg/app"
 	"github.com/rqure/qlib/pkg/data"
 	"github.com/rqure/qlib/pkg/data/entity"
-	"github.com/rqure/qlib/pkg/data/query"
 	"github.com/rqure/qlib/pkg/data/snapshot"
 	"github.com/rqure/qlib/pkg/log"
 	"github.com/rqure/qlib/pkg/protobufs"
 	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type ConfigWorker struct {
 	store            data.Store
 	isStoreConnected bool
+	policy           *Policy
 }
 
-func NewConfigWorker(store data.Store) *ConfigWorker {
+func NewConfigWorker(store data.Store, policy *Policy) *ConfigWorker {
 	return &ConfigWorker{
 		store:            store,
 		isStoreConnected: false,
+		policy:           policy,
 	}
 }
 
@@ -40,14 +45,7 @@ func (w *ConfigWorker) DoWork(context.Context) {
 }
 
 func (w *ConfigWorker) TriggerSchemaUpdate(ctx context.Context) {
-	roots := query.New(w.store).
-		Select().
-		From("Root").
-		Execute(ctx)
-
-	for _, root := range roots {
-		root.GetField("SchemaUpdateTrigger").WriteInt(ctx)
-	}
+	triggerSchemaUpdate(ctx, w.store)
 }
 
 func (w *ConfigWorker) OnNewClientMessage(ctx context.Context, args ...interface{}) {
@@ -66,12 +64,36 @@ func (w *ConfigWorker) OnNewClientMessage(ctx context.Context, args ...interface
 		w.onConfigGetEntitySchemaRequest(ctx, client, msg)
 	} else if msg.Payload.MessageIs(&protobufs.WebConfigSetEntitySchemaRequest{}) {
 		w.onConfigSetEntitySchemaRequest(ctx, client, msg)
+	} else if msg.Payload.MessageIs(&protobufs.WebConfigGetFieldSchemaRequest{}) {
+		w.onConfigGetFieldSchemaRequest(ctx, client, msg)
+	} else if msg.Payload.MessageIs(&protobufs.WebConfigSetFieldSchemaRequest{}) {
+		w.onConfigSetFieldSchemaRequest(ctx, client, msg)
+	} else if msg.Payload.MessageIs(&protobufs.WebConfigGetAllFieldsRequest{}) {
+		w.onConfigGetAllFieldsRequest(ctx, client, msg)
 	} else if msg.Payload.MessageIs(&protobufs.WebConfigCreateSnapshotRequest{}) {
 		w.onConfigCreateSnapshotRequest(ctx, client, msg)
 	} else if msg.Payload.MessageIs(&protobufs.WebConfigRestoreSnapshotRequest{}) {
 		w.onConfigRestoreSnapshotRequest(ctx, client, msg)
 	} else if msg.Payload.MessageIs(&protobufs.WebConfigGetRootRequest{}) {
 		w.onConfigGetRootRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayGetEntityTreeRequestType {
+		w.onGatewayGetEntityTreeRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayFindEntitiesRequestType {
+		w.onGatewayFindEntitiesRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayRenameEntityRequestType {
+		w.onGatewayRenameEntityRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayMoveEntityRequestType {
+		w.onGatewayMoveEntityRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayCloneEntityRequestType {
+		w.onGatewayCloneEntityRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayCreateSnapshotRequestType {
+		w.onGatewayCreateSnapshotRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayMergeSnapshotRequestType {
+		w.onGatewayMergeSnapshotRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayPreviewRestoreRequestType {
+		w.onGatewayPreviewRestoreRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayDiffSnapshotsRequestType {
+		w.onGatewayDiffSnapshotsRequest(ctx, client, msg)
 	}
 }
 
@@ -98,7 +120,7 @@ func (w *ConfigWorker) onConfigCreateEntityRequest(ctx context.Context, client w
 	}
 
 	log.Info("Created entity: %v", req)
-	w.store.CreateEntity(ctx, req.Type, req.ParentId, req.Name)
+	rsp.Id = w.store.CreateEntity(ctx, req.Type, req.ParentId, req.Name)
 
 	rsp.Status = protobufs.WebConfigCreateEntityResponse_SUCCESS
 	msg.Header.Timestamp = timestamppb.Now()
@@ -147,6 +169,142 @@ func (w *ConfigWorker) onConfigDeleteEntityRequest(ctx context.Context, client w
 	w.TriggerSchemaUpdate(ctx)
 }
 
+func (w *ConfigWorker) onGatewayRenameEntityRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayRenameEntityRequest)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayRenameEntityRequestType, err)
+		return
+	}
+
+	if req.Name == "" {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "name is required")
+		return
+	}
+
+	ent := getEntityPb(ctx, w.store, req.Id)
+	if ent == nil {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist", req.Id)
+		return
+	}
+
+	log.Info("Renamed entity '%s' from '%s' to '%s'", ent.Id, ent.Name, req.Name)
+	ent.Name = req.Name
+	w.store.SetEntity(ctx, entity.FromEntityPb(ent))
+
+	writeGatewayResponse(client, msg, WebGatewayRenameEntityResponseType, &WebGatewayRenameEntityResponse{
+		Entity: marshalEntity(ent),
+	})
+	w.TriggerSchemaUpdate(ctx)
+}
+
+func (w *ConfigWorker) onGatewayMoveEntityRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayMoveEntityRequest)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayMoveEntityRequestType, err)
+		return
+	}
+
+	ent := getEntityPb(ctx, w.store, req.Id)
+	if ent == nil {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist", req.Id)
+		return
+	}
+
+	parent := getEntityPb(ctx, w.store, req.ParentId)
+	if parent == nil {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist", req.ParentId)
+		return
+	}
+
+	previousParentId := ent.GetParent().GetRaw()
+	if previousParentId == "" {
+		writeGatewayError(client, msg, GatewayErrorRequestFailed, "entity '%s' has no parent and cannot be moved", ent.Id)
+		return
+	}
+
+	if slices.Contains(ancestorsOf(ctx, w.store, parent.Id), ent.Id) {
+		writeGatewayError(client, msg, GatewayErrorRequestFailed, "entity '%s' cannot be moved below itself", ent.Id)
+		return
+	}
+
+	if previousParentId != parent.Id {
+		isChild := func(child *protobufs.EntityReference) bool {
+			return child.GetRaw() == ent.Id
+		}
+
+		// The entity's parent is written first, then its new parent's children, and its
+		// previous parent's children last, so that it stays in the tree if a write fails
+		moved := proto.Clone(ent).(*protobufs.DatabaseEntity)
+		moved.Parent = &protobufs.EntityReference{Raw: parent.Id}
+
+		adopted := proto.Clone(parent).(*protobufs.DatabaseEntity)
+		adopted.Children = append(adopted.Children, &protobufs.EntityReference{Raw: ent.Id})
+
+		writes := []entityWrite{
+			{moved, ent, func(stored *protobufs.DatabaseEntity) bool {
+				return stored.GetParent().GetRaw() == parent.Id
+			}},
+			{adopted, parent, func(stored *protobufs.DatabaseEntity) bool {
+				return slices.ContainsFunc(stored.Children, isChild)
+			}},
+		}
+
+		if previous := getEntityPb(ctx, w.store, previousParentId); previous != nil {
+			orphaned := proto.Clone(previous).(*protobufs.DatabaseEntity)
+			orphaned.Children = slices.DeleteFunc(orphaned.Children, isChild)
+
+			writes = append(writes, entityWrite{orphaned, previous, func(stored *protobufs.DatabaseEntity) bool {
+				return !slices.ContainsFunc(stored.Children, isChild)
+			}})
+		}
+
+		if err := w.writeEntities(ctx, writes); err != nil {
+			log.Error("Could not move entity '%s': %v", ent.Id, err)
+			writeGatewayError(client, msg, GatewayErrorRequestFailed, "could not move entity '%s': %v", ent.Id, err)
+			return
+		}
+
+		log.Info("Moved entity '%s' from parent '%s' to '%s'", ent.Id, previousParentId, parent.Id)
+		ent = moved
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayMoveEntityResponseType, &WebGatewayMoveEntityResponse{
+		Entity: marshalEntity(ent),
+	})
+	w.TriggerSchemaUpdate(ctx)
+}
+
+// entityWrite replaces an entity with updated. stored checks that the store holds the update,
+// and previous is written back if it or a later write does not.
+type entityWrite struct {
+	updated  *protobufs.DatabaseEntity
+	previous *protobufs.DatabaseEntity
+	stored   func(*protobufs.DatabaseEntity) bool
+}
+
+// writeEntities applies writes in order. The store does not report failed writes, so each one
+// is read back; if one was not stored, it and the writes before it are reverted in reverse
+// order, like a rolled back transaction.
+func (w *ConfigWorker) writeEntities(ctx context.Context, writes []entityWrite) error {
+	for i, write := range writes {
+		w.store.SetEntity(ctx, entity.FromEntityPb(write.updated))
+
+		if stored := getEntityPb(ctx, w.store, write.updated.Id); stored == nil || !write.stored(stored) {
+			for j := i; j >= 0; j-- {
+				w.store.SetEntity(ctx, entity.FromEntityPb(writes[j].previous))
+			}
+
+			return fmt.Errorf("entity '%s' was not updated", write.updated.Id)
+		}
+	}
+
+	return nil
+}
+
 func (w *ConfigWorker) onConfigGetEntityRequest(ctx context.Context, client web.Client, msg web.Message) {
 	req := new(protobufs.WebConfigGetEntityRequest)
 	rsp := new(protobufs.WebConfigGetEntityResponse)
@@ -321,6 +479,193 @@ func (w *ConfigWorker) onConfigSetEntitySchemaRequest(ctx context.Context, clien
 	w.TriggerSchemaUpdate(ctx)
 }
 
+// entitySchemas returns the schema of every entity type in the store
+func (w *ConfigWorker) entitySchemas(ctx context.Context) []*protobufs.DatabaseEntitySchema {
+	schemas := []*protobufs.DatabaseEntitySchema{}
+
+	for _, entityType := range w.store.GetEntityTypes(ctx) {
+		sch := w.store.GetEntitySchema(ctx, entityType)
+		if sch == nil {
+			continue
+		}
+
+		schemas = append(schemas, entity.ToSchemaPb(sch))
+	}
+
+	return schemas
+}
+
+// Fields are only defined as part of entity schemas, so the schema of a field is the one
+// found in the first entity schema that has it.
+func (w *ConfigWorker) fieldSchema(ctx context.Context, field string) *protobufs.DatabaseFieldSchema {
+	for _, sch := range w.entitySchemas(ctx) {
+		for _, f := range sch.Fields {
+			if f.Name == field {
+				return f
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *ConfigWorker) onConfigGetFieldSchemaRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(protobufs.WebConfigGetFieldSchemaRequest)
+	rsp := new(protobufs.WebConfigGetFieldSchemaResponse)
+
+	if err := msg.Payload.UnmarshalTo(req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		return
+	}
+
+	if !w.isStoreConnected {
+		log.Error("Could not handle request %v. Database is not connected.", req)
+		rsp.Status = protobufs.WebConfigGetFieldSchemaResponse_FAILURE
+		msg.Header.Timestamp = timestamppb.Now()
+		if err := msg.Payload.MarshalFrom(rsp); err != nil {
+			log.Error("Could not marshal response: %v", err)
+			return
+		}
+
+		client.Write(msg)
+		return
+	}
+
+	sch := w.fieldSchema(ctx, req.Field)
+	if sch == nil {
+		log.Error("Could not get field schema: %v", req.Field)
+		rsp.Status = protobufs.WebConfigGetFieldSchemaResponse_FAILURE
+		msg.Header.Timestamp = timestamppb.Now()
+		if err := msg.Payload.MarshalFrom(rsp); err != nil {
+			log.Error("Could not marshal response: %v", err)
+			return
+		}
+
+		client.Write(msg)
+		return
+	}
+
+	rsp.Schema = sch
+	rsp.Status = protobufs.WebConfigGetFieldSchemaResponse_SUCCESS
+	msg.Header.Timestamp = timestamppb.Now()
+	if err := msg.Payload.MarshalFrom(rsp); err != nil {
+		log.Error("Could not marshal response: %v", err)
+		return
+	}
+
+	client.Write(msg)
+}
+
+// onConfigSetFieldSchemaRequest changes the type of a field in every entity schema that has it.
+// Adding or removing fields is done through WebConfigSetEntitySchemaRequest.
+func (w *ConfigWorker) onConfigSetFieldSchemaRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(protobufs.WebConfigSetFieldSchemaRequest)
+	rsp := new(protobufs.WebConfigSetFieldSchemaResponse)
+
+	if err := msg.Payload.UnmarshalTo(req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		return
+	}
+
+	if !w.isStoreConnected {
+		log.Error("Could not handle request %v. Database is not connected.", req)
+		rsp.Status = protobufs.WebConfigSetFieldSchemaResponse_FAILURE
+		msg.Header.Timestamp = timestamppb.Now()
+		if err := msg.Payload.MarshalFrom(rsp); err != nil {
+			log.Error("Could not marshal response: %v", err)
+			return
+		}
+
+		client.Write(msg)
+		return
+	}
+
+	if req.Schema == nil || req.Schema.Type == "" || (req.Schema.Name != "" && req.Schema.Name != req.Field) {
+		log.Error("Could not handle request %v. Field schema is invalid.", req)
+		rsp.Status = protobufs.WebConfigSetFieldSchemaResponse_FAILURE
+		msg.Header.Timestamp = timestamppb.Now()
+		if err := msg.Payload.MarshalFrom(rsp); err != nil {
+			log.Error("Could not marshal response: %v", err)
+			return
+		}
+
+		client.Write(msg)
+		return
+	}
+
+	updated := []*protobufs.DatabaseEntitySchema{}
+	for _, sch := range w.entitySchemas(ctx) {
+		for _, f := range sch.Fields {
+			if f.Name == req.Field {
+				f.Type = req.Schema.Type
+				updated = append(updated, sch)
+			}
+		}
+	}
+
+	if len(updated) == 0 {
+		log.Error("Could not handle request %v. Field does not exist in any entity schema.", req)
+		rsp.Status = protobufs.WebConfigSetFieldSchemaResponse_FAILURE
+		msg.Header.Timestamp = timestamppb.Now()
+		if err := msg.Payload.MarshalFrom(rsp); err != nil {
+			log.Error("Could not marshal response: %v", err)
+			return
+		}
+
+		client.Write(msg)
+		return
+	}
+
+	log.Info("Set field schema: %v", req)
+	for _, sch := range updated {
+		w.store.SetEntitySchema(ctx, entity.FromSchemaPb(sch))
+	}
+
+	rsp.Status = protobufs.WebConfigSetFieldSchemaResponse_SUCCESS
+	msg.Header.Timestamp = timestamppb.Now()
+	if err := msg.Payload.MarshalFrom(rsp); err != nil {
+		log.Error("Could not marshal response: %v", err)
+		return
+	}
+
+	client.Write(msg)
+	w.TriggerSchemaUpdate(ctx)
+}
+
+func (w *ConfigWorker) onConfigGetAllFieldsRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(protobufs.WebConfigGetAllFieldsRequest)
+	rsp := new(protobufs.WebConfigGetAllFieldsResponse)
+
+	if err := msg.Payload.UnmarshalTo(req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		return
+	}
+
+	rsp.Fields = []string{}
+	if w.isStoreConnected {
+		seen := map[string]bool{}
+		for _, sch := range w.entitySchemas(ctx) {
+			for _, f := range sch.Fields {
+				if !seen[f.Name] {
+					seen[f.Name] = true
+					rsp.Fields = append(rsp.Fields, f.Name)
+				}
+			}
+		}
+	} else {
+		log.Error("Could not handle request %v. Database is not connected.", req)
+	}
+
+	sort.Strings(rsp.Fields)
+	msg.Header.Timestamp = timestamppb.Now()
+	if err := msg.Payload.MarshalFrom(rsp); err != nil {
+		log.Error("Could not marshal response: %v", err)
+		return
+	}
+
+	client.Write(msg)
+}
+
 func (w *ConfigWorker) onConfigCreateSnapshotRequest(ctx context.Context, client web.Client, msg web.Message) {
 	req := new(protobufs.WebConfigCreateSnapshotRequest)
 	rsp := new(protobufs.WebConfigCreateSnapshotResponse)
@@ -433,5 +778,5 @@ func (w *ConfigWorker) OnStoreConnected(context.Context) {
 }
 
 func (w *ConfigWorker) OnStoreDisconnected() {
-	w.isStoreConnected = true
+	w.isStoreConnected = false
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMoveEntity(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            string
+		parentId      string
+		failSetEntity string
+		errCode       string
+	}{
+		{"moved", "pump", "site2", "", ""},
+		{"below itself", "site1", "pump", "", GatewayErrorRequestFailed},
+		{"entity not written", "pump", "site2", "pump", GatewayErrorRequestFailed},
+		{"new parent not written", "pump", "site2", "site2", GatewayErrorRequestFailed},
+		{"previous parent not written", "pump", "site2", "site1", GatewayErrorRequestFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := newTestSnapshot(t)
+			store := newTestStore(from)
+			store.failSetEntity = map[string]bool{tt.failSetEntity: true}
+
+			w := NewConfigWorker(store, NewDefaultPolicy())
+			w.OnStoreConnected(context.Background())
+
+			payload, err := newGatewayPayload(WebGatewayMoveEntityRequestType, &WebGatewayMoveEntityRequest{Id: tt.id, ParentId: tt.parentId})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &testClient{}
+			w.OnNewClientMessage(context.Background(), client, &protobufs.WebMessage{Header: &protobufs.WebHeader{}, Payload: payload})
+			if len(client.responses) != 1 {
+				t.Fatalf("expected one response, got %d", len(client.responses))
+			}
+
+			gerr := gatewayErrorOf(client.responses[0].Payload)
+			if tt.errCode == "" {
+				if gerr != nil {
+					t.Fatalf("unexpected error: %+v", gerr)
+				}
+
+				if parent := store.entities[tt.id].GetParent().GetRaw(); parent != tt.parentId {
+					t.Errorf("expected parent '%s', got '%s'", tt.parentId, parent)
+				}
+
+				if ancestors := ancestorsOf(context.Background(), store, tt.id); len(ancestors) != 3 || ancestors[1] != tt.parentId {
+					t.Errorf("expected the entity below '%s', got ancestors %v", tt.parentId, ancestors)
+				}
+
+				for id, ent := range store.entities {
+					for _, child := range ent.Children {
+						if child.GetRaw() == tt.id && id != tt.parentId {
+							t.Errorf("expected '%s' to be removed from the children of '%s'", tt.id, id)
+						}
+					}
+				}
+				return
+			}
+
+			if gerr == nil || gerr.Code != tt.errCode {
+				t.Fatalf("expected a %s error, got %+v", tt.errCode, gerr)
+			}
+
+			for _, ent := range from.Entities {
+				if !proto.Equal(store.entities[ent.Id], ent) {
+					t.Errorf("expected entity '%s' to be unchanged, got %v", ent.Id, store.entities[ent.Id])
+				}
+			}
+		})
+	}
+}
+
+func TestCloneEntity(t *testing.T) {
+	policy := &Policy{
+		Principals: map[string][]string{
+			"alice": {RoleAdmin},
+			"carol": {RoleEngineer},
+		},
+		Rules: []PolicyRule{
+			{
+				Effect:      PolicyEffectDeny,
+				Roles:       []string{RoleEngineer},
+				Payloads:    []string{WebGatewayCloneEntityRequestType},
+				Operations:  []string{OperationRead},
+				EntityTypes: []string{"Pump"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		principal string
+		id        string
+		failWrite string
+		errCode   string
+		copied    []string
+	}{
+		{"subtree", "alice", "site1", "", "", []string{"pump", "site1"}},
+		{"entities that may not be read are left out", "carol", "site1", "", "", []string{"site1"}},
+		{"entity that may not be read", "carol", "pump", "", GatewayErrorPermissionDenied, nil},
+		{"field not written", "alice", "site1", "Speed", GatewayErrorRequestFailed, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := newTestSnapshot(t)
+			store := newTestStore(from)
+			store.failWrite = map[string]bool{tt.failWrite: true}
+
+			w := NewConfigWorker(store, policy)
+			w.OnStoreConnected(context.Background())
+
+			payload, err := newGatewayPayload(WebGatewayCloneEntityRequestType, &WebGatewayCloneEntityRequest{Id: tt.id, ParentId: "site2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &testClient{principal: &Principal{Name: tt.principal}}
+			w.OnNewClientMessage(context.Background(), client, &protobufs.WebMessage{Header: &protobufs.WebHeader{}, Payload: payload})
+			if len(client.responses) != 1 {
+				t.Fatalf("expected one response, got %d", len(client.responses))
+			}
+
+			if tt.errCode != "" {
+				if gerr := gatewayErrorOf(client.responses[0].Payload); gerr == nil || gerr.Code != tt.errCode {
+					t.Fatalf("expected a %s error, got %+v", tt.errCode, gerr)
+				}
+
+				if len(store.entities) != len(from.Entities) || !proto.Equal(store.entities["site2"], from.Entities[2]) {
+					t.Errorf("expected the copies to be deleted, got %v", store.entities)
+				}
+				return
+			}
+
+			rsp := new(WebGatewayCloneEntityResponse)
+			if err := unmarshalGatewayPayload(client.responses[0].Payload, rsp); err != nil {
+				t.Fatal(err)
+			}
+
+			copied := []string{}
+			for id := range rsp.Ids {
+				copied = append(copied, id)
+			}
+			slices.Sort(copied)
+
+			if !slices.Equal(copied, tt.copied) {
+				t.Errorf("expected copies of %v, got %v", tt.copied, copied)
+			}
+
+			if len(store.entities) != len(from.Entities)+len(tt.copied) {
+				t.Errorf("expected %d copies, got entities %v", len(tt.copied), store.entities)
+			}
+		})
+	}
+}
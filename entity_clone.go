@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/entity"
+	"github.com/rqure/qlib/pkg/data/request"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// clonedEntity is an entity of the subtree being cloned, along with the access describing it
+type clonedEntity struct {
+	entity *protobufs.DatabaseEntity
+	access *Access
+}
+
+func (w *ConfigWorker) onGatewayCloneEntityRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayCloneEntityRequest)
+	rsp := &WebGatewayCloneEntityResponse{
+		Ids: map[string]string{},
+	}
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayCloneEntityRequestType, err)
+		return
+	}
+
+	if !w.store.EntityExists(ctx, req.ParentId) {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist", req.ParentId)
+		return
+	}
+
+	// The subtree is collected before anything is created, so that an entity can be cloned
+	// below itself
+	subtree := w.clonedSubtree(ctx, req.Id, ancestorsOf(ctx, w.store, req.Id))
+	if len(subtree) == 0 {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist", req.Id)
+		return
+	}
+
+	if len(subtree) > MaxEntityTreeSize {
+		writeGatewayError(client, msg, GatewayErrorRequestFailed, "entity '%s' has more than %d descendants", req.Id, MaxEntityTreeSize)
+		return
+	}
+
+	// Entities the principal may not read are not copied, and neither are their descendants
+	principal := principalOf(client)
+	subtree, err := w.permittedSubtree(principal, subtree)
+	if err != nil {
+		log.Warn("Denied cloning entity '%s' for client %s: %v", req.Id, client.Id(), err)
+		writeGatewayError(client, msg, GatewayErrorPermissionDenied, "%v", err)
+		return
+	}
+
+	// Copies are created below the copy of the entity, so deleting it discards them all
+	discard := func() {
+		if cloneId := rsp.Ids[req.Id]; cloneId != "" {
+			w.store.DeleteEntity(ctx, cloneId)
+		}
+		w.TriggerSchemaUpdate(ctx)
+	}
+
+	for i, c := range subtree {
+		parentId := req.ParentId
+		name := c.entity.Name
+		if i == 0 {
+			if req.Name != "" {
+				name = req.Name
+			}
+		} else {
+			parentId = rsp.Ids[c.entity.GetParent().GetRaw()]
+		}
+
+		id := w.store.CreateEntity(ctx, c.entity.Type, parentId, name)
+		if id == "" {
+			log.Error("Could not create copy of entity '%s'", c.entity.Id)
+			discard()
+			writeGatewayError(client, msg, GatewayErrorRequestFailed, "could not create a copy of entity '%s'", c.entity.Id)
+			return
+		}
+
+		rsp.Ids[c.entity.Id] = id
+	}
+
+	for _, c := range subtree {
+		if err := w.copyFields(ctx, principal, c, rsp.Ids[c.entity.Id], req.RewriteReferences, rsp.Ids); err != nil {
+			log.Error("Could not copy the fields of entity '%s': %v", c.entity.Id, err)
+			discard()
+			writeGatewayError(client, msg, GatewayErrorRequestFailed, "could not copy the fields of entity '%s': %v", c.entity.Id, err)
+			return
+		}
+	}
+
+	log.Info("Cloned entity '%s' and %d descendants below '%s'", req.Id, len(subtree)-1, req.ParentId)
+	rsp.Entity = marshalEntity(getEntityPb(ctx, w.store, rsp.Ids[req.Id]))
+	writeGatewayResponse(client, msg, WebGatewayCloneEntityResponseType, rsp)
+	w.TriggerSchemaUpdate(ctx)
+}
+
+// clonedSubtree lists entityId and its descendants, parents before their children
+func (w *ConfigWorker) clonedSubtree(ctx context.Context, entityId string, ancestors []string) []*clonedEntity {
+	subtree := []*clonedEntity{}
+
+	var walk func(string, []string)
+	walk = func(id string, ancestors []string) {
+		ent := getEntityPb(ctx, w.store, id)
+		if ent == nil || len(ancestors) > MaxEntityDepth || len(subtree) > MaxEntityTreeSize {
+			return
+		}
+
+		subtree = append(subtree, &clonedEntity{
+			entity: ent,
+			access: &Access{
+				Payload:    WebGatewayCloneEntityRequestType,
+				Operation:  OperationRead,
+				EntityType: ent.Type,
+				EntityId:   id,
+				Ancestors:  ancestors,
+			},
+		})
+
+		for _, child := range ent.Children {
+			walk(child.GetRaw(), append([]string{child.GetRaw()}, ancestors...))
+		}
+	}
+	walk(entityId, ancestors)
+
+	return subtree
+}
+
+// permittedSubtree leaves out the entities of subtree that principal may not read, along with
+// their descendants. It returns an error if the root of the subtree may not be read.
+func (w *ConfigWorker) permittedSubtree(principal *Principal, subtree []*clonedEntity) ([]*clonedEntity, error) {
+	permitted := []*clonedEntity{}
+	isPermitted := map[string]bool{}
+
+	for i, c := range subtree {
+		if i > 0 && !isPermitted[c.entity.GetParent().GetRaw()] {
+			continue
+		}
+
+		if err := w.policy.Authorize(principal, c.access); err != nil {
+			if i == 0 {
+				return nil, err
+			}
+
+			log.Trace("Left entity '%s' out of the clone: %v", c.entity.Id, err)
+			continue
+		}
+
+		isPermitted[c.entity.Id] = true
+		permitted = append(permitted, c)
+	}
+
+	return permitted, nil
+}
+
+// copyFields writes the field values of c that principal may read to the entity cloneId. If
+// rewriteReferences is set, entity references found in ids are replaced with the copies. An
+// error is returned if a field could not be written.
+func (w *ConfigWorker) copyFields(ctx context.Context, principal *Principal, c *clonedEntity, cloneId string, rewriteReferences bool, ids map[string]string) error {
+	sch := w.store.GetEntitySchema(ctx, c.entity.Type)
+	if sch == nil {
+		return nil
+	}
+
+	fields := []string{}
+	for _, f := range entity.ToSchemaPb(sch).Fields {
+		fields = append(fields, f.Name)
+	}
+
+	values := readPermittedFields(ctx, w.store, w.policy, principal, c.access, fields)
+
+	writes := []*protobufs.DatabaseRequest{}
+	reqs := []data.Request{}
+	for _, field := range fields {
+		value := values[field]
+		if !value.Success || value.Value == nil {
+			continue
+		}
+
+		if rewriteReferences {
+			value.Value = rewriteReference(value.Value, ids)
+		}
+
+		r := &protobufs.DatabaseRequest{
+			Id:    cloneId,
+			Field: field,
+			Value: value.Value,
+		}
+		writes = append(writes, r)
+		reqs = append(reqs, request.FromPb(r))
+	}
+
+	w.store.Write(ctx, reqs...)
+
+	failed := []string{}
+	for _, r := range writes {
+		if !r.Success {
+			failed = append(failed, r.Field)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not write %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// rewriteReference returns value, or a reference to the copy of the entity value refers to
+// if it is an entity reference found in ids
+func rewriteReference(value *anypb.Any, ids map[string]string) *anypb.Any {
+	ref := new(protobufs.EntityReference)
+	if !value.MessageIs(ref) || value.UnmarshalTo(ref) != nil {
+		return value
+	}
+
+	cloneId, ok := ids[ref.Raw]
+	if !ok {
+		return value
+	}
+
+	rewritten, err := anypb.New(&protobufs.EntityReference{Raw: cloneId})
+	if err != nil {
+		log.Error("Could not rewrite entity reference: %v", err)
+		return value
+	}
+
+	return rewritten
+}
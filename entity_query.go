@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+)
+
+const (
+	DefaultEntityPageSize = 100
+	MaxEntityPageSize     = 1000
+)
+
+const (
+	ConditionOperatorEquals         = "eq"
+	ConditionOperatorNotEquals      = "ne"
+	ConditionOperatorLessThan       = "lt"
+	ConditionOperatorLessOrEqual    = "lte"
+	ConditionOperatorGreaterThan    = "gt"
+	ConditionOperatorGreaterOrEqual = "gte"
+	ConditionOperatorPrefix         = "prefix"
+)
+
+// entityRow is an entity along with the fields read for it to answer a WebGatewayGetEntitiesRequest
+type entityRow struct {
+	id     string
+	fields map[string]*protobufs.DatabaseRequest
+}
+
+// scalar returns the raw value of field, or nil if it could not be read
+func (r *entityRow) scalar(field string) *scalar {
+	f := r.fields[field]
+	if f == nil || !f.Success {
+		return nil
+	}
+
+	s, _ := scalarValue(f.Value)
+	return s
+}
+
+// matches reports whether all conditions hold for the entity. Conditions on fields that could
+// not be read do not hold. An error is returned if a condition's value cannot be compared
+// with the field's value.
+func (r *entityRow) matches(conditions []WebGatewayFieldCondition) (bool, error) {
+	for _, c := range conditions {
+		value := r.scalar(c.Field)
+		if value == nil {
+			return false, nil
+		}
+
+		operand, err := parseScalar(value.Kind, c.Value)
+		if err != nil {
+			return false, fmt.Errorf("condition on field '%s': %v", c.Field, err)
+		}
+
+		if !conditionHolds(c.Operator, value, operand) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func conditionHolds(operator string, value *scalar, operand *scalar) bool {
+	if operator == ConditionOperatorPrefix {
+		return value.Kind == ScalarString && strings.HasPrefix(value.String, operand.String)
+	}
+
+	c := compareScalars(value, operand)
+	switch operator {
+	case ConditionOperatorEquals:
+		return c == 0
+	case ConditionOperatorNotEquals:
+		return c != 0
+	case ConditionOperatorLessThan:
+		return c < 0
+	case ConditionOperatorLessOrEqual:
+		return c <= 0
+	case ConditionOperatorGreaterThan:
+		return c > 0
+	case ConditionOperatorGreaterOrEqual:
+		return c >= 0
+	default:
+		return false
+	}
+}
+
+// entityPageToken is the position of the last entity of a page. Because the next page starts
+// after that position rather than at an offset, entities created or deleted between pages do
+// not cause others to be skipped or repeated.
+type entityPageToken struct {
+	OrderBy    string  `json:"orderBy"`
+	Descending bool    `json:"descending"`
+	Key        *scalar `json:"key,omitempty"`
+	Id         string  `json:"id"`
+}
+
+func (t *entityPageToken) Encode() string {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return ""
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeEntityPageToken(s string) (*entityPageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token: %v", err)
+	}
+
+	t := new(entityPageToken)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("invalid page token: %v", err)
+	}
+
+	return t, nil
+}
+
+// compareEntities orders entities by key then id, or the reverse if descending. Entities
+// without a key come first.
+func compareEntities(descending bool, aKey *scalar, aId string, bKey *scalar, bId string) int {
+	c := compareKeys(aKey, bKey)
+	if c == 0 {
+		c = strings.Compare(aId, bId)
+	}
+
+	if descending {
+		return -c
+	}
+
+	return c
+}
+
+func compareKeys(a *scalar, b *scalar) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	case a.Kind != b.Kind:
+		return strings.Compare(a.Kind, b.Kind)
+	default:
+		return compareScalars(a, b)
+	}
+}
+
+func validateGetEntitiesRequest(req *WebGatewayGetEntitiesRequest) error {
+	if req.EntityType == "" {
+		return fmt.Errorf("entityType is required")
+	}
+
+	if err := validateEntityLimit(req.Limit); err != nil {
+		return err
+	}
+
+	return validateFieldConditions(req.Where)
+}
+
+func validateEntityLimit(limit int) error {
+	if limit < 0 || limit > MaxEntityPageSize {
+		return fmt.Errorf("limit must be between 0 and %d", MaxEntityPageSize)
+	}
+
+	return nil
+}
+
+func validateFieldConditions(conditions []WebGatewayFieldCondition) error {
+	for i, c := range conditions {
+		if c.Field == "" {
+			return fmt.Errorf("condition %d has no field", i)
+		}
+
+		switch c.Operator {
+		case ConditionOperatorEquals, ConditionOperatorNotEquals,
+			ConditionOperatorLessThan, ConditionOperatorLessOrEqual,
+			ConditionOperatorGreaterThan, ConditionOperatorGreaterOrEqual,
+			ConditionOperatorPrefix:
+		default:
+			return fmt.Errorf("condition %d has unknown operator '%s'", i, c.Operator)
+		}
+	}
+
+	return nil
+}
+
+// fieldsOfGetEntitiesRequest lists the fields that need to be read to answer req
+func fieldsOfGetEntitiesRequest(req *WebGatewayGetEntitiesRequest) []string {
+	fields := []string{}
+	seen := map[string]bool{}
+
+	add := func(field string) {
+		if field != "" && !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	for _, field := range req.Fields {
+		add(field)
+	}
+
+	for _, c := range req.Where {
+		add(c.Field)
+	}
+
+	add(req.OrderBy)
+
+	return fields
+}
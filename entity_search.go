@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/log"
+	web "github.com/rqure/qlib/pkg/web/go"
+)
+
+// entitySearch holds the state of a WebGatewayFindEntitiesRequest while the tree is searched
+type entitySearch struct {
+	req       *WebGatewayFindEntitiesRequest
+	principal *Principal
+	matchName func(string) bool
+	fields    []string
+	limit     int
+	rsp       *WebGatewayFindEntitiesResponse
+}
+
+func (w *ConfigWorker) onGatewayFindEntitiesRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayFindEntitiesRequest)
+	rsp := &WebGatewayFindEntitiesResponse{
+		Matches: []WebGatewayEntityMatch{},
+	}
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayFindEntitiesRequestType, err)
+		return
+	}
+
+	matchName, err := newNameMatcher(req.Name)
+	if err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+		return
+	}
+
+	if err := validateEntityLimit(req.Limit); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+		return
+	}
+
+	if err := validateFieldConditions(req.Where); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+		return
+	}
+
+	search := &entitySearch{
+		req:       req,
+		principal: principalOf(client),
+		matchName: matchName,
+		fields:    fieldsOfGetEntitiesRequest(&WebGatewayGetEntitiesRequest{Where: req.Where}),
+		limit:     req.Limit,
+		rsp:       rsp,
+	}
+
+	if search.limit == 0 {
+		search.limit = DefaultEntityPageSize
+	}
+
+	ancestorId := req.AncestorId
+	if ancestorId == "" {
+		for _, id := range w.store.FindEntities(ctx, "Root") {
+			ancestorId = id
+		}
+	}
+
+	ancestors := ancestorsOf(ctx, w.store, ancestorId)
+	if len(ancestors) == 0 {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist", ancestorId)
+		return
+	}
+
+	pathIds := slices.Clone(ancestors)
+	slices.Reverse(pathIds)
+	names := []string{}
+	for _, id := range pathIds[:len(pathIds)-1] {
+		name := ""
+		access := newEntityAccess(ctx, w.store, WebGatewayFindEntitiesRequestType, OperationRead, id, "")
+		if err := w.policy.Authorize(search.principal, access); err == nil {
+			name = getEntityPb(ctx, w.store, id).GetName()
+		}
+
+		names = append(names, name)
+	}
+
+	if err := w.searchEntities(ctx, search, ancestorId, ancestors, names, pathIds[:len(pathIds)-1]); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+		return
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayFindEntitiesResponseType, rsp)
+}
+
+// searchEntities adds entityId and its descendants that match the search, depth first. Names
+// and ids describe the path from the root down to the entity's parent. Entities the principal
+// may not read are not matched, but their descendants are still searched.
+func (w *ConfigWorker) searchEntities(ctx context.Context, search *entitySearch, entityId string, ancestors []string, names []string, ids []string) error {
+	if search.rsp.Truncated || len(ancestors) > MaxEntityDepth {
+		return nil
+	}
+
+	ent := getEntityPb(ctx, w.store, entityId)
+	if ent == nil {
+		return nil
+	}
+
+	access := &Access{
+		Payload:    WebGatewayFindEntitiesRequestType,
+		Operation:  OperationRead,
+		EntityType: ent.Type,
+		EntityId:   entityId,
+		Ancestors:  ancestors,
+	}
+
+	// The names of entities the principal may not read are empty in their descendants' paths
+	permitted := w.policy.Authorize(search.principal, access) == nil
+	name := ""
+	if permitted {
+		name = ent.Name
+	}
+
+	names = append(slices.Clone(names), name)
+	ids = append(slices.Clone(ids), ent.Id)
+
+	matches := permitted && search.matchName(ent.Name) &&
+		(len(search.req.EntityTypes) == 0 || slices.Contains(search.req.EntityTypes, ent.Type))
+
+	if matches && len(search.req.Where) > 0 {
+		row := &entityRow{
+			id:     entityId,
+			fields: readPermittedFields(ctx, w.store, w.policy, search.principal, access, search.fields),
+		}
+
+		ok, err := row.matches(search.req.Where)
+		if err != nil {
+			return err
+		}
+
+		matches = ok
+	}
+
+	if matches {
+		if len(search.rsp.Matches) == search.limit {
+			search.rsp.Truncated = true
+			return nil
+		}
+
+		search.rsp.Matches = append(search.rsp.Matches, WebGatewayEntityMatch{
+			Id:      ent.Id,
+			Name:    ent.Name,
+			Type:    ent.Type,
+			Path:    names,
+			PathIds: ids,
+		})
+	}
+
+	for _, child := range ent.Children {
+		childAncestors := append([]string{child.GetRaw()}, ancestors...)
+		if err := w.searchEntities(ctx, search, child.GetRaw(), childAncestors, names, ids); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newNameMatcher returns a case-insensitive matcher for pattern, which is a glob pattern if it
+// contains '*', '?' or '[', and a substring otherwise
+func newNameMatcher(pattern string) (func(string) bool, error) {
+	pattern = strings.ToLower(pattern)
+
+	if !strings.ContainsAny(pattern, "*?[") {
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), pattern)
+		}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid name pattern '%s': %v", pattern, err)
+	}
+
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, strings.ToLower(name))
+		return ok
+	}, nil
+}
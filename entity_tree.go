@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+)
+
+// MaxEntityTreeSize bounds the number of entities returned by a WebGatewayGetEntityTreeRequest
+const MaxEntityTreeSize = 50000
+
+// entityTreeWalk holds the state of a WebGatewayGetEntityTreeRequest while its tree is built
+type entityTreeWalk struct {
+	req       *WebGatewayGetEntityTreeRequest
+	principal *Principal
+	remaining int
+	truncated bool
+}
+
+func (w *ConfigWorker) onGatewayGetEntityTreeRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayGetEntityTreeRequest)
+	rsp := new(WebGatewayGetEntityTreeResponse)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayGetEntityTreeRequestType, err)
+		return
+	}
+
+	if req.MaxDepth < 0 {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "maxDepth cannot be negative")
+		return
+	}
+
+	rootId := req.RootId
+	if rootId == "" {
+		for _, id := range w.store.FindEntities(ctx, "Root") {
+			rootId = id
+		}
+	}
+
+	walk := &entityTreeWalk{
+		req:       req,
+		principal: principalOf(client),
+		remaining: MaxEntityTreeSize,
+	}
+
+	var root *entityTreeEntry
+	if ent := getEntityPb(ctx, w.store, rootId); ent != nil {
+		root = w.permittedTreeEntry(walk, ent, ancestorsOf(ctx, w.store, rootId))
+	}
+
+	if root != nil {
+		rsp.Root = w.entityTreeNode(ctx, walk, root, 0)
+	}
+
+	if rsp.Root == nil {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "entity '%s' does not exist or cannot be read", rootId)
+		return
+	}
+
+	rsp.Truncated = walk.truncated
+	writeGatewayResponse(client, msg, WebGatewayGetEntityTreeResponseType, rsp)
+}
+
+// entityTreeEntry is an entity of the tree the principal may read
+type entityTreeEntry struct {
+	ent    *protobufs.DatabaseEntity
+	access *Access
+}
+
+// permittedTreeEntry returns ent as an entry of the tree, or nil if the principal may not read
+// it. Ancestors starts with the entity itself.
+func (w *ConfigWorker) permittedTreeEntry(walk *entityTreeWalk, ent *protobufs.DatabaseEntity, ancestors []string) *entityTreeEntry {
+	access := &Access{
+		Payload:    WebGatewayGetEntityTreeRequestType,
+		Operation:  OperationRead,
+		EntityType: ent.Type,
+		EntityId:   ent.Id,
+		Ancestors:  ancestors,
+	}
+
+	if err := w.policy.Authorize(walk.principal, access); err != nil {
+		return nil
+	}
+
+	return &entityTreeEntry{
+		ent:    ent,
+		access: access,
+	}
+}
+
+// permittedChildren returns the children of entry the principal may read. A child it may not
+// read is skipped, and its own permitted children take its place, so that a denied entity does
+// not hide the entities below it.
+func (w *ConfigWorker) permittedChildren(ctx context.Context, walk *entityTreeWalk, entry *entityTreeEntry) []*entityTreeEntry {
+	children := []*entityTreeEntry{}
+	if len(entry.access.Ancestors) >= MaxEntityDepth {
+		return children
+	}
+
+	for _, child := range entry.ent.Children {
+		ent := getEntityPb(ctx, w.store, child.GetRaw())
+		if ent == nil {
+			continue
+		}
+
+		ancestors := append([]string{ent.Id}, entry.access.Ancestors...)
+		if c := w.permittedTreeEntry(walk, ent, ancestors); c != nil {
+			children = append(children, c)
+			continue
+		}
+
+		denied := &entityTreeEntry{
+			ent:    ent,
+			access: &Access{Ancestors: ancestors},
+		}
+		children = append(children, w.permittedChildren(ctx, walk, denied)...)
+	}
+
+	return children
+}
+
+// entityTreeNode returns the tree below entry. Entities the principal may not read are left
+// out, with their descendants in their place, and so are entities that are filtered out and
+// have no descendants that are not.
+func (w *ConfigWorker) entityTreeNode(ctx context.Context, walk *entityTreeWalk, entry *entityTreeEntry, depth int) *WebGatewayEntityTreeNode {
+	if walk.remaining == 0 {
+		walk.truncated = true
+		return nil
+	}
+	walk.remaining--
+
+	ent := entry.ent
+	children := w.permittedChildren(ctx, walk, entry)
+	node := &WebGatewayEntityTreeNode{
+		Id:         ent.Id,
+		Name:       ent.Name,
+		Type:       ent.Type,
+		Children:   []*WebGatewayEntityTreeNode{},
+		ChildCount: len(children),
+	}
+
+	if walk.req.MaxDepth == 0 || depth < walk.req.MaxDepth {
+		for _, child := range children {
+			if c := w.entityTreeNode(ctx, walk, child, depth+1); c != nil {
+				node.Children = append(node.Children, c)
+			}
+		}
+	}
+
+	matches := len(walk.req.EntityTypes) == 0 || slices.Contains(walk.req.EntityTypes, ent.Type)
+	if !matches {
+		if depth > 0 && len(node.Children) == 0 {
+			// Give back the slot so that filtered out branches do not truncate the tree
+			walk.remaining++
+			return nil
+		}
+
+		return node
+	}
+
+	if len(walk.req.Fields) > 0 {
+		fields := readPermittedFields(ctx, w.store, w.policy, walk.principal, entry.access, walk.req.Fields)
+		for _, field := range walk.req.Fields {
+			node.Fields = append(node.Fields, marshalDatabaseRequest(fields[field]))
+		}
+	}
+
+	return node
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	jsonpb "google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MaxExampleDepth bounds how deep nested messages are filled in, so that recursive
+// messages produce finite examples
+const MaxExampleDepth = 4
+
+// examplePackage is the protobuf package whose messages are served under '/examples'
+func examplePackage() protoreflect.FullName {
+	return (&protobufs.WebMessage{}).ProtoReflect().Descriptor().ParentFile().Package()
+}
+
+func exampleMessageNames() []string {
+	names := []string{}
+
+	protoregistry.GlobalFiles.RangeFilesByPackage(examplePackage(), func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Messages().Len(); i++ {
+			names = append(names, string(fd.Messages().Get(i).Name()))
+		}
+		return true
+	})
+
+	sort.Strings(names)
+	return names
+}
+
+// registerExampleRoutes lists the messages of the protobufs package at '/examples', and
+// serves a WebMessage carrying a sample of any of them at '/examples/{name}'.
+func registerExampleRoutes() {
+	http.HandleFunc("GET /examples", func(wr http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(exampleMessageNames())
+		if err != nil {
+			log.Error("Failed to marshal response: %v", err)
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(b)
+	})
+
+	http.HandleFunc("GET /examples/{name}", func(wr http.ResponseWriter, r *http.Request) {
+		name := examplePackage().Append(protoreflect.Name(r.PathValue("name")))
+		mt, err := protoregistry.GlobalTypes.FindMessageByName(name)
+		if err != nil {
+			log.Error("Failed to find message '%v': %v", name, err)
+			http.Error(wr, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		m := mt.New().Interface()
+		fillExample(m.ProtoReflect(), 0)
+
+		payload, err := anypb.New(m)
+		if err != nil {
+			log.Error("Failed to create payload: %v", err)
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := &protobufs.WebMessage{
+			Header: &protobufs.WebHeader{
+				Timestamp: timestamppb.Now(),
+				Id:        uuid.NewString(),
+			},
+			Payload: payload,
+		}
+
+		marshaller := &jsonpb.MarshalOptions{
+			EmitUnpopulated:   true,
+			EmitDefaultValues: true,
+		}
+		s, err := marshaller.Marshal(response)
+		if err != nil {
+			log.Error("Failed to marshal response: %v", err)
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write([]byte(s))
+	})
+}
+
+// fillExample sets every field of m to a representative value. Repeated and map fields get
+// a single element.
+func fillExample(m protoreflect.Message, depth int) {
+	if depth >= MaxExampleDepth {
+		return
+	}
+
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Any":
+		value, err := anypb.New(&protobufs.String{Raw: "value"})
+		if err == nil {
+			proto.Merge(m.Interface(), value)
+		}
+		return
+	case "google.protobuf.Timestamp":
+		proto.Merge(m.Interface(), timestamppb.Now())
+		return
+	}
+
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		switch {
+		case fd.IsMap():
+			mp := m.Mutable(fd).Map()
+			key := exampleValue(protoreflect.Value{}, fd.MapKey(), depth)
+			mp.Set(key.MapKey(), exampleValue(mp.NewValue(), fd.MapValue(), depth))
+		case fd.IsList():
+			list := m.Mutable(fd).List()
+			list.Append(exampleValue(list.NewElement(), fd, depth))
+		case fd.Message() != nil:
+			fillExample(m.Mutable(fd).Message(), depth+1)
+		default:
+			m.Set(fd, exampleValue(protoreflect.Value{}, fd, depth))
+		}
+	}
+}
+
+// exampleValue returns a sample value for fd. element is the empty message filled in when
+// fd is a message field of a list or map.
+func exampleValue(element protoreflect.Value, fd protoreflect.FieldDescriptor, depth int) protoreflect.Value {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return protoreflect.ValueOfBool(true)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.ValueOfInt32(42)
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.ValueOfInt64(42)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return protoreflect.ValueOfUint32(42)
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return protoreflect.ValueOfUint64(42)
+	case protoreflect.FloatKind:
+		return protoreflect.ValueOfFloat32(4.2)
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(4.2)
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(fd.JSONName())
+	case protoreflect.BytesKind:
+		return protoreflect.ValueOfBytes([]byte(fd.JSONName()))
+	case protoreflect.EnumKind:
+		// Prefer the first value that isn't the zero/unspecified value
+		values := fd.Enum().Values()
+		if values.Len() > 1 {
+			return protoreflect.ValueOfEnum(values.Get(1).Number())
+		}
+		return protoreflect.ValueOfEnum(fd.Default().Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		fillExample(element.Message(), depth+1)
+		return element
+	}
+
+	return fd.Default()
+}
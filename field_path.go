@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/request"
+	"github.com/rqure/qlib/pkg/protobufs"
+)
+
+// FieldPathDelimiter separates the fields of an indirection path such as 'Controller->Setpoint'.
+// Every field but the last must hold an EntityReference.
+const FieldPathDelimiter = "->"
+
+// ParentField refers to an entity's parent in an indirection path, unless the entity has a
+// field of that name
+const ParentField = "Parent"
+
+func isFieldPath(field string) bool {
+	return strings.Contains(field, FieldPathDelimiter)
+}
+
+// firstFieldOf returns the field read first when resolving field, which may be a path
+func firstFieldOf(field string) string {
+	return strings.SplitN(field, FieldPathDelimiter, 2)[0]
+}
+
+// resolveFieldPath follows the entity references along path from entityId, and returns the
+// entity holding the last field of path along with that field. authorize is called before
+// each reference is read; the last field is left for the caller to authorize.
+func resolveFieldPath(ctx context.Context, store data.Store, entityId string, path string, authorize func(entityId string, field string) error) (string, string, *WebGatewayError) {
+	fields := strings.Split(path, FieldPathDelimiter)
+	for _, field := range fields {
+		if strings.TrimSpace(field) != field || field == "" {
+			return "", "", &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: fmt.Sprintf("invalid field path '%s'", path)}
+		}
+	}
+
+	id := entityId
+	for _, field := range fields[:len(fields)-1] {
+		if err := authorize(id, field); err != nil {
+			return "", "", &WebGatewayError{Code: GatewayErrorPermissionDenied, Message: err.Error()}
+		}
+
+		next, err := referencedEntity(ctx, store, id, field)
+		if err != nil {
+			return "", "", err
+		}
+
+		id = next
+	}
+
+	return id, fields[len(fields)-1], nil
+}
+
+// referencedEntity returns the id of the entity referenced by field of entityId
+func referencedEntity(ctx context.Context, store data.Store, entityId string, field string) (string, *WebGatewayError) {
+	r := &protobufs.DatabaseRequest{Id: entityId, Field: field}
+	store.Read(ctx, request.FromPb(r))
+
+	if r.Success {
+		ref := new(protobufs.EntityReference)
+		if r.Value == nil || r.Value.UnmarshalTo(ref) != nil {
+			return "", &WebGatewayError{Code: GatewayErrorRequestFailed, Message: fmt.Sprintf("field '%s' of entity '%s' is not an entity reference", field, entityId)}
+		}
+
+		if ref.Raw == "" {
+			return "", &WebGatewayError{Code: GatewayErrorNotFound, Message: fmt.Sprintf("field '%s' of entity '%s' does not reference an entity", field, entityId)}
+		}
+
+		return ref.Raw, nil
+	}
+
+	if field == ParentField {
+		if parentId := getEntityPb(ctx, store, entityId).GetParent().GetRaw(); parentId != "" {
+			return parentId, nil
+		}
+
+		return "", &WebGatewayError{Code: GatewayErrorNotFound, Message: fmt.Sprintf("entity '%s' has no parent", entityId)}
+	}
+
+	return "", &WebGatewayError{Code: GatewayErrorNotFound, Message: fmt.Sprintf("could not read field '%s' of entity '%s'", field, entityId)}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	ScalarNumber = "number"
+	ScalarString = "string"
+	ScalarBool   = "bool"
+	ScalarTime   = "time"
+)
+
+// scalar is the raw value of a field value, in a form that values of the same kind can be
+// compared in. Entity references and other string based values are strings.
+type scalar struct {
+	Kind   string    `json:"kind"`
+	Number float64   `json:"number,omitempty"`
+	String string    `json:"string,omitempty"`
+	Bool   bool      `json:"bool,omitempty"`
+	Time   time.Time `json:"time,omitempty"`
+}
+
+// valuesEqual reports whether two field values hold the same type and content. Values that
+// cannot be decoded are compared by their encoding.
+func valuesEqual(a *anypb.Any, b *anypb.Any) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if a.TypeUrl != b.TypeUrl {
+		return false
+	}
+
+	am, aErr := a.UnmarshalNew()
+	bm, bErr := b.UnmarshalNew()
+	if aErr != nil || bErr != nil {
+		return proto.Equal(a, b)
+	}
+
+	return proto.Equal(am, bm)
+}
+
+// numericValue returns the raw value of a numeric field value such as an Int or a Float
+func numericValue(v *anypb.Any) (float64, bool) {
+	if v == nil {
+		return 0, false
+	}
+
+	m, err := v.UnmarshalNew()
+	if err != nil {
+		return 0, false
+	}
+
+	fd := m.ProtoReflect().Descriptor().Fields().ByName("raw")
+	if fd == nil || fd.IsList() || fd.IsMap() {
+		return 0, false
+	}
+
+	raw := m.ProtoReflect().Get(fd)
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return float64(raw.Int()), true
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(raw.Uint()), true
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return raw.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// scalarValue returns the raw value of a field value such as an Int, a String or a Timestamp
+func scalarValue(v *anypb.Any) (*scalar, bool) {
+	if v == nil {
+		return nil, false
+	}
+
+	if n, ok := numericValue(v); ok {
+		return &scalar{Kind: ScalarNumber, Number: n}, true
+	}
+
+	m, err := v.UnmarshalNew()
+	if err != nil {
+		return nil, false
+	}
+
+	fd := m.ProtoReflect().Descriptor().Fields().ByName("raw")
+	if fd == nil || fd.IsList() || fd.IsMap() {
+		return nil, false
+	}
+
+	raw := m.ProtoReflect().Get(fd)
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return &scalar{Kind: ScalarString, String: raw.String()}, true
+	case protoreflect.BoolKind:
+		return &scalar{Kind: ScalarBool, Bool: raw.Bool()}, true
+	case protoreflect.MessageKind:
+		if ts, ok := raw.Message().Interface().(*timestamppb.Timestamp); ok {
+			return &scalar{Kind: ScalarTime, Time: ts.AsTime()}, true
+		}
+	}
+
+	return nil, false
+}
+
+// parseScalar decodes a bare JSON value as a scalar of the given kind. Times are RFC 3339
+// strings.
+func parseScalar(kind string, raw json.RawMessage) (*scalar, error) {
+	s := &scalar{Kind: kind}
+
+	var err error
+	switch kind {
+	case ScalarNumber:
+		err = json.Unmarshal(raw, &s.Number)
+	case ScalarString:
+		err = json.Unmarshal(raw, &s.String)
+	case ScalarBool:
+		err = json.Unmarshal(raw, &s.Bool)
+	case ScalarTime:
+		err = json.Unmarshal(raw, &s.Time)
+	default:
+		err = fmt.Errorf("unknown kind '%s'", kind)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("expected a %s: %v", kind, err)
+	}
+
+	return s, nil
+}
+
+// compareScalars orders a and b, which must be of the same kind
+func compareScalars(a *scalar, b *scalar) int {
+	switch a.Kind {
+	case ScalarNumber:
+		return cmp.Compare(a.Number, b.Number)
+	case ScalarString:
+		return strings.Compare(a.String, b.String)
+	case ScalarBool:
+		if a.Bool == b.Bool {
+			return 0
+		} else if b.Bool {
+			return -1
+		}
+		return 1
+	case ScalarTime:
+		return a.Time.Compare(b.Time)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The qdb protobufs are owned by qlib, so messages that only exist in the gateway are carried
+// as google.protobuf.Struct payloads. The "messageType" key names the gateway message.
+const GatewayMessageTypeKey = "messageType"
+
+const (
+	WebGatewayErrorType                    = "WebGatewayError"
+	WebGatewayGetNotificationsRequestType  = "WebGatewayGetNotificationsRequest"
+	WebGatewayGetNotificationsResponseType = "WebGatewayGetNotificationsResponse"
+	WebGatewayTransactionRequestType       = "WebGatewayTransactionRequest"
+	WebGatewayTransactionResponseType      = "WebGatewayTransactionResponse"
+	WebGatewayConditionalWriteRequestType  = "WebGatewayConditionalWriteRequest"
+	WebGatewayConditionalWriteResponseType = "WebGatewayConditionalWriteResponse"
+	WebGatewayGetEntitiesRequestType       = "WebGatewayGetEntitiesRequest"
+	WebGatewayGetEntitiesResponseType      = "WebGatewayGetEntitiesResponse"
+	WebGatewayGetEntityTreeRequestType     = "WebGatewayGetEntityTreeRequest"
+	WebGatewayGetEntityTreeResponseType    = "WebGatewayGetEntityTreeResponse"
+	WebGatewayFindEntitiesRequestType      = "WebGatewayFindEntitiesRequest"
+	WebGatewayFindEntitiesResponseType     = "WebGatewayFindEntitiesResponse"
+	WebGatewayRenameEntityRequestType      = "WebGatewayRenameEntityRequest"
+	WebGatewayRenameEntityResponseType     = "WebGatewayRenameEntityResponse"
+	WebGatewayMoveEntityRequestType        = "WebGatewayMoveEntityRequest"
+	WebGatewayMoveEntityResponseType       = "WebGatewayMoveEntityResponse"
+	WebGatewayCloneEntityRequestType       = "WebGatewayCloneEntityRequest"
+	WebGatewayCloneEntityResponseType      = "WebGatewayCloneEntityResponse"
+	WebGatewayCreateSnapshotRequestType    = "WebGatewayCreateSnapshotRequest"
+	WebGatewayCreateSnapshotResponseType   = "WebGatewayCreateSnapshotResponse"
+	WebGatewayMergeSnapshotRequestType     = "WebGatewayMergeSnapshotRequest"
+	WebGatewayMergeSnapshotResponseType    = "WebGatewayMergeSnapshotResponse"
+	WebGatewayPreviewRestoreRequestType    = "WebGatewayPreviewRestoreRequest"
+	WebGatewayPreviewRestoreResponseType   = "WebGatewayPreviewRestoreResponse"
+	WebGatewayDiffSnapshotsRequestType     = "WebGatewayDiffSnapshotsRequest"
+	WebGatewayDiffSnapshotsResponseType    = "WebGatewayDiffSnapshotsResponse"
+	WebGatewayListBackupsRequestType       = "WebGatewayListBackupsRequest"
+	WebGatewayListBackupsResponseType      = "WebGatewayListBackupsResponse"
+	WebGatewayDownloadBackupRequestType    = "WebGatewayDownloadBackupRequest"
+	WebGatewayDownloadBackupResponseType   = "WebGatewayDownloadBackupResponse"
+	WebGatewayRestoreBackupRequestType     = "WebGatewayRestoreBackupRequest"
+	WebGatewayRestoreBackupResponseType    = "WebGatewayRestoreBackupResponse"
+)
+
+const (
+	WriteModeAlways   = "always"
+	WriteModeOnChange = "onChange"
+	WriteModeDeadband = "deadband"
+)
+
+const (
+	GatewayErrorUnauthenticated   = "UNAUTHENTICATED"
+	GatewayErrorPermissionDenied  = "PERMISSION_DENIED"
+	GatewayErrorNotFound          = "NOT_FOUND"
+	GatewayErrorRequestFailed     = "REQUEST_FAILED"
+	GatewayErrorUnknownType       = "UNKNOWN_TYPE"
+	GatewayErrorMalformedRequest  = "MALFORMED_REQUEST"
+	GatewayErrorStoreDisconnected = "STORE_DISCONNECTED"
+	GatewayErrorTimeout           = "TIMEOUT"
+	GatewayErrorInternal          = "INTERNAL"
+	GatewayErrorConditionFailed   = "CONDITION_FAILED"
+)
+
+type WebGatewayError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestId"`
+}
+
+func (e *WebGatewayError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// WebGatewayGetNotificationsRequest drains the client's notification queue like
+// WebRuntimeGetNotificationsRequest, and also reports how many notifications were dropped
+// because the queue overflowed since the last time it was asked.
+type WebGatewayGetNotificationsRequest struct {
+}
+
+type WebGatewayGetNotificationsResponse struct {
+	// Notifications are JSON encoded protobufs.DatabaseNotification messages
+	Notifications  []json.RawMessage `json:"notifications"`
+	Dropped        uint64            `json:"dropped"`
+	DroppedByToken map[string]uint64 `json:"droppedByToken"`
+}
+
+// WebGatewayTransactionRequest applies its operations in order, or none of them. Each
+// operation is a JSON encoded google.protobuf.Any holding a request, e.g.
+// {"@type": "type.googleapis.com/qdb.WebConfigCreateEntityRequest", ...}. A string equal
+// to "$<n>" within an operation is replaced by the id of the entity created by operation n.
+type WebGatewayTransactionRequest struct {
+	Operations []json.RawMessage `json:"operations"`
+}
+
+type WebGatewayTransactionResponse struct {
+	Committed bool `json:"committed"`
+
+	// Responses are the JSON encoded google.protobuf.Any responses of the applied operations
+	Responses []json.RawMessage `json:"responses"`
+
+	// FailedOperation is the index of the operation that failed, or -1 if committed
+	FailedOperation int              `json:"failedOperation"`
+	Error           *WebGatewayError `json:"error,omitempty"`
+}
+
+// WebGatewayConditionalWriteRequest writes each request only if the field's stored value
+// still matches what the client last saw, and if its write mode calls for it. Each result
+// reports whether its write was applied.
+type WebGatewayConditionalWriteRequest struct {
+	Requests []WebGatewayConditionalWrite `json:"requests"`
+}
+
+type WebGatewayConditionalWrite struct {
+	// Request is the JSON encoded protobufs.DatabaseRequest to write
+	Request json.RawMessage `json:"request"`
+
+	// ExpectedValue is a JSON encoded google.protobuf.Any the stored value must be equal to
+	ExpectedValue json.RawMessage `json:"expectedValue,omitempty"`
+
+	// ExpectedWriteTime is the write time the stored value must have
+	ExpectedWriteTime *time.Time `json:"expectedWriteTime,omitempty"`
+
+	// Mode is one of the WriteMode* constants, and defaults to WriteModeAlways
+	Mode string `json:"mode,omitempty"`
+
+	// Deadband is the absolute change a numeric value must exceed in WriteModeDeadband
+	Deadband float64 `json:"deadband,omitempty"`
+
+	// DeadbandPercent is the change, relative to the stored value, a numeric value must
+	// exceed in WriteModeDeadband. It cannot be set along with Deadband.
+	DeadbandPercent float64 `json:"deadbandPercent,omitempty"`
+}
+
+type WebGatewayConditionalWriteResponse struct {
+	Results []WebGatewayConditionalWriteResult `json:"results"`
+}
+
+type WebGatewayConditionalWriteResult struct {
+	Applied bool `json:"applied"`
+
+	// Suppressed is set when the write was skipped because the value did not change enough
+	// for its write mode
+	Suppressed bool `json:"suppressed"`
+
+	// Current is the JSON encoded protobufs.DatabaseRequest holding the value now stored
+	Current json.RawMessage  `json:"current,omitempty"`
+	Error   *WebGatewayError `json:"error,omitempty"`
+}
+
+// WebGatewayGetEntitiesRequest lists the entities of a type like WebRuntimeGetEntitiesRequest,
+// one page at a time. Entities can be filtered and ordered by their field values, and the
+// values of the projected fields are returned along with each entity.
+type WebGatewayGetEntitiesRequest struct {
+	EntityType string `json:"entityType"`
+
+	// Fields are the fields to return for each entity
+	Fields []string `json:"fields"`
+
+	// Where lists conditions that must all hold for an entity to be returned
+	Where []WebGatewayFieldCondition `json:"where"`
+
+	// OrderBy is the field to order entities by. Entities are ordered by id otherwise, and
+	// entities with equal values are ordered by id. Every page reads OrderBy for every entity
+	// of the type, whereas pages ordered by id only read the fields of the entities they need.
+	OrderBy    string `json:"orderBy"`
+	Descending bool   `json:"descending"`
+
+	// Limit is the maximum number of entities to return, up to MaxEntityPageSize
+	Limit int `json:"limit"`
+
+	// PageToken is the NextPageToken of the previous page, when fetching the next one
+	PageToken string `json:"pageToken"`
+}
+
+type WebGatewayFieldCondition struct {
+	Field string `json:"field"`
+
+	// Operator is one of the ConditionOperator* constants
+	Operator string `json:"operator"`
+
+	// Value is the bare JSON value compared with the field's raw value, e.g. 42, "abc" or
+	// "2024-01-01T00:00:00Z" for a Timestamp
+	Value json.RawMessage `json:"value"`
+}
+
+type WebGatewayGetEntitiesResponse struct {
+	Entities []WebGatewayEntityResult `json:"entities"`
+
+	// NextPageToken fetches the entities following this page, and is empty on the last page
+	NextPageToken string `json:"nextPageToken"`
+}
+
+type WebGatewayEntityResult struct {
+	// Entity is the JSON encoded protobufs.DatabaseEntity
+	Entity json.RawMessage `json:"entity"`
+
+	// Fields are the JSON encoded protobufs.DatabaseRequest of each projected field, in the
+	// order they were requested
+	Fields []json.RawMessage `json:"fields"`
+}
+
+// WebGatewayGetEntityTreeRequest returns the hierarchy below an entity in one response,
+// instead of one WebConfigGetEntityRequest per entity.
+type WebGatewayGetEntityTreeRequest struct {
+	// RootId is the entity at the top of the tree, and defaults to the root entity
+	RootId string `json:"rootId"`
+
+	// MaxDepth is the number of levels of descendants to return. 0 returns all of them.
+	MaxDepth int `json:"maxDepth"`
+
+	// EntityTypes, when set, limits the tree to entities of these types and their ancestors
+	EntityTypes []string `json:"entityTypes"`
+
+	// Fields are the fields to return for each entity of the tree that has them
+	Fields []string `json:"fields"`
+}
+
+type WebGatewayGetEntityTreeResponse struct {
+	Root *WebGatewayEntityTreeNode `json:"root"`
+
+	// Truncated is set when the tree had more than MaxEntityTreeSize entities
+	Truncated bool `json:"truncated"`
+}
+
+type WebGatewayEntityTreeNode struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Fields are the JSON encoded protobufs.DatabaseRequest of each requested field, in the
+	// order they were requested
+	Fields []json.RawMessage `json:"fields,omitempty"`
+
+	Children []*WebGatewayEntityTreeNode `json:"children"`
+
+	// ChildCount is the number of children of the node, including those that are not
+	// returned because of the depth limit or a filter. Children the principal may not read
+	// are not counted, and their permitted children are counted in their place.
+	ChildCount int `json:"childCount"`
+}
+
+// WebGatewayFindEntitiesRequest searches the entity tree for entities by name, type, ancestor
+// and field values. Criteria that are not set match every entity.
+type WebGatewayFindEntitiesRequest struct {
+	// Name is matched case-insensitively against entity names. It is a glob pattern if it
+	// contains '*', '?' or '[', and a substring otherwise.
+	Name string `json:"name"`
+
+	EntityTypes []string `json:"entityTypes"`
+
+	// AncestorId limits the search to the descendants of an entity, and defaults to the root entity
+	AncestorId string `json:"ancestorId"`
+
+	// Where lists conditions on field values that must all hold
+	Where []WebGatewayFieldCondition `json:"where"`
+
+	// Limit is the maximum number of matches to return, up to MaxEntityPageSize
+	Limit int `json:"limit"`
+}
+
+type WebGatewayFindEntitiesResponse struct {
+	Matches []WebGatewayEntityMatch `json:"matches"`
+
+	// Truncated is set when there were more matches than the limit
+	Truncated bool `json:"truncated"`
+}
+
+type WebGatewayEntityMatch struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Path holds the names of the entity's ancestors from the root down to the entity itself
+	Path []string `json:"path"`
+
+	// PathIds holds the ids of the entities in Path
+	PathIds []string `json:"pathIds"`
+}
+
+// WebGatewayRenameEntityRequest changes the name of an entity, keeping its id
+type WebGatewayRenameEntityRequest struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebGatewayRenameEntityResponse struct {
+	// Entity is the JSON encoded protobufs.DatabaseEntity after it was renamed
+	Entity json.RawMessage `json:"entity"`
+}
+
+// WebGatewayMoveEntityRequest moves an entity and its descendants to a new parent, keeping
+// their ids so that entity references to them remain valid
+type WebGatewayMoveEntityRequest struct {
+	Id       string `json:"id"`
+	ParentId string `json:"parentId"`
+}
+
+type WebGatewayMoveEntityResponse struct {
+	// Entity is the JSON encoded protobufs.DatabaseEntity after it was moved
+	Entity json.RawMessage `json:"entity"`
+}
+
+// WebGatewayCloneEntityRequest copies an entity, its descendants and their field values below
+// a new parent. Entities and fields the principal may not read are left out of the copy.
+type WebGatewayCloneEntityRequest struct {
+	Id       string `json:"id"`
+	ParentId string `json:"parentId"`
+
+	// Name is the name of the copy of the entity, and defaults to the entity's name
+	Name string `json:"name"`
+
+	// RewriteReferences makes entity references to entities of the cloned subtree refer to
+	// their copies instead
+	RewriteReferences bool `json:"rewriteReferences"`
+}
+
+type WebGatewayCloneEntityResponse struct {
+	// Entity is the JSON encoded protobufs.DatabaseEntity of the copy of the entity
+	Entity json.RawMessage `json:"entity"`
+
+	// Ids maps the id of each cloned entity to the id of its copy
+	Ids map[string]string `json:"ids"`
+}
+
+// WebGatewayCreateSnapshotRequest creates a snapshot of part of the database: the subtree of
+// an entity and/or the entities of some types, along with their fields and schemas. Entities
+// and fields the client may not read are left out.
+type WebGatewayCreateSnapshotRequest struct {
+	// RootId limits the snapshot to an entity and its descendants
+	RootId string `json:"rootId"`
+
+	// EntityTypes limits the snapshot to entities of these types
+	EntityTypes []string `json:"entityTypes"`
+}
+
+type WebGatewayCreateSnapshotResponse struct {
+	// Snapshot is the JSON encoded protobufs.DatabaseSnapshot
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// WebGatewayMergeSnapshotRequest restores the entities, fields and schemas of a snapshot,
+// typically a partial one, and leaves everything else in the database as it is
+type WebGatewayMergeSnapshotRequest struct {
+	// Snapshot is the JSON encoded protobufs.DatabaseSnapshot
+	Snapshot json.RawMessage `json:"snapshot"`
+
+	// ParentId, when set, becomes the parent of the entities of the snapshot whose parent is
+	// not part of it. They otherwise keep their parent, which must exist.
+	ParentId string `json:"parentId"`
+}
+
+type WebGatewayMergeSnapshotResponse struct {
+	Schemas  int `json:"schemas"`
+	Entities int `json:"entities"`
+	Fields   int `json:"fields"`
+}
+
+// WebGatewayPreviewRestoreRequest compares a snapshot with the database, and describes what
+// restoring it would change without writing anything. Fields the client may not read are left
+// out of the comparison.
+type WebGatewayPreviewRestoreRequest struct {
+	// Snapshot is the JSON encoded protobufs.DatabaseSnapshot
+	Snapshot json.RawMessage `json:"snapshot"`
+
+	// Merge previews a WebGatewayMergeSnapshotRequest with ParentId instead of a
+	// WebConfigRestoreSnapshotRequest
+	Merge    bool   `json:"merge"`
+	ParentId string `json:"parentId"`
+}
+
+type WebGatewayPreviewRestoreResponse struct {
+	Diff *WebGatewaySnapshotDiff `json:"diff"`
+}
+
+// WebGatewayDiffSnapshotsRequest compares two snapshots, such as backups taken at different
+// times, without loading either of them into the database
+type WebGatewayDiffSnapshotsRequest struct {
+	// From and To are JSON encoded protobufs.DatabaseSnapshot
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+type WebGatewayDiffSnapshotsResponse struct {
+	Diff *WebGatewaySnapshotDiff `json:"diff"`
+}
+
+// WebGatewaySnapshotDiff describes the changes from one database state to another. Entity
+// paths are the names of the entity and its ancestors from the root, separated by '/'.
+type WebGatewaySnapshotDiff struct {
+	SchemasAdded    []string                 `json:"schemasAdded"`
+	SchemasRemoved  []string                 `json:"schemasRemoved"`
+	SchemasChanged  []WebGatewaySchemaChange `json:"schemasChanged"`
+	EntitiesAdded   []WebGatewayEntityChange `json:"entitiesAdded"`
+	EntitiesRemoved []WebGatewayEntityChange `json:"entitiesRemoved"`
+	EntitiesMoved   []WebGatewayEntityChange `json:"entitiesMoved"`
+	EntitiesRenamed []WebGatewayEntityChange `json:"entitiesRenamed"`
+	FieldsChanged   []WebGatewayFieldChange  `json:"fieldsChanged"`
+
+	// Summary describes each change on its own line
+	Summary []string `json:"summary"`
+}
+
+type WebGatewaySchemaChange struct {
+	Type          string   `json:"type"`
+	FieldsAdded   []string `json:"fieldsAdded"`
+	FieldsRemoved []string `json:"fieldsRemoved"`
+
+	// FieldsChanged are the fields whose type changed
+	FieldsChanged []string `json:"fieldsChanged"`
+}
+
+type WebGatewayEntityChange struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Path string `json:"path"`
+
+	// PreviousPath is set for moved and renamed entities
+	PreviousPath string `json:"previousPath,omitempty"`
+}
+
+type WebGatewayFieldChange struct {
+	Id    string `json:"id"`
+	Path  string `json:"path"`
+	Field string `json:"field"`
+
+	// Previous and Value are JSON encoded google.protobuf.Any values, and are null if the
+	// field has no value
+	Previous json.RawMessage `json:"previous"`
+	Value    json.RawMessage `json:"value"`
+}
+
+// WebGatewayListBackupsRequest lists the backups taken by the BackupWorker
+type WebGatewayListBackupsRequest struct {
+}
+
+type WebGatewayListBackupsResponse struct {
+	// Backups are sorted newest first
+	Backups []WebGatewayBackup `json:"backups"`
+}
+
+type WebGatewayBackup struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+
+	// Size is the compressed size in bytes
+	Size int64 `json:"size"`
+}
+
+// WebGatewayDownloadBackupRequest returns the snapshot stored in a backup, limited to the
+// entities and fields the client may read
+type WebGatewayDownloadBackupRequest struct {
+	Name string `json:"name"`
+}
+
+type WebGatewayDownloadBackupResponse struct {
+	Name string `json:"name"`
+
+	// Snapshot is the JSON encoded protobufs.DatabaseSnapshot
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// WebGatewayRestoreBackupRequest replaces the database with the snapshot stored in a backup,
+// like WebConfigRestoreSnapshotRequest
+type WebGatewayRestoreBackupRequest struct {
+	Name string `json:"name"`
+}
+
+type WebGatewayRestoreBackupResponse struct {
+	Name     string `json:"name"`
+	Schemas  int    `json:"schemas"`
+	Entities int    `json:"entities"`
+	Fields   int    `json:"fields"`
+}
+
+func newGatewayPayload(messageType string, v interface{}) (*anypb.Any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	m[GatewayMessageTypeKey] = messageType
+
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return anypb.New(s)
+}
+
+// gatewayMessageType returns the gateway message carried by payload, or an empty string
+// if payload is not a gateway message.
+func gatewayMessageType(payload *anypb.Any) string {
+	if !payload.MessageIs(&structpb.Struct{}) {
+		return ""
+	}
+
+	s := new(structpb.Struct)
+	if err := payload.UnmarshalTo(s); err != nil {
+		return ""
+	}
+
+	return s.Fields[GatewayMessageTypeKey].GetStringValue()
+}
+
+func unmarshalGatewayPayload(payload *anypb.Any, v interface{}) error {
+	s := new(structpb.Struct)
+	if err := payload.UnmarshalTo(s); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(s.AsMap())
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func writeGatewayResponse(client web.Client, msg web.Message, messageType string, v interface{}) {
+	payload, err := newGatewayPayload(messageType, v)
+	if err != nil {
+		log.Error("Could not marshal response: %v", err)
+		return
+	}
+
+	msg.Payload = payload
+	msg.Header.Timestamp = timestamppb.Now()
+	client.Write(msg)
+}
+
+// gatewayErrorOf returns the WebGatewayError carried by payload, or nil if payload is not one
+func gatewayErrorOf(payload *anypb.Any) *WebGatewayError {
+	if gatewayMessageType(payload) != WebGatewayErrorType {
+		return nil
+	}
+
+	e := new(WebGatewayError)
+	if err := unmarshalGatewayPayload(payload, e); err != nil {
+		return nil
+	}
+
+	return e
+}
+
+// toGatewayError replaces the payload of msg with a WebGatewayError
+func toGatewayError(msg web.Message, code string, format string, args ...interface{}) web.Message {
+	e := &WebGatewayError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+
+	if msg.Header == nil {
+		msg.Header = &protobufs.WebHeader{}
+	}
+	e.RequestId = msg.Header.Id
+
+	payload, err := newGatewayPayload(WebGatewayErrorType, e)
+	if err != nil {
+		log.Error("Could not marshal response: %v", err)
+	}
+
+	msg.Payload = payload
+	msg.Header.Timestamp = timestamppb.Now()
+	return msg
+}
+
+func writeGatewayError(client web.Client, msg web.Message, code string, format string, args ...interface{}) {
+	client.Write(toGatewayError(msg, code, format, args...))
+}
@@ -5,6 +5,7 @@ go 1.22.7
 require (
 	github.com/google/uuid v1.6.0
 	github.com/rqure/qlib v0.0.53
+	golang.org/x/crypto v0.31.0
 	google.golang.org/protobuf v1.36.1
 )
 
@@ -18,7 +19,6 @@ require (
 	github.com/jackc/pgx/v5 v5.7.2 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
 	github.com/redis/go-redis/v9 v9.7.0 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 )
@@ -2,10 +2,14 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rqure/qlib/pkg/app"
 	"github.com/rqure/qlib/pkg/app/workers"
 	"github.com/rqure/qlib/pkg/data/store"
+	"github.com/rqure/qlib/pkg/log"
 )
 
 func getStoreAddress() string {
@@ -26,6 +30,151 @@ func getWebServiceAddress() string {
 	return addr
 }
 
+func getAuthenticator() Authenticator {
+	authenticator := NewChainAuthenticator()
+
+	if path := os.Getenv("Q_AUTH_API_KEYS_FILE"); path != "" {
+		if a, err := NewApiKeyAuthenticator(path); err == nil {
+			authenticator.authenticators = append(authenticator.authenticators, a)
+		} else {
+			log.Error("Failed to load API keys: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if path := os.Getenv("Q_AUTH_HTPASSWD_FILE"); path != "" {
+		if a, err := NewBasicAuthenticator(path); err == nil {
+			authenticator.authenticators = append(authenticator.authenticators, a)
+		} else {
+			log.Error("Failed to load htpasswd file: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if path := os.Getenv("Q_AUTH_JWT_KEYS_FILE"); path != "" {
+		a, err := NewJwtAuthenticator(JwtAuthenticatorConfig{
+			KeysFile:      path,
+			Issuer:        os.Getenv("Q_AUTH_JWT_ISSUER"),
+			Audience:      os.Getenv("Q_AUTH_JWT_AUDIENCE"),
+			RolesClaim:    os.Getenv("Q_AUTH_JWT_ROLES_CLAIM"),
+			AllowNoExpiry: os.Getenv("Q_AUTH_JWT_ALLOW_NO_EXPIRY") == "true",
+		})
+
+		if err == nil {
+			authenticator.authenticators = append(authenticator.authenticators, a)
+		} else {
+			log.Error("Failed to load JWT keys: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if authenticator.Len() == 0 {
+		log.Warn("No authenticators configured. REST API clients will be issued anonymous tokens.")
+		return nil
+	}
+
+	return authenticator
+}
+
+func getPolicy(authenticated bool) *Policy {
+	path := os.Getenv("Q_AUTHZ_POLICY_FILE")
+	if path == "" && authenticated {
+		// Websocket clients cannot be authenticated, so they must not inherit the admin role
+		log.Warn("No authorization policy configured. Authenticated principals are granted the '%s' role, and websocket clients no role at all.", RoleAdmin)
+		return NewAuthenticatedDefaultPolicy()
+	} else if path == "" {
+		log.Warn("No authorization policy configured. All principals are granted the '%s' role.", RoleAdmin)
+		return NewDefaultPolicy()
+	}
+
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		log.Error("Failed to load authorization policy: %v", err)
+		os.Exit(1)
+	}
+
+	if roles := policy.RolesOf(NewAnonymousPrincipal()); authenticated && len(roles) > 0 {
+		log.Warn("!!! Authentication is configured, but websocket clients are not authenticated and are granted the roles [%s] by the authorization policy. Set 'anonymousRoles' to restrict them. !!!", strings.Join(roles, ","))
+	}
+
+	return policy
+}
+
+func getNotificationQueueConfig() NotificationQueueConfig {
+	config := NewDefaultNotificationQueueConfig()
+
+	if limit := os.Getenv("Q_NOTIFICATION_QUEUE_TOKEN_LIMIT"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			config.TokenLimit = n
+		} else {
+			log.Error("Invalid Q_NOTIFICATION_QUEUE_TOKEN_LIMIT: %v", err)
+		}
+	}
+
+	if limit := os.Getenv("Q_NOTIFICATION_QUEUE_CLIENT_LIMIT"); limit != "" {
+		if n, err := strconv.Atoi(limit); err == nil {
+			config.ClientLimit = n
+		} else {
+			log.Error("Invalid Q_NOTIFICATION_QUEUE_CLIENT_LIMIT: %v", err)
+		}
+	}
+
+	if policy := os.Getenv("Q_NOTIFICATION_QUEUE_OVERFLOW_POLICY"); policy != "" {
+		config.OverflowPolicy = policy
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Error("Invalid notification queue configuration: %v", err)
+		os.Exit(1)
+	}
+
+	return config
+}
+
+func getBackupConfig() BackupConfig {
+	config := NewDefaultBackupConfig()
+	config.Directory = os.Getenv("Q_BACKUP_DIR")
+
+	if interval := os.Getenv("Q_BACKUP_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			config.Interval = d
+		} else {
+			log.Error("Invalid Q_BACKUP_INTERVAL: %v", err)
+		}
+	}
+
+	if keep := os.Getenv("Q_BACKUP_KEEP_HOURLY"); keep != "" {
+		if n, err := strconv.Atoi(keep); err == nil {
+			config.KeepHourly = n
+		} else {
+			log.Error("Invalid Q_BACKUP_KEEP_HOURLY: %v", err)
+		}
+	}
+
+	if keep := os.Getenv("Q_BACKUP_KEEP_DAILY"); keep != "" {
+		if n, err := strconv.Atoi(keep); err == nil {
+			config.KeepDaily = n
+		} else {
+			log.Error("Invalid Q_BACKUP_KEEP_DAILY: %v", err)
+		}
+	}
+
+	if keep := os.Getenv("Q_BACKUP_KEEP_WEEKLY"); keep != "" {
+		if n, err := strconv.Atoi(keep); err == nil {
+			config.KeepWeekly = n
+		} else {
+			log.Error("Invalid Q_BACKUP_KEEP_WEEKLY: %v", err)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Error("Invalid backup configuration: %v", err)
+		os.Exit(1)
+	}
+
+	return config
+}
+
 func main() {
 	s := store.NewPostgres(store.PostgresConfig{
 		ConnectionString: getStoreAddress(),
@@ -34,29 +183,51 @@ func main() {
 	storeWorker := workers.NewStore(s)
 	webWorker := workers.NewWeb(getWebServiceAddress())
 
-	configWorker := NewConfigWorker(s)
-	runtimeWorker := NewRuntimeWorker(s)
-	restApiWorker := NewRestApiWorker()
+	authenticator := getAuthenticator()
+	policy := getPolicy(authenticator != nil)
+	configWorker := NewConfigWorker(s, policy)
+	runtimeWorker := NewRuntimeWorker(s, policy, getNotificationQueueConfig())
+	restApiWorker := NewRestApiWorker(authenticator)
+	authorizationWorker := NewAuthorizationWorker(s, policy)
+	transactionWorker := NewTransactionWorker(s, policy, authorizationWorker)
+	backupWorker := NewBackupWorker(s, policy, getBackupConfig())
+
+	storeWorker.Connected.Connect(authorizationWorker.OnStoreConnected)
+	storeWorker.Disconnected.Connect(authorizationWorker.OnStoreDisconnected)
+	webWorker.Received.Connect(authorizationWorker.OnNewClientMessage)
+	restApiWorker.Received.Connect(authorizationWorker.OnNewClientMessage)
 
 	storeWorker.Connected.Connect(configWorker.OnStoreConnected)
 	storeWorker.Disconnected.Connect(configWorker.OnStoreDisconnected)
-	webWorker.Received.Connect(configWorker.OnNewClientMessage)
-	restApiWorker.Received.Connect(configWorker.OnNewClientMessage)
+	authorizationWorker.Received.Connect(configWorker.OnNewClientMessage)
 
 	storeWorker.Connected.Connect(runtimeWorker.OnStoreConnected)
 	storeWorker.Disconnected.Connect(runtimeWorker.OnStoreDisconnected)
-	webWorker.Received.Connect(runtimeWorker.OnNewClientMessage)
+	authorizationWorker.Received.Connect(runtimeWorker.OnNewClientMessage)
 	webWorker.ClientConnected.Connect(runtimeWorker.OnClientConnected)
 	webWorker.ClientDisconnected.Connect(runtimeWorker.OnClientDisconnected)
-	restApiWorker.Received.Connect(runtimeWorker.OnNewClientMessage)
 	restApiWorker.ClientConnected.Connect(runtimeWorker.OnClientConnected)
 	restApiWorker.ClientDisconnected.Connect(runtimeWorker.OnClientDisconnected)
+	restApiWorker.NotificationStreamConnected.Connect(runtimeWorker.OnNotificationStreamConnected)
+	restApiWorker.NotificationStreamDisconnected.Connect(runtimeWorker.OnNotificationStreamDisconnected)
+
+	storeWorker.Connected.Connect(transactionWorker.OnStoreConnected)
+	storeWorker.Disconnected.Connect(transactionWorker.OnStoreDisconnected)
+	authorizationWorker.Received.Connect(transactionWorker.OnNewClientMessage)
+	transactionWorker.Dispatched.Connect(authorizationWorker.OnNewClientMessage)
+
+	storeWorker.Connected.Connect(backupWorker.OnStoreConnected)
+	storeWorker.Disconnected.Connect(backupWorker.OnStoreDisconnected)
+	authorizationWorker.Received.Connect(backupWorker.OnNewClientMessage)
 
 	a := app.NewApplication("webgateway")
 	a.AddWorker(storeWorker)
 	a.AddWorker(restApiWorker)
 	a.AddWorker(webWorker)
+	a.AddWorker(authorizationWorker)
 	a.AddWorker(configWorker)
 	a.AddWorker(runtimeWorker)
+	a.AddWorker(transactionWorker)
+	a.AddWorker(backupWorker)
 	a.Execute()
 }
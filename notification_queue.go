@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+)
+
+const (
+	// Discard the oldest queued notification to make room for the new one
+	OverflowPolicyDropOldest = "drop-oldest"
+
+	// Discard the new notification
+	OverflowPolicyDropNewest = "drop-newest"
+
+	// Replace the queued notification for the same entity field, falling back to drop-oldest
+	OverflowPolicyCoalesce = "coalesce-latest-per-field"
+
+	// Disconnect the client
+	OverflowPolicyDisconnect = "disconnect"
+)
+
+const DefaultNotificationQueueTokenLimit = 1000
+const DefaultNotificationQueueClientLimit = 10000
+
+type NotificationQueueConfig struct {
+	// TokenLimit is the maximum number of notifications queued per notification token
+	TokenLimit int
+
+	// ClientLimit is the maximum number of notifications queued per client across all tokens
+	ClientLimit int
+
+	OverflowPolicy string
+}
+
+func NewDefaultNotificationQueueConfig() NotificationQueueConfig {
+	return NotificationQueueConfig{
+		TokenLimit:     DefaultNotificationQueueTokenLimit,
+		ClientLimit:    DefaultNotificationQueueClientLimit,
+		OverflowPolicy: OverflowPolicyDropOldest,
+	}
+}
+
+func (c NotificationQueueConfig) Validate() error {
+	switch c.OverflowPolicy {
+	case OverflowPolicyDropOldest, OverflowPolicyDropNewest, OverflowPolicyCoalesce, OverflowPolicyDisconnect:
+	default:
+		return fmt.Errorf("unknown notification queue overflow policy '%s'", c.OverflowPolicy)
+	}
+
+	if c.TokenLimit <= 0 || c.ClientLimit <= 0 {
+		return fmt.Errorf("notification queue limits must be positive")
+	}
+
+	return nil
+}
+
+// notificationQueue holds the notifications of a single client until it polls for them
+type notificationQueue struct {
+	config  NotificationQueueConfig
+	tokens  map[string][]*protobufs.DatabaseNotification
+	dropped map[string]uint64
+	size    int
+}
+
+func newNotificationQueue(config NotificationQueueConfig) *notificationQueue {
+	return &notificationQueue{
+		config:  config,
+		tokens:  make(map[string][]*protobufs.DatabaseNotification),
+		dropped: make(map[string]uint64),
+	}
+}
+
+func (q *notificationQueue) Register(token string) {
+	if _, ok := q.tokens[token]; !ok {
+		q.tokens[token] = make([]*protobufs.DatabaseNotification, 0)
+	}
+}
+
+func (q *notificationQueue) Unregister(token string) {
+	q.size -= len(q.tokens[token])
+	delete(q.tokens, token)
+	delete(q.dropped, token)
+}
+
+func (q *notificationQueue) IsRegistered(token string) bool {
+	_, ok := q.tokens[token]
+	return ok
+}
+
+// Push queues n, applying the overflow policy if a limit is reached. It returns false if the
+// client must be disconnected.
+func (q *notificationQueue) Push(n *protobufs.DatabaseNotification) bool {
+	token := n.Token
+
+	if len(q.tokens[token]) < q.config.TokenLimit && q.size < q.config.ClientLimit {
+		q.tokens[token] = append(q.tokens[token], n)
+		q.size++
+		return true
+	}
+
+	switch q.config.OverflowPolicy {
+	case OverflowPolicyDisconnect:
+		q.dropped[token]++
+		return false
+	case OverflowPolicyDropNewest:
+		q.dropped[token]++
+		return true
+	case OverflowPolicyCoalesce:
+		if q.coalesce(n) {
+			return true
+		}
+	}
+
+	// Make room by discarding the oldest notification of this token, or of the largest
+	// token if this token has nothing queued
+	victim := token
+	if len(q.tokens[victim]) == 0 {
+		for tok, ntfs := range q.tokens {
+			if len(ntfs) > len(q.tokens[victim]) {
+				victim = tok
+			}
+		}
+	}
+
+	if len(q.tokens[victim]) > 0 {
+		q.tokens[victim] = q.tokens[victim][1:]
+		q.dropped[victim]++
+		q.size--
+	}
+
+	q.tokens[token] = append(q.tokens[token], n)
+	q.size++
+	return true
+}
+
+func (q *notificationQueue) coalesce(n *protobufs.DatabaseNotification) bool {
+	ntfs := q.tokens[n.Token]
+	for i, queued := range ntfs {
+		if queued.GetCurrent().GetId() == n.GetCurrent().GetId() && queued.GetCurrent().GetName() == n.GetCurrent().GetName() {
+			// Keep the order of arrival by moving the field to the back of the queue
+			q.tokens[n.Token] = append(append(ntfs[:i:i], ntfs[i+1:]...), n)
+			q.dropped[n.Token]++
+			return true
+		}
+	}
+
+	return false
+}
+
+// Drain returns and removes every queued notification
+func (q *notificationQueue) Drain() []*protobufs.DatabaseNotification {
+	ntfs := []*protobufs.DatabaseNotification{}
+	for tok := range q.tokens {
+		ntfs = append(ntfs, q.tokens[tok]...)
+		q.tokens[tok] = make([]*protobufs.DatabaseNotification, 0)
+	}
+	q.size = 0
+
+	return ntfs
+}
+
+// DrainDropped returns and resets the number of notifications dropped per token
+func (q *notificationQueue) DrainDropped() map[string]uint64 {
+	dropped := q.dropped
+	q.dropped = make(map[string]uint64)
+	return dropped
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+)
+
+// testNotification is pushed to a notificationQueue, and is identified by its label
+type testNotification struct {
+	token   string
+	entity  string
+	field   string
+	label   string
+	refused bool
+}
+
+func newTestNotification(n testNotification) *protobufs.DatabaseNotification {
+	return &protobufs.DatabaseNotification{
+		Token: n.token,
+		Current: &protobufs.DatabaseField{
+			Id:       n.entity,
+			Name:     n.field,
+			WriterId: n.label,
+		},
+	}
+}
+
+// queuedLabels returns the labels of the notifications queued per token, in order
+func queuedLabels(q *notificationQueue) map[string][]string {
+	queued := map[string][]string{}
+	for token, ntfs := range q.tokens {
+		queued[token] = []string{}
+		for _, n := range ntfs {
+			queued[token] = append(queued[token], n.GetCurrent().GetWriterId())
+		}
+	}
+
+	return queued
+}
+
+func TestNotificationQueuePush(t *testing.T) {
+	config := func(policy string, tokenLimit int, clientLimit int) NotificationQueueConfig {
+		return NotificationQueueConfig{TokenLimit: tokenLimit, ClientLimit: clientLimit, OverflowPolicy: policy}
+	}
+
+	tests := []struct {
+		name    string
+		config  NotificationQueueConfig
+		pushes  []testNotification
+		queued  map[string][]string
+		dropped map[string]uint64
+	}{
+		{
+			"within limits",
+			config(OverflowPolicyDropOldest, 2, 10),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t2", label: "c"}},
+			map[string][]string{"t1": {"a", "b"}, "t2": {"c"}},
+			map[string]uint64{},
+		},
+		{
+			"drop oldest",
+			config(OverflowPolicyDropOldest, 2, 10),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t1", label: "c"}},
+			map[string][]string{"t1": {"b", "c"}, "t2": {}},
+			map[string]uint64{"t1": 1},
+		},
+		{
+			"drop newest",
+			config(OverflowPolicyDropNewest, 2, 10),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t1", label: "c"}},
+			map[string][]string{"t1": {"a", "b"}, "t2": {}},
+			map[string]uint64{"t1": 1},
+		},
+		{
+			"disconnect",
+			config(OverflowPolicyDisconnect, 2, 10),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t1", label: "c", refused: true}},
+			map[string][]string{"t1": {"a", "b"}, "t2": {}},
+			map[string]uint64{"t1": 1},
+		},
+		{
+			"coalesce the same field",
+			config(OverflowPolicyCoalesce, 2, 10),
+			[]testNotification{
+				{token: "t1", entity: "e1", field: "Value", label: "a"},
+				{token: "t1", entity: "e2", field: "Value", label: "b"},
+				{token: "t1", entity: "e1", field: "Value", label: "c"},
+			},
+			map[string][]string{"t1": {"b", "c"}, "t2": {}},
+			map[string]uint64{"t1": 1},
+		},
+		{
+			"coalesce only the same field of the same entity",
+			config(OverflowPolicyCoalesce, 2, 10),
+			[]testNotification{
+				{token: "t1", entity: "e1", field: "Value", label: "a"},
+				{token: "t1", entity: "e1", field: "Alarm", label: "b"},
+				{token: "t1", entity: "e2", field: "Value", label: "c"},
+			},
+			map[string][]string{"t1": {"b", "c"}, "t2": {}},
+			map[string]uint64{"t1": 1},
+		},
+		{
+			"coalesce keeps older fields until needed",
+			config(OverflowPolicyCoalesce, 3, 10),
+			[]testNotification{
+				{token: "t1", entity: "e1", field: "Value", label: "a"},
+				{token: "t1", entity: "e1", field: "Value", label: "b"},
+			},
+			map[string][]string{"t1": {"a", "b"}, "t2": {}},
+			map[string]uint64{},
+		},
+		{
+			"client limit drops from the largest token",
+			config(OverflowPolicyDropOldest, 10, 2),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t2", label: "c"}},
+			map[string][]string{"t1": {"b"}, "t2": {"c"}},
+			map[string]uint64{"t1": 1},
+		},
+		{
+			"client limit drops from the same token first",
+			config(OverflowPolicyDropOldest, 10, 2),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t2", label: "b"}, {token: "t2", label: "c"}},
+			map[string][]string{"t1": {"a"}, "t2": {"c"}},
+			map[string]uint64{"t2": 1},
+		},
+		{
+			"client limit with drop newest",
+			config(OverflowPolicyDropNewest, 10, 2),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t2", label: "c"}},
+			map[string][]string{"t1": {"a", "b"}, "t2": {}},
+			map[string]uint64{"t2": 1},
+		},
+		{
+			"client limit with disconnect",
+			config(OverflowPolicyDisconnect, 10, 2),
+			[]testNotification{{token: "t1", label: "a"}, {token: "t2", label: "b"}, {token: "t2", label: "c", refused: true}},
+			map[string][]string{"t1": {"a"}, "t2": {"b"}},
+			map[string]uint64{"t2": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newNotificationQueue(tt.config)
+			q.Register("t1")
+			q.Register("t2")
+
+			for i, n := range tt.pushes {
+				if ok := q.Push(newTestNotification(n)); ok == n.refused {
+					t.Fatalf("push %d: expected Push to return %v", i, !n.refused)
+				}
+			}
+
+			if queued := queuedLabels(q); !maps.EqualFunc(queued, tt.queued, slices.Equal[[]string]) {
+				t.Errorf("expected %v to be queued, got %v", tt.queued, queued)
+			}
+
+			size := 0
+			for _, labels := range tt.queued {
+				size += len(labels)
+			}
+
+			if q.size != size {
+				t.Errorf("expected a size of %d, got %d", size, q.size)
+			}
+
+			if dropped := q.DrainDropped(); !maps.Equal(dropped, tt.dropped) {
+				t.Errorf("expected %v to be dropped, got %v", tt.dropped, dropped)
+			}
+
+			if dropped := q.DrainDropped(); len(dropped) != 0 {
+				t.Errorf("expected DrainDropped to reset the dropped counts, got %v", dropped)
+			}
+		})
+	}
+}
+
+func TestNotificationQueueDrain(t *testing.T) {
+	q := newNotificationQueue(NotificationQueueConfig{TokenLimit: 2, ClientLimit: 3, OverflowPolicy: OverflowPolicyDropNewest})
+	q.Register("t1")
+	q.Register("t2")
+
+	for _, n := range []testNotification{{token: "t1", label: "a"}, {token: "t1", label: "b"}, {token: "t2", label: "c"}, {token: "t2", label: "d"}} {
+		q.Push(newTestNotification(n))
+	}
+
+	labels := []string{}
+	for _, n := range q.Drain() {
+		labels = append(labels, n.GetCurrent().GetWriterId())
+	}
+	slices.Sort(labels)
+
+	if !slices.Equal(labels, []string{"a", "b", "c"}) {
+		t.Errorf("expected a, b and c to be drained, got %v", labels)
+	}
+
+	if q.size != 0 || len(q.Drain()) != 0 {
+		t.Errorf("expected the queue to be empty after draining")
+	}
+
+	if !q.IsRegistered("t1") || !q.IsRegistered("t2") {
+		t.Errorf("expected tokens to stay registered after draining")
+	}
+
+	// Notifications dropped before draining are still reported
+	if dropped := q.DrainDropped(); dropped["t2"] != 1 {
+		t.Errorf("expected one dropped notification for t2, got %v", dropped)
+	}
+}
+
+func TestNotificationQueueUnregister(t *testing.T) {
+	q := newNotificationQueue(NotificationQueueConfig{TokenLimit: 10, ClientLimit: 2, OverflowPolicy: OverflowPolicyDropNewest})
+	q.Register("t1")
+	q.Register("t2")
+
+	q.Push(newTestNotification(testNotification{token: "t1", label: "a"}))
+	q.Push(newTestNotification(testNotification{token: "t1", label: "b"}))
+	q.Push(newTestNotification(testNotification{token: "t1", label: "c"}))
+
+	q.Unregister("t1")
+	if q.IsRegistered("t1") || q.size != 0 {
+		t.Fatalf("expected t1 and its notifications to be removed")
+	}
+
+	if dropped := q.DrainDropped(); len(dropped) != 0 {
+		t.Errorf("expected the dropped count of t1 to be removed, got %v", dropped)
+	}
+
+	// The room taken by t1 is available to other tokens again
+	q.Push(newTestNotification(testNotification{token: "t2", label: "d"}))
+	q.Push(newTestNotification(testNotification{token: "t2", label: "e"}))
+	if queued := queuedLabels(q); !slices.Equal(queued["t2"], []string{"d", "e"}) {
+		t.Errorf("expected d and e to be queued, got %v", queued)
+	}
+}
+
+func TestNotificationQueueConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config NotificationQueueConfig
+		valid  bool
+	}{
+		{"default", NewDefaultNotificationQueueConfig(), true},
+		{"coalesce policy", NotificationQueueConfig{TokenLimit: 1, ClientLimit: 1, OverflowPolicy: OverflowPolicyCoalesce}, true},
+		{"unknown policy", NotificationQueueConfig{TokenLimit: 1, ClientLimit: 1, OverflowPolicy: "drop-all"}, false},
+		{"zero token limit", NotificationQueueConfig{TokenLimit: 0, ClientLimit: 1, OverflowPolicy: OverflowPolicyDropOldest}, false},
+		{"negative client limit", NotificationQueueConfig{TokenLimit: 1, ClientLimit: -1, OverflowPolicy: OverflowPolicyDropOldest}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err == nil) != tt.valid {
+				t.Errorf("expected valid to be %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+)
+
+const DefaultNotificationStreamBufferSize = 1024
+const DefaultNotificationHistorySize = 1024
+
+type NotificationEvent struct {
+	Id           uint64
+	Notification *protobufs.DatabaseNotification
+}
+
+// NotificationStream receives a client's notifications as soon as they are raised, instead
+// of them being queued until the client polls.
+type NotificationStream interface {
+	ClientId() string
+
+	// ResumeAfter returns the id of the last event the client received, and false if the
+	// client did not ask to resume.
+	ResumeAfter() (uint64, bool)
+
+	// Send delivers an event without blocking. It returns false if the stream cannot keep up.
+	Send(event *NotificationEvent) bool
+
+	Close()
+}
+
+type RestApiNotificationStream struct {
+	clientId    string
+	resumeAfter uint64
+	resume      bool
+
+	Accepted chan bool
+	Events   chan *NotificationEvent
+	Closed   chan struct{}
+
+	closeOnce sync.Once
+}
+
+func NewRestApiNotificationStream(clientId string, resumeAfter uint64, resume bool) *RestApiNotificationStream {
+	return &RestApiNotificationStream{
+		clientId:    clientId,
+		resumeAfter: resumeAfter,
+		resume:      resume,
+		Accepted:    make(chan bool, 1),
+		Events:      make(chan *NotificationEvent, DefaultNotificationStreamBufferSize),
+		Closed:      make(chan struct{}),
+	}
+}
+
+func (s *RestApiNotificationStream) ClientId() string {
+	return s.clientId
+}
+
+func (s *RestApiNotificationStream) ResumeAfter() (uint64, bool) {
+	return s.resumeAfter, s.resume
+}
+
+func (s *RestApiNotificationStream) Send(event *NotificationEvent) bool {
+	select {
+	case <-s.Closed:
+		return false
+	default:
+	}
+
+	select {
+	case s.Events <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *RestApiNotificationStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.Closed)
+	})
+}
+
+// notificationHistory keeps the most recent events of a client so that a stream can resume
+// from the last event it received.
+type notificationHistory struct {
+	lastEventId uint64
+	events      []*NotificationEvent
+}
+
+func (h *notificationHistory) Add(n *protobufs.DatabaseNotification) *NotificationEvent {
+	h.lastEventId++
+	event := &NotificationEvent{
+		Id:           h.lastEventId,
+		Notification: n,
+	}
+
+	h.events = append(h.events, event)
+	if len(h.events) > DefaultNotificationHistorySize {
+		h.events = h.events[len(h.events)-DefaultNotificationHistorySize:]
+	}
+
+	return event
+}
+
+func (h *notificationHistory) After(id uint64) []*NotificationEvent {
+	for i, event := range h.events {
+		if event.Id > id {
+			return h.events[i:]
+		}
+	}
+
+	return []*NotificationEvent{}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const OpenApiVersion = "3.0.3"
+
+// ApiMessage pairs a request handled by the gateway with the response it is answered with
+type ApiMessage struct {
+	Request  proto.Message
+	Response proto.Message
+}
+
+// GatewayApiMessage is the equivalent of ApiMessage for gateway messages, whose fields are
+// described by Go structs instead of protobuf descriptors
+type GatewayApiMessage struct {
+	RequestType  string
+	Request      interface{}
+	ResponseType string
+	Response     interface{}
+}
+
+var apiMessages = []ApiMessage{
+	{&protobufs.WebConfigCreateEntityRequest{}, &protobufs.WebConfigCreateEntityResponse{}},
+	{&protobufs.WebConfigDeleteEntityRequest{}, &protobufs.WebConfigDeleteEntityResponse{}},
+	{&protobufs.WebConfigGetEntityRequest{}, &protobufs.WebConfigGetEntityResponse{}},
+	{&protobufs.WebConfigGetEntityTypesRequest{}, &protobufs.WebConfigGetEntityTypesResponse{}},
+	{&protobufs.WebConfigGetEntitySchemaRequest{}, &protobufs.WebConfigGetEntitySchemaResponse{}},
+	{&protobufs.WebConfigSetEntitySchemaRequest{}, &protobufs.WebConfigSetEntitySchemaResponse{}},
+	{&protobufs.WebConfigGetFieldSchemaRequest{}, &protobufs.WebConfigGetFieldSchemaResponse{}},
+	{&protobufs.WebConfigSetFieldSchemaRequest{}, &protobufs.WebConfigSetFieldSchemaResponse{}},
+	{&protobufs.WebConfigGetAllFieldsRequest{}, &protobufs.WebConfigGetAllFieldsResponse{}},
+	{&protobufs.WebConfigCreateSnapshotRequest{}, &protobufs.WebConfigCreateSnapshotResponse{}},
+	{&protobufs.WebConfigRestoreSnapshotRequest{}, &protobufs.WebConfigRestoreSnapshotResponse{}},
+	{&protobufs.WebConfigGetRootRequest{}, &protobufs.WebConfigGetRootResponse{}},
+	{&protobufs.WebRuntimeDatabaseRequest{}, &protobufs.WebRuntimeDatabaseResponse{}},
+	{&protobufs.WebRuntimeRegisterNotificationRequest{}, &protobufs.WebRuntimeRegisterNotificationResponse{}},
+	{&protobufs.WebRuntimeGetNotificationsRequest{}, &protobufs.WebRuntimeGetNotificationsResponse{}},
+	{&protobufs.WebRuntimeUnregisterNotificationRequest{}, &protobufs.WebRuntimeUnregisterNotificationResponse{}},
+	{&protobufs.WebRuntimeGetDatabaseConnectionStatusRequest{}, &protobufs.WebRuntimeGetDatabaseConnectionStatusResponse{}},
+	{&protobufs.WebRuntimeGetEntitiesRequest{}, &protobufs.WebRuntimeGetEntitiesResponse{}},
+	{&protobufs.WebRuntimeFieldExistsRequest{}, &protobufs.WebRuntimeFieldExistsResponse{}},
+	{&protobufs.WebRuntimeEntityExistsRequest{}, &protobufs.WebRuntimeEntityExistsResponse{}},
+}
+
+var gatewayApiMessages = []GatewayApiMessage{
+	{WebGatewayGetNotificationsRequestType, &WebGatewayGetNotificationsRequest{}, WebGatewayGetNotificationsResponseType, &WebGatewayGetNotificationsResponse{}},
+	{WebGatewayTransactionRequestType, &WebGatewayTransactionRequest{}, WebGatewayTransactionResponseType, &WebGatewayTransactionResponse{}},
+	{WebGatewayConditionalWriteRequestType, &WebGatewayConditionalWriteRequest{}, WebGatewayConditionalWriteResponseType, &WebGatewayConditionalWriteResponse{}},
+	{WebGatewayGetEntitiesRequestType, &WebGatewayGetEntitiesRequest{}, WebGatewayGetEntitiesResponseType, &WebGatewayGetEntitiesResponse{}},
+	{WebGatewayGetEntityTreeRequestType, &WebGatewayGetEntityTreeRequest{}, WebGatewayGetEntityTreeResponseType, &WebGatewayGetEntityTreeResponse{}},
+	{WebGatewayFindEntitiesRequestType, &WebGatewayFindEntitiesRequest{}, WebGatewayFindEntitiesResponseType, &WebGatewayFindEntitiesResponse{}},
+	{WebGatewayRenameEntityRequestType, &WebGatewayRenameEntityRequest{}, WebGatewayRenameEntityResponseType, &WebGatewayRenameEntityResponse{}},
+	{WebGatewayMoveEntityRequestType, &WebGatewayMoveEntityRequest{}, WebGatewayMoveEntityResponseType, &WebGatewayMoveEntityResponse{}},
+	{WebGatewayCloneEntityRequestType, &WebGatewayCloneEntityRequest{}, WebGatewayCloneEntityResponseType, &WebGatewayCloneEntityResponse{}},
+	{WebGatewayCreateSnapshotRequestType, &WebGatewayCreateSnapshotRequest{}, WebGatewayCreateSnapshotResponseType, &WebGatewayCreateSnapshotResponse{}},
+	{WebGatewayMergeSnapshotRequestType, &WebGatewayMergeSnapshotRequest{}, WebGatewayMergeSnapshotResponseType, &WebGatewayMergeSnapshotResponse{}},
+	{WebGatewayPreviewRestoreRequestType, &WebGatewayPreviewRestoreRequest{}, WebGatewayPreviewRestoreResponseType, &WebGatewayPreviewRestoreResponse{}},
+	{WebGatewayDiffSnapshotsRequestType, &WebGatewayDiffSnapshotsRequest{}, WebGatewayDiffSnapshotsResponseType, &WebGatewayDiffSnapshotsResponse{}},
+	{WebGatewayListBackupsRequestType, &WebGatewayListBackupsRequest{}, WebGatewayListBackupsResponseType, &WebGatewayListBackupsResponse{}},
+	{WebGatewayDownloadBackupRequestType, &WebGatewayDownloadBackupRequest{}, WebGatewayDownloadBackupResponseType, &WebGatewayDownloadBackupResponse{}},
+	{WebGatewayRestoreBackupRequestType, &WebGatewayRestoreBackupRequest{}, WebGatewayRestoreBackupResponseType, &WebGatewayRestoreBackupResponse{}},
+}
+
+// isApiRequest reports whether payload is one of the requests listed in apiMessages or
+// gatewayApiMessages
+func isApiRequest(payload *anypb.Any) bool {
+	if name := gatewayMessageType(payload); name != "" {
+		for _, m := range gatewayApiMessages {
+			if m.RequestType == name {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, m := range apiMessages {
+		if payload.MessageIs(m.Request) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// swaggerUi is served at '/docs'. The Swagger UI distribution is vendored by 'go generate'
+// instead of being loaded from a CDN, so that the docs work offline and under a strict
+// content security policy.
+//
+//go:generate sh -c "curl -fsSL https://registry.npmjs.org/swagger-ui-dist/-/swagger-ui-dist-5.17.14.tgz | tar -xz -C swagger-ui --strip-components=1 package/LICENSE package/swagger-ui.css package/swagger-ui-bundle.js"
+//go:embed swagger-ui
+var swaggerUi embed.FS
+
+func typeUrlOf(m proto.Message) string {
+	return "type.googleapis.com/" + string(m.ProtoReflect().Descriptor().FullName())
+}
+
+// openApiBuilder generates an OpenAPI document describing the REST API. Protobuf messages
+// are described from their descriptors, following the protojson mapping.
+type openApiBuilder struct {
+	schemas map[string]interface{}
+}
+
+func newOpenApiBuilder() *openApiBuilder {
+	return &openApiBuilder{
+		schemas: make(map[string]interface{}),
+	}
+}
+
+func (b *openApiBuilder) Build() map[string]interface{} {
+	apiRequests := []interface{}{}
+	apiResponses := []interface{}{
+		b.gatewayEnvelope(WebGatewayErrorType, &WebGatewayError{}),
+	}
+
+	for _, m := range apiMessages {
+		apiRequests = append(apiRequests, b.envelope(m.Request))
+		apiResponses = append(apiResponses, b.envelope(m.Response))
+	}
+
+	for _, m := range gatewayApiMessages {
+		apiRequests = append(apiRequests, b.gatewayEnvelope(m.RequestType, m.Request))
+		apiResponses = append(apiResponses, b.gatewayEnvelope(m.ResponseType, m.Response))
+	}
+
+	errorResponse := map[string]interface{}{
+		"description": "The request was rejected",
+		"content": jsonContent(map[string]interface{}{
+			"$ref": b.goRef("WebGatewayError", &WebGatewayError{}),
+		}),
+	}
+
+	return map[string]interface{}{
+		"openapi": OpenApiVersion,
+		"info": map[string]interface{}{
+			"title":   "qwebgateway",
+			"version": "1",
+		},
+		"paths": map[string]interface{}{
+			"/make-client-id": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":  "Authenticate and obtain a client id",
+					"security": []interface{}{map[string]interface{}{"apiKey": []string{}}, map[string]interface{}{"basic": []string{}}, map[string]interface{}{"bearer": []string{}}},
+					"parameters": []interface{}{
+						queryParameter("clientTimeout", "Duration of inactivity after which the client id expires"),
+						queryParameter("requestTimeout", "Duration to wait for the response"),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The client id is the header id of the response",
+							"content":     jsonContent(b.messageRef(&protobufs.WebMessage{})),
+						},
+						"401": map[string]interface{}{"description": "The credentials were missing or invalid"},
+					},
+				},
+			},
+			"/api": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary": "Send a request envelope. The header id is the client id.",
+					"parameters": []interface{}{
+						queryParameter("requestTimeout", "Duration to wait for the response"),
+					},
+					"requestBody": map[string]interface{}{
+						"required": true,
+						"content":  withProtobufContent(jsonContent(map[string]interface{}{"oneOf": apiRequests})),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The response envelope",
+							"content":     withProtobufContent(jsonContent(map[string]interface{}{"oneOf": apiResponses})),
+						},
+						"default": map[string]interface{}{
+							"description": "The request was rejected with a WebGatewayError",
+							"content":     jsonContent(b.gatewayEnvelope(WebGatewayErrorType, &WebGatewayError{})),
+						},
+					},
+				},
+			},
+			"/api/batch": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary": "Send many request envelopes. The response at each position answers the request at the same position.",
+					"parameters": []interface{}{
+						queryParameter("requestTimeout", "Duration to wait for all of the responses"),
+					},
+					"requestBody": map[string]interface{}{
+						"required": true,
+						"content": withProtobufContent(jsonContent(map[string]interface{}{
+							"type":  "array",
+							"items": map[string]interface{}{"oneOf": apiRequests},
+						})),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The response envelopes",
+							"content": withProtobufContent(jsonContent(map[string]interface{}{
+								"type":  "array",
+								"items": map[string]interface{}{"oneOf": apiResponses},
+							})),
+						},
+					},
+				},
+			},
+			"/api/notifications/stream": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary": "Receive notifications as Server-Sent Events",
+					"parameters": []interface{}{
+						queryParameter("clientId", "Client id issued by /make-client-id"),
+						queryParameter("lastEventId", "Id of the last event received, to resume a stream"),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "'notification' events whose data is a DatabaseNotification",
+							"content": map[string]interface{}{
+								"text/event-stream": map[string]interface{}{
+									"schema": map[string]interface{}{"type": "string"},
+								},
+							},
+						},
+						"401": map[string]interface{}{"description": "The client id is unknown or expired"},
+					},
+				},
+			},
+			"/v1/entities": map[string]interface{}{
+				"post": b.resourceOperation("Create an entity", &protobufs.WebConfigCreateEntityRequest{}, "201", &protobufs.WebConfigCreateEntityResponse{}, errorResponse),
+			},
+			"/v1/entities/{id}": map[string]interface{}{
+				"parameters": []interface{}{pathParameter("id")},
+				"get":        b.resourceOperation("Get an entity", nil, "200", &protobufs.DatabaseEntity{}, errorResponse),
+				"delete":     b.resourceOperation("Delete an entity", nil, "204", nil, errorResponse),
+			},
+			"/v1/entities/{id}/fields/{field}": map[string]interface{}{
+				"parameters": []interface{}{pathParameter("id"), pathParameter("field")},
+				"get":        b.resourceOperation("Read a field", nil, "200", &protobufs.DatabaseRequest{}, errorResponse),
+				"put":        b.fieldWriteOperation(errorResponse),
+			},
+			"/v1/types/{type}/schema": map[string]interface{}{
+				"parameters": []interface{}{pathParameter("type")},
+				"get":        b.resourceOperation("Get the schema of an entity type", nil, "200", &protobufs.DatabaseEntitySchema{}, errorResponse),
+			},
+			"/v1/types/{type}/entities": map[string]interface{}{
+				"parameters": []interface{}{pathParameter("type")},
+				"get":        b.resourceOperation("Get the entities of a type", nil, "200", &protobufs.WebRuntimeGetEntitiesResponse{}, errorResponse),
+			},
+			"/v1/snapshots/diff": map[string]interface{}{
+				"post": b.gatewayResourceOperation("Compare two snapshots", WebGatewayDiffSnapshotsRequestType, &WebGatewayDiffSnapshotsRequest{}, "200", WebGatewayDiffSnapshotsResponseType, &WebGatewayDiffSnapshotsResponse{}, errorResponse),
+			},
+			"/v1/backups": map[string]interface{}{
+				"get": b.gatewayResourceOperation("List the stored backups", "", nil, "200", WebGatewayListBackupsResponseType, &WebGatewayListBackupsResponse{}, errorResponse),
+			},
+			"/v1/backups/{name}": map[string]interface{}{
+				"parameters": []interface{}{pathParameter("name")},
+				"get":        b.resourceOperation("Download the snapshot of a backup", nil, "200", &protobufs.DatabaseSnapshot{}, errorResponse),
+			},
+			"/v1/backups/{name}/restore": map[string]interface{}{
+				"parameters": []interface{}{pathParameter("name")},
+				"post":       b.gatewayResourceOperation("Restore a backup", "", nil, "200", WebGatewayRestoreBackupResponseType, &WebGatewayRestoreBackupResponse{}, errorResponse),
+			},
+		},
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey":   map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"basic":    map[string]interface{}{"type": "http", "scheme": "basic"},
+				"bearer":   map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"clientId": map[string]interface{}{"type": "apiKey", "in": "header", "name": ClientIdHeader},
+			},
+		},
+	}
+}
+
+func (b *openApiBuilder) resourceOperation(summary string, request proto.Message, status string, response proto.Message, errorResponse interface{}) map[string]interface{} {
+	success := map[string]interface{}{
+		"description": summary,
+	}
+	if response != nil {
+		success["content"] = jsonContent(b.messageRef(response))
+	}
+
+	operation := map[string]interface{}{
+		"summary":  summary,
+		"security": []interface{}{map[string]interface{}{"clientId": []string{}}},
+		"responses": map[string]interface{}{
+			status:    success,
+			"default": errorResponse,
+		},
+	}
+
+	if request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(b.messageRef(request)),
+		}
+	}
+
+	return operation
+}
+
+func (b *openApiBuilder) fieldWriteOperation(errorResponse interface{}) map[string]interface{} {
+	operation := b.resourceOperation("Write a field", nil, "200", &protobufs.DatabaseRequest{}, errorResponse)
+	operation["requestBody"] = map[string]interface{}{
+		"required": true,
+		"content": jsonContent(map[string]interface{}{
+			"type":     "object",
+			"required": []string{"value"},
+			"properties": map[string]interface{}{
+				"value": map[string]interface{}{
+					"description": "The raw value, converted to the type in the field's schema, or a google.protobuf.Any",
+				},
+			},
+		}),
+	}
+
+	return operation
+}
+
+// gatewayResourceOperation is like resourceOperation for a route whose request body and
+// response are the gateway messages request and response, without their messageType
+func (b *openApiBuilder) gatewayResourceOperation(summary string, requestType string, request interface{}, status string, responseType string, response interface{}, errorResponse interface{}) map[string]interface{} {
+	operation := b.resourceOperation(summary, nil, status, nil, errorResponse)
+	operation["responses"].(map[string]interface{})[status] = map[string]interface{}{
+		"description": summary,
+		"content": jsonContent(map[string]interface{}{
+			"$ref": b.goRef(responseType, response),
+		}),
+	}
+
+	if request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": jsonContent(map[string]interface{}{
+				"$ref": b.goRef(requestType, request),
+			}),
+		}
+	}
+
+	return operation
+}
+
+// envelope describes a WebMessage whose payload is m
+func (b *openApiBuilder) envelope(m proto.Message) map[string]interface{} {
+	name := string(m.ProtoReflect().Descriptor().Name())
+
+	return b.envelopeOf(name+"Message", map[string]interface{}{
+		"allOf": []interface{}{
+			b.messageRef(m),
+			map[string]interface{}{
+				"type":     "object",
+				"required": []string{"@type"},
+				"properties": map[string]interface{}{
+					"@type": map[string]interface{}{"type": "string", "enum": []string{typeUrlOf(m)}},
+				},
+			},
+		},
+	})
+}
+
+// gatewayEnvelope describes a WebMessage whose payload is the gateway message v
+func (b *openApiBuilder) gatewayEnvelope(messageType string, v interface{}) map[string]interface{} {
+	return b.envelopeOf(messageType+"Message", map[string]interface{}{
+		"type":     "object",
+		"required": []string{"@type", "value"},
+		"properties": map[string]interface{}{
+			"@type": map[string]interface{}{"type": "string", "enum": []string{"type.googleapis.com/google.protobuf.Struct"}},
+			"value": map[string]interface{}{
+				"allOf": []interface{}{
+					map[string]interface{}{"$ref": b.goRef(messageType, v)},
+					map[string]interface{}{
+						"type":     "object",
+						"required": []string{GatewayMessageTypeKey},
+						"properties": map[string]interface{}{
+							GatewayMessageTypeKey: map[string]interface{}{"type": "string", "enum": []string{messageType}},
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (b *openApiBuilder) envelopeOf(name string, payload interface{}) map[string]interface{} {
+	if _, ok := b.schemas[name]; !ok {
+		b.schemas[name] = map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"header":  b.messageRef(&protobufs.WebHeader{}),
+				"payload": payload,
+			},
+		}
+	}
+
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (b *openApiBuilder) messageRef(m proto.Message) map[string]interface{} {
+	return b.messageSchema(m.ProtoReflect().Descriptor())
+}
+
+func (b *openApiBuilder) messageSchema(md protoreflect.MessageDescriptor) map[string]interface{} {
+	switch md.FullName() {
+	case "google.protobuf.Any":
+		return map[string]interface{}{
+			"type":                 "object",
+			"required":             []string{"@type"},
+			"properties":           map[string]interface{}{"@type": map[string]interface{}{"type": "string"}},
+			"additionalProperties": true,
+		}
+	case "google.protobuf.Timestamp":
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case "google.protobuf.Duration":
+		return map[string]interface{}{"type": "string"}
+	case "google.protobuf.Struct":
+		return map[string]interface{}{"type": "object", "additionalProperties": true}
+	case "google.protobuf.Value":
+		return map[string]interface{}{}
+	}
+
+	name := string(md.FullName())
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	if _, ok := b.schemas[name]; ok {
+		return ref
+	}
+
+	// Register the schema before describing the fields so that recursive messages terminate
+	properties := map[string]interface{}{}
+	b.schemas[name] = map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		properties[fd.JSONName()] = b.fieldSchema(fd)
+	}
+
+	return ref
+}
+
+func (b *openApiBuilder) fieldSchema(fd protoreflect.FieldDescriptor) map[string]interface{} {
+	if fd.IsMap() {
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": b.singularFieldSchema(fd.MapValue()),
+		}
+	}
+
+	if fd.IsList() {
+		return map[string]interface{}{
+			"type":  "array",
+			"items": b.singularFieldSchema(fd),
+		}
+	}
+
+	return b.singularFieldSchema(fd)
+}
+
+func (b *openApiBuilder) singularFieldSchema(fd protoreflect.FieldDescriptor) map[string]interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return map[string]interface{}{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return map[string]interface{}{"type": "integer", "format": "int64", "minimum": 0}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// protojson encodes 64 bit integers as strings
+		return map[string]interface{}{"type": "string", "format": "int64"}
+	case protoreflect.FloatKind:
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case protoreflect.DoubleKind:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case protoreflect.StringKind:
+		return map[string]interface{}{"type": "string"}
+	case protoreflect.BytesKind:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		values := []string{}
+		for i := 0; i < fd.Enum().Values().Len(); i++ {
+			values = append(values, string(fd.Enum().Values().Get(i).Name()))
+		}
+		return map[string]interface{}{"type": "string", "enum": values}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return b.messageSchema(fd.Message())
+	}
+
+	return map[string]interface{}{}
+}
+
+// goRef registers the schema of the Go struct v under name and returns a reference to it
+func (b *openApiBuilder) goRef(name string, v interface{}) string {
+	if _, ok := b.schemas[name]; !ok {
+		b.schemas[name] = goSchema(reflect.TypeOf(v))
+	}
+
+	return "#/components/schemas/" + name
+}
+
+// goSchema describes how encoding/json marshals a value of type t
+func goSchema(t reflect.Type) map[string]interface{} {
+	return goSchemaOf(t, map[reflect.Type]bool{})
+}
+
+// goSchemaOf describes t like goSchema. A struct that contains itself, such as a tree node, is
+// described as a plain object where it recurs.
+func goSchemaOf(t reflect.Type, visiting map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": goSchemaOf(t.Elem(), visiting)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": goSchemaOf(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+
+			if name == "" {
+				name = f.Name
+			}
+
+			properties[name] = goSchemaOf(f.Type, visiting)
+		}
+
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+
+	return map[string]interface{}{}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		ContentTypeJson: map[string]interface{}{
+			"schema": schema,
+		},
+	}
+}
+
+// withProtobufContent adds the protobuf wire format of a WebMessage to content
+func withProtobufContent(content map[string]interface{}) map[string]interface{} {
+	content[ContentTypeProtobuf] = map[string]interface{}{
+		"schema": map[string]interface{}{"type": "string", "format": "binary"},
+	}
+
+	return content
+}
+
+func queryParameter(name string, description string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      map[string]interface{}{"type": "string"},
+	}
+}
+
+func pathParameter(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"in":       "path",
+		"required": true,
+		"schema":   map[string]interface{}{"type": "string"},
+	}
+}
+
+// registerOpenApiRoutes serves the OpenAPI document at '/openapi.json' and Swagger UI at '/docs'
+func registerOpenApiRoutes() {
+	document, err := json.MarshalIndent(newOpenApiBuilder().Build(), "", "  ")
+	if err != nil {
+		log.Error("Failed to generate OpenAPI document: %v", err)
+		return
+	}
+
+	http.HandleFunc("GET /openapi.json", func(wr http.ResponseWriter, r *http.Request) {
+		wr.Header().Set("Content-Type", "application/json")
+		wr.Write(document)
+	})
+
+	assets, err := fs.Sub(swaggerUi, "swagger-ui")
+	if err != nil {
+		log.Error("Failed to load Swagger UI: %v", err)
+		return
+	}
+
+	if _, err := fs.Stat(assets, "swagger-ui-bundle.js"); err != nil {
+		log.Warn("Swagger UI was not vendored with 'go generate', '/docs' is not served")
+		return
+	}
+
+	http.Handle("GET /docs/", http.StripPrefix("/docs", http.FileServerFS(assets)))
+}
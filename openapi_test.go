@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// testClient records the responses written to it, on behalf of principal
+type testClient struct {
+	principal *Principal
+	responses []web.Message
+}
+
+func (c *testClient) Id() string                           { return "test" }
+func (c *testClient) Principal() *Principal                { return c.principal }
+func (c *testClient) Read() web.Message                    { return nil }
+func (c *testClient) Write(msg web.Message)                { c.responses = append(c.responses, msg) }
+func (c *testClient) Close()                               {}
+func (c *testClient) SetMessageHandler(web.MessageHandler) {}
+
+// gatewayRequestTypes returns the values of the WebGateway*RequestType constants
+func gatewayRequestTypes(t *testing.T) []string {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := regexp.MustCompile(`^WebGateway\w+RequestType$`)
+	types := []string{}
+	for _, pkg := range pkgs {
+		ast.Inspect(pkg, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+			if !ok || len(spec.Names) != 1 || len(spec.Values) != 1 || !name.MatchString(spec.Names[0].Name) {
+				return true
+			}
+
+			if lit, ok := spec.Values[0].(*ast.BasicLit); ok {
+				if v, err := strconv.Unquote(lit.Value); err == nil {
+					types = append(types, v)
+				}
+			}
+
+			return true
+		})
+	}
+
+	return types
+}
+
+// TestApiMessagesListHandledRequests checks that every request a worker answers is listed in
+// apiMessages or gatewayApiMessages, which describe the API and tell unanswered requests from
+// unknown ones
+func TestApiMessagesListHandledRequests(t *testing.T) {
+	handlers := map[string]func(context.Context, ...interface{}){
+		"ConfigWorker":      NewConfigWorker(nil, NewDefaultPolicy()).OnNewClientMessage,
+		"RuntimeWorker":     NewRuntimeWorker(nil, NewDefaultPolicy(), NewDefaultNotificationQueueConfig()).OnNewClientMessage,
+		"TransactionWorker": NewTransactionWorker(nil, NewDefaultPolicy(), nil).OnNewClientMessage,
+		"BackupWorker":      NewBackupWorker(nil, NewDefaultPolicy(), NewDefaultBackupConfig()).OnNewClientMessage,
+	}
+
+	payloads := []*anypb.Any{}
+	pkg := (&protobufs.WebMessage{}).ProtoReflect().Descriptor().ParentFile().Package()
+	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+		d := mt.Descriptor()
+		if d.ParentFile().Package() == pkg && strings.HasSuffix(string(d.Name()), "Request") {
+			payload, err := anypb.New(mt.New().Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			payloads = append(payloads, payload)
+		}
+
+		return true
+	})
+
+	requestTypes := gatewayRequestTypes(t)
+	if len(requestTypes) == 0 {
+		t.Fatal("found no gateway request types")
+	}
+
+	for _, requestType := range requestTypes {
+		payload, err := newGatewayPayload(requestType, struct{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}
+
+	for _, payload := range payloads {
+		payloadType := payload.TypeUrl
+		if name := gatewayMessageType(payload); name != "" {
+			payloadType = name
+		}
+
+		for worker, handle := range handlers {
+			client := &testClient{}
+			handled := func() (handled bool) {
+				// A handler that panics without a store still handles the message
+				defer func() {
+					if recover() != nil {
+						handled = true
+					}
+				}()
+
+				// Handlers write their response into the message they were given
+				handle(context.Background(), client, &protobufs.WebMessage{Header: &protobufs.WebHeader{}, Payload: proto.Clone(payload).(*anypb.Any)})
+				return len(client.responses) > 0
+			}()
+
+			if handled && !isApiRequest(payload) {
+				t.Errorf("%s handles '%s', which is missing from apiMessages or gatewayApiMessages", worker, payloadType)
+			}
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/entity"
+	"github.com/rqure/qlib/pkg/data/request"
+	"github.com/rqure/qlib/pkg/data/snapshot"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func (w *ConfigWorker) onGatewayCreateSnapshotRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayCreateSnapshotRequest)
+	rsp := new(WebGatewayCreateSnapshotResponse)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayCreateSnapshotRequestType, err)
+		return
+	}
+
+	// The whole database is filtered so that entities are authorized with all of their ancestors
+	full := permittedSnapshot(w.policy, principalOf(client), WebGatewayCreateSnapshotRequestType, snapshot.ToPb(w.store.CreateSnapshot(ctx)))
+	ss, err := partialSnapshot(full, req.RootId, req.EntityTypes)
+	if err != nil {
+		writeGatewayError(client, msg, GatewayErrorNotFound, "%v", err)
+		return
+	}
+
+	b, err := protojson.Marshal(ss)
+	if err != nil {
+		log.Error("Could not marshal snapshot: %v", err)
+		writeGatewayError(client, msg, GatewayErrorInternal, "could not encode snapshot: %v", err)
+		return
+	}
+
+	log.Info("Created partial snapshot of %d entities: %v", len(ss.Entities), req)
+	rsp.Snapshot = b
+	writeGatewayResponse(client, msg, WebGatewayCreateSnapshotResponseType, rsp)
+}
+
+func (w *ConfigWorker) onGatewayMergeSnapshotRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayMergeSnapshotRequest)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayMergeSnapshotRequestType, err)
+		return
+	}
+
+	ss := new(protobufs.DatabaseSnapshot)
+	if err := protojson.Unmarshal(req.Snapshot, ss); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode snapshot: %v", err)
+		return
+	}
+
+	ss = reparentSnapshot(ss, req.ParentId)
+	for _, parentId := range snapshotParents(ss) {
+		if !w.store.EntityExists(ctx, parentId) {
+			writeGatewayError(client, msg, GatewayErrorNotFound, "parent entity '%s' does not exist", parentId)
+			return
+		}
+	}
+
+	log.Info("Merging snapshot of %d entities below %v", len(ss.Entities), snapshotParents(ss))
+	w.mergeSnapshot(ctx, ss)
+
+	writeGatewayResponse(client, msg, WebGatewayMergeSnapshotResponseType, &WebGatewayMergeSnapshotResponse{
+		Schemas:  len(ss.EntitySchemas),
+		Entities: len(ss.Entities),
+		Fields:   len(ss.Fields),
+	})
+	w.TriggerSchemaUpdate(ctx)
+}
+
+// mergeSnapshot writes the schemas, entities and fields of ss to the store. Fields of existing
+// schemas that are not part of ss are kept, and so are children of existing entities that are
+// not part of ss. Entities of ss are added to the children of their parents outside of it.
+func (w *ConfigWorker) mergeSnapshot(ctx context.Context, ss *protobufs.DatabaseSnapshot) {
+	inSnapshot := snapshotEntityIds(ss)
+
+	for _, sch := range ss.EntitySchemas {
+		if current := w.store.GetEntitySchema(ctx, sch.Name); current != nil {
+			sch = mergeEntitySchemas(entity.ToSchemaPb(current), sch)
+		}
+
+		w.store.SetEntitySchema(ctx, entity.FromSchemaPb(sch))
+	}
+
+	// Entities outside of the snapshot whose children change
+	outside := map[string]*protobufs.DatabaseEntity{}
+	outsideEntity := func(id string) *protobufs.DatabaseEntity {
+		if outside[id] == nil {
+			outside[id] = getEntityPb(ctx, w.store, id)
+		}
+		return outside[id]
+	}
+
+	for _, ent := range ss.Entities {
+		ent = proto.Clone(ent).(*protobufs.DatabaseEntity)
+		parentId := ent.GetParent().GetRaw()
+
+		ent.Children = slices.DeleteFunc(ent.Children, func(child *protobufs.EntityReference) bool {
+			return !inSnapshot[child.GetRaw()] && !w.store.EntityExists(ctx, child.GetRaw())
+		})
+
+		if current := getEntityPb(ctx, w.store, ent.Id); current != nil {
+			for _, child := range current.Children {
+				if !inSnapshot[child.GetRaw()] && !containsReference(ent.Children, child.GetRaw()) {
+					ent.Children = append(ent.Children, child)
+				}
+			}
+
+			// The entity moves away from a parent outside of the snapshot
+			if previousId := current.GetParent().GetRaw(); previousId != "" && previousId != parentId && !inSnapshot[previousId] {
+				if previous := outsideEntity(previousId); previous != nil {
+					previous.Children = slices.DeleteFunc(previous.Children, func(child *protobufs.EntityReference) bool {
+						return child.GetRaw() == ent.Id
+					})
+				}
+			}
+		}
+
+		if parentId != "" && !inSnapshot[parentId] {
+			if parent := outsideEntity(parentId); parent != nil && !containsReference(parent.Children, ent.Id) {
+				parent.Children = append(parent.Children, &protobufs.EntityReference{Raw: ent.Id})
+			}
+		}
+
+		w.store.SetEntity(ctx, entity.FromEntityPb(ent))
+	}
+
+	for _, ent := range outside {
+		if ent != nil {
+			w.store.SetEntity(ctx, entity.FromEntityPb(ent))
+		}
+	}
+
+	reqs := []data.Request{}
+	for _, field := range ss.Fields {
+		reqs = append(reqs, request.FromPb(&protobufs.DatabaseRequest{
+			Id:        field.Id,
+			Field:     field.Name,
+			Value:     field.Value,
+			WriteTime: &protobufs.Timestamp{Raw: field.WriteTime},
+			WriterId:  &protobufs.String{Raw: field.WriterId},
+		}))
+	}
+
+	w.store.Write(ctx, reqs...)
+}
+
+// partialSnapshot returns the part of ss holding rootId and its descendants (or every entity
+// if rootId is empty), limited to entityTypes if set, along with their fields and the schemas
+// of their types
+func partialSnapshot(ss *protobufs.DatabaseSnapshot, rootId string, entityTypes []string) (*protobufs.DatabaseSnapshot, error) {
+	entities := map[string]*protobufs.DatabaseEntity{}
+	for _, ent := range ss.Entities {
+		entities[ent.Id] = ent
+	}
+
+	included := map[string]bool{}
+	if rootId == "" {
+		for id := range entities {
+			included[id] = true
+		}
+	} else {
+		if entities[rootId] == nil {
+			return nil, fmt.Errorf("entity '%s' does not exist", rootId)
+		}
+
+		pending := []string{rootId}
+		for len(pending) > 0 {
+			id := pending[0]
+			pending = pending[1:]
+
+			if included[id] || entities[id] == nil {
+				continue
+			}
+
+			included[id] = true
+			for _, child := range entities[id].Children {
+				pending = append(pending, child.GetRaw())
+			}
+		}
+	}
+
+	if len(entityTypes) > 0 {
+		for id := range included {
+			if !slices.Contains(entityTypes, entities[id].Type) {
+				delete(included, id)
+			}
+		}
+	}
+
+	partial := &protobufs.DatabaseSnapshot{}
+	types := map[string]bool{}
+	for _, ent := range ss.Entities {
+		if included[ent.Id] {
+			partial.Entities = append(partial.Entities, ent)
+			types[ent.Type] = true
+		}
+	}
+
+	for _, field := range ss.Fields {
+		if included[field.Id] {
+			partial.Fields = append(partial.Fields, field)
+		}
+	}
+
+	for _, sch := range ss.EntitySchemas {
+		if types[sch.Name] {
+			partial.EntitySchemas = append(partial.EntitySchemas, sch)
+		}
+	}
+
+	return partial, nil
+}
+
+// mergeEntitySchemas returns current with the fields of sch that it does not have added. The
+// fields of current keep their type, since existing values of the field are of that type.
+func mergeEntitySchemas(current *protobufs.DatabaseEntitySchema, sch *protobufs.DatabaseEntitySchema) *protobufs.DatabaseEntitySchema {
+	merged := proto.Clone(current).(*protobufs.DatabaseEntitySchema)
+
+	for _, field := range sch.Fields {
+		exists := slices.ContainsFunc(merged.Fields, func(f *protobufs.DatabaseFieldSchema) bool {
+			return f.Name == field.Name
+		})
+
+		if !exists {
+			merged.Fields = append(merged.Fields, proto.Clone(field).(*protobufs.DatabaseFieldSchema))
+		}
+	}
+
+	return merged
+}
+
+// reparentSnapshot returns a copy of ss in which the entities whose parent is not part of ss
+// have parentId as their parent. ss is returned as it is if parentId is empty.
+func reparentSnapshot(ss *protobufs.DatabaseSnapshot, parentId string) *protobufs.DatabaseSnapshot {
+	if parentId == "" {
+		return ss
+	}
+
+	ss = proto.Clone(ss).(*protobufs.DatabaseSnapshot)
+	inSnapshot := snapshotEntityIds(ss)
+	for _, ent := range ss.Entities {
+		if !inSnapshot[ent.GetParent().GetRaw()] {
+			ent.Parent = &protobufs.EntityReference{Raw: parentId}
+		}
+	}
+
+	return ss
+}
+
+// snapshotParents lists the parents of entities of ss that are not part of ss
+func snapshotParents(ss *protobufs.DatabaseSnapshot) []string {
+	inSnapshot := snapshotEntityIds(ss)
+	parents := []string{}
+
+	for _, ent := range ss.Entities {
+		parentId := ent.GetParent().GetRaw()
+		if parentId != "" && !inSnapshot[parentId] && !slices.Contains(parents, parentId) {
+			parents = append(parents, parentId)
+		}
+	}
+
+	return parents
+}
+
+func snapshotEntityIds(ss *protobufs.DatabaseSnapshot) map[string]bool {
+	ids := map[string]bool{}
+	for _, ent := range ss.Entities {
+		ids[ent.Id] = true
+	}
+
+	return ids
+}
+
+func containsReference(refs []*protobufs.EntityReference, entityId string) bool {
+	return slices.ContainsFunc(refs, func(ref *protobufs.EntityReference) bool {
+		return ref.GetRaw() == entityId
+	})
+}
+
+// snapshotAncestors returns the ancestors of every entity of ss. They follow the parents in
+// ss, and continue with outsideAncestors of the first parent that is not part of ss, if set.
+func snapshotAncestors(ss *protobufs.DatabaseSnapshot, outsideAncestors func(string) []string) map[string][]string {
+	entities := map[string]*protobufs.DatabaseEntity{}
+	for _, ent := range ss.Entities {
+		entities[ent.Id] = ent
+	}
+
+	outside := map[string][]string{}
+	ancestors := map[string][]string{}
+	for _, ent := range ss.Entities {
+		chain := []string{}
+
+		id := ent.Id
+		for ; entities[id] != nil && len(chain) < MaxEntityDepth; id = entities[id].GetParent().GetRaw() {
+			chain = append(chain, id)
+		}
+
+		if id != "" && entities[id] == nil && outsideAncestors != nil {
+			if _, ok := outside[id]; !ok {
+				outside[id] = outsideAncestors(id)
+			}
+			chain = append(chain, outside[id]...)
+		}
+
+		ancestors[ent.Id] = chain
+	}
+
+	return ancestors
+}
+
+// permittedSnapshot returns the part of ss that principal may read with payload. Entities it
+// may not read are left out along with their descendants, and so are the fields it may not
+// read and the schemas of types it has no entities of and may not read otherwise. Ancestors
+// are taken from ss, so it should hold the whole database.
+func permittedSnapshot(policy *Policy, principal *Principal, payload string, ss *protobufs.DatabaseSnapshot) *protobufs.DatabaseSnapshot {
+	ancestors := snapshotAncestors(ss, nil)
+
+	accesses := map[string]*Access{}
+	readable := map[string]bool{}
+	for _, ent := range ss.Entities {
+		accesses[ent.Id] = &Access{
+			Payload:    payload,
+			Operation:  OperationRead,
+			EntityType: ent.Type,
+			EntityId:   ent.Id,
+			Ancestors:  ancestors[ent.Id],
+		}
+		readable[ent.Id] = policy.Authorize(principal, accesses[ent.Id]) == nil
+	}
+
+	// An entity is left out if it or any of its ancestors may not be read
+	isPermitted := func(entityId string) bool {
+		access, ok := accesses[entityId]
+		return ok && !slices.ContainsFunc(access.Ancestors, func(id string) bool {
+			return !readable[id]
+		})
+	}
+
+	permitted := &protobufs.DatabaseSnapshot{}
+	types := map[string]bool{}
+	for _, ent := range ss.Entities {
+		if !isPermitted(ent.Id) {
+			continue
+		}
+
+		ent = proto.Clone(ent).(*protobufs.DatabaseEntity)
+		ent.Children = slices.DeleteFunc(ent.Children, func(child *protobufs.EntityReference) bool {
+			_, inSnapshot := accesses[child.GetRaw()]
+			return inSnapshot && !isPermitted(child.GetRaw())
+		})
+
+		permitted.Entities = append(permitted.Entities, ent)
+		types[ent.Type] = true
+	}
+
+	for _, field := range ss.Fields {
+		if !isPermitted(field.Id) {
+			continue
+		}
+
+		access := *accesses[field.Id]
+		access.Field = field.Name
+		if policy.Authorize(principal, &access) == nil {
+			permitted.Fields = append(permitted.Fields, field)
+		}
+	}
+
+	for _, sch := range ss.EntitySchemas {
+		access := &Access{Payload: payload, Operation: OperationRead, EntityType: sch.Name}
+		if types[sch.Name] || policy.Authorize(principal, access) == nil {
+			permitted.EntitySchemas = append(permitted.EntitySchemas, sch)
+		}
+	}
+
+	return permitted
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestSchema(name string, fields ...string) *protobufs.DatabaseEntitySchema {
+	sch := &protobufs.DatabaseEntitySchema{Name: name}
+	for i := 0; i+1 < len(fields); i += 2 {
+		sch.Fields = append(sch.Fields, &protobufs.DatabaseFieldSchema{Name: fields[i], Type: fields[i+1]})
+	}
+
+	return sch
+}
+
+func TestMergeEntitySchemas(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  *protobufs.DatabaseEntitySchema
+		sch      *protobufs.DatabaseEntitySchema
+		expected *protobufs.DatabaseEntitySchema
+	}{
+		{
+			"same fields",
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+		},
+		{
+			"missing fields are added",
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+			newTestSchema("Sensor", "Value", "qdb.Float", "Unit", "qdb.String"),
+			newTestSchema("Sensor", "Value", "qdb.Float", "Unit", "qdb.String"),
+		},
+		{
+			"existing fields are kept",
+			newTestSchema("Sensor", "Value", "qdb.Float", "Alarm", "qdb.Bool"),
+			newTestSchema("Sensor", "Unit", "qdb.String"),
+			newTestSchema("Sensor", "Value", "qdb.Float", "Alarm", "qdb.Bool", "Unit", "qdb.String"),
+		},
+		{
+			"existing fields keep their type",
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+			newTestSchema("Sensor", "Value", "qdb.Int"),
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+		},
+		{
+			"no fields",
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+			newTestSchema("Sensor"),
+			newTestSchema("Sensor", "Value", "qdb.Float"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := proto.Clone(tt.current)
+
+			merged := mergeEntitySchemas(tt.current, tt.sch)
+			if !proto.Equal(merged, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, merged)
+			}
+
+			if !proto.Equal(tt.current, current) {
+				t.Errorf("current schema was modified")
+			}
+		})
+	}
+}
+
+func TestPermittedSnapshot(t *testing.T) {
+	principals := map[string][]string{"alice": {RoleAdmin}, "carol": {RoleEngineer}}
+	deny := func(rule PolicyRule) *Policy {
+		rule.Effect = PolicyEffectDeny
+		rule.Roles = []string{RoleEngineer}
+		return &Policy{Principals: principals, Rules: []PolicyRule{rule}}
+	}
+
+	tests := []struct {
+		name      string
+		principal string
+		policy    *Policy
+		entities  []string
+		children  []string
+		fields    []string
+		schemas   []string
+	}{
+		{
+			"everything readable",
+			"alice",
+			deny(PolicyRule{Subtrees: []string{"site1"}}),
+			[]string{"root", "site1", "site2", "pump"},
+			[]string{"site1", "site2"},
+			[]string{"pump.Speed"},
+			[]string{"Pump", "Site"},
+		},
+		{
+			"subtree denied",
+			"carol",
+			deny(PolicyRule{Subtrees: []string{"site1"}}),
+			[]string{"root", "site2"},
+			[]string{"site2"},
+			[]string{},
+			[]string{"Pump", "Site"},
+		},
+		{
+			"field denied",
+			"carol",
+			deny(PolicyRule{Fields: []string{"Speed"}}),
+			[]string{"root", "site1", "site2", "pump"},
+			[]string{"site1", "site2"},
+			[]string{},
+			[]string{"Pump", "Site"},
+		},
+		{
+			"entity type denied",
+			"carol",
+			deny(PolicyRule{EntityTypes: []string{"Pump"}}),
+			[]string{"root", "site1", "site2"},
+			[]string{"site1", "site2"},
+			[]string{},
+			[]string{"Site"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := newTestSnapshot(t)
+			permitted := permittedSnapshot(tt.policy, &Principal{Name: tt.principal}, WebGatewayCreateSnapshotRequestType, ss)
+
+			entities, children, fields, schemas := []string{}, []string{}, []string{}, []string{}
+			for _, ent := range permitted.Entities {
+				entities = append(entities, ent.Id)
+				if ent.Id == "root" {
+					for _, child := range ent.Children {
+						children = append(children, child.GetRaw())
+					}
+				}
+			}
+
+			for _, field := range permitted.Fields {
+				fields = append(fields, field.Id+"."+field.Name)
+			}
+
+			for _, sch := range permitted.EntitySchemas {
+				schemas = append(schemas, sch.Name)
+			}
+
+			if !slices.Equal(entities, tt.entities) || !slices.Equal(children, tt.children) {
+				t.Errorf("expected entities %v with root children %v, got %v and %v", tt.entities, tt.children, entities, children)
+			}
+
+			if !slices.Equal(fields, tt.fields) || !slices.Equal(schemas, tt.schemas) {
+				t.Errorf("expected fields %v and schemas %v, got %v and %v", tt.fields, tt.schemas, fields, schemas)
+			}
+
+			if !proto.Equal(ss, newTestSnapshot(t)) {
+				t.Errorf("snapshot was modified")
+			}
+		})
+	}
+}
+
+func TestMergeSnapshotAccesses(t *testing.T) {
+	ctx := context.Background()
+
+	// area is new and moves the existing pump below it
+	ss := &protobufs.DatabaseSnapshot{
+		Entities: []*protobufs.DatabaseEntity{
+			newTestEntity("area", "Site", "Area", "", "pump"),
+			newTestEntity("pump", "Pump", "Pump", "area"),
+		},
+		Fields: []*protobufs.DatabaseField{
+			newTestField(t, "pump", "Speed", 10),
+		},
+	}
+
+	b, err := protojson.Marshal(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowMerge := PolicyRule{
+		Effect:   PolicyEffectAllow,
+		Roles:    []string{RoleEngineer},
+		Payloads: []string{WebGatewayMergeSnapshotRequestType},
+	}
+
+	tests := []struct {
+		name     string
+		parentId string
+		deny     PolicyRule
+		allowed  bool
+	}{
+		{"allowed", "site2", PolicyRule{Subtrees: []string{"other"}}, true},
+		{"denied where an entity is now", "site2", PolicyRule{Subtrees: []string{"site1"}}, false},
+		{"denied where an entity ends up", "", PolicyRule{Subtrees: []string{"area"}}, false},
+		{"denied below the parent", "site2", PolicyRule{Subtrees: []string{"site2"}, EntityTypes: []string{"Pump"}}, false},
+		{"field denied", "site2", PolicyRule{Fields: []string{"Speed"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.deny.Effect = PolicyEffectDeny
+			tt.deny.Roles = []string{RoleEngineer}
+			policy := &Policy{
+				Principals: map[string][]string{"carol": {RoleEngineer}},
+				Rules:      []PolicyRule{allowMerge, tt.deny},
+			}
+
+			w := NewAuthorizationWorker(newTestStore(newTestSnapshot(t)), policy)
+			w.OnStoreConnected(ctx)
+
+			payload, err := newGatewayPayload(WebGatewayMergeSnapshotRequestType, &WebGatewayMergeSnapshotRequest{Snapshot: b, ParentId: tt.parentId})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			allowed := true
+			for _, access := range w.accessesOf(ctx, &protobufs.WebMessage{Payload: payload}) {
+				if policy.Authorize(&Principal{Name: "carol"}, access) != nil {
+					allowed = false
+				}
+			}
+
+			if allowed != tt.allowed {
+				t.Errorf("expected allowed to be %v", tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleEngineer = "engineer"
+	RoleAdmin    = "admin"
+)
+
+const (
+	OperationRead  = "read"
+	OperationWrite = "write"
+)
+
+const (
+	PolicyEffectAllow = "allow"
+	PolicyEffectDeny  = "deny"
+)
+
+// Access describes a single operation a principal is attempting through the gateway.
+type Access struct {
+	Payload    string
+	Operation  string
+	EntityType string
+	EntityId   string
+	Field      string
+
+	// Ancestors holds the entity followed by its parents up to the root
+	Ancestors []string
+}
+
+func (a *Access) String() string {
+	s := fmt.Sprintf("%s %s", a.Operation, a.Payload)
+
+	if a.EntityType != "" {
+		s += fmt.Sprintf(" on entity type '%s'", a.EntityType)
+	}
+
+	if a.EntityId != "" {
+		s += fmt.Sprintf(" entity '%s'", a.EntityId)
+	}
+
+	if a.Field != "" {
+		s += fmt.Sprintf(" field '%s'", a.Field)
+	}
+
+	return s
+}
+
+// PolicyRule matches an access when each of its non-empty lists contains a matching entry.
+// Entries may use path.Match wildcards, e.g. 'WebConfig*'. Subtrees lists entity ids; the
+// rule applies to those entities and all of their descendants.
+type PolicyRule struct {
+	Effect      string   `json:"effect"`
+	Roles       []string `json:"roles"`
+	Payloads    []string `json:"payloads"`
+	Operations  []string `json:"operations"`
+	EntityTypes []string `json:"entityTypes"`
+	Fields      []string `json:"fields"`
+	Subtrees    []string `json:"subtrees"`
+}
+
+func (r *PolicyRule) Matches(role string, access *Access) bool {
+	return matchesAny(r.Roles, role) &&
+		matchesAny(r.Payloads, access.Payload) &&
+		matchesAny(r.Operations, access.Operation) &&
+		matchesAny(r.EntityTypes, access.EntityType) &&
+		matchesAny(r.Fields, access.Field) &&
+		r.matchesSubtree(access)
+}
+
+func (r *PolicyRule) matchesSubtree(access *Access) bool {
+	if len(r.Subtrees) == 0 {
+		return true
+	}
+
+	for _, root := range r.Subtrees {
+		for _, ancestor := range access.Ancestors {
+			if root == ancestor {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type Policy struct {
+	// Principals maps principal names to roles, in addition to any roles granted by the authenticator
+	Principals map[string][]string `json:"principals"`
+
+	// DefaultRoles are granted to principals that have no other roles, including websocket clients
+	DefaultRoles []string `json:"defaultRoles"`
+
+	// AnonymousRoles, if set, are granted to unauthenticated principals (websocket clients, and
+	// REST clients when no authenticator is configured) instead of DefaultRoles
+	AnonymousRoles []string `json:"anonymousRoles"`
+
+	// Rules are evaluated after the built-in role rules
+	Rules []PolicyRule `json:"rules"`
+}
+
+var builtinPolicyRules = []PolicyRule{
+	{
+		Effect:     PolicyEffectAllow,
+		Roles:      []string{RoleViewer, RoleOperator, RoleEngineer},
+		Payloads:   []string{"WebConfigGet*", "WebRuntime*", "WebGatewayGet*", "WebGatewayFind*"},
+		Operations: []string{OperationRead},
+	},
+	{
+		Effect:     PolicyEffectAllow,
+		Roles:      []string{RoleOperator, RoleEngineer},
+		Payloads:   []string{"WebRuntimeDatabaseRequest", "WebGatewayTransactionRequest", "WebGatewayConditionalWriteRequest"},
+		Operations: []string{OperationWrite},
+	},
+	{
+		Effect:   PolicyEffectAllow,
+		Roles:    []string{RoleEngineer},
+		Payloads: []string{"WebConfig*", "WebGatewayRenameEntityRequest", "WebGatewayMoveEntityRequest", "WebGatewayCloneEntityRequest", "WebGatewayCreateSnapshotRequest", "WebGatewayPreviewRestoreRequest", "WebGatewayDiffSnapshotsRequest", "WebGatewayListBackupsRequest", "WebGatewayDownloadBackupRequest"},
+	},
+	{
+		Effect:   PolicyEffectDeny,
+		Roles:    []string{RoleEngineer},
+		Payloads: []string{"WebConfigRestoreSnapshotRequest"},
+	},
+	{
+		Effect: PolicyEffectAllow,
+		Roles:  []string{RoleAdmin},
+	},
+}
+
+// NewDefaultPolicy grants every principal the admin role, which matches the behaviour of the
+// gateway before authorization was introduced.
+func NewDefaultPolicy() *Policy {
+	return &Policy{
+		Principals:   make(map[string][]string),
+		DefaultRoles: []string{RoleAdmin},
+	}
+}
+
+// NewAuthenticatedDefaultPolicy grants every authenticated principal the admin role, and
+// unauthenticated principals no role at all.
+func NewAuthenticatedDefaultPolicy() *Policy {
+	p := NewDefaultPolicy()
+	p.AnonymousRoles = []string{}
+	return p
+}
+
+func LoadPolicy(filePath string) (*Policy, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+
+	if p.Principals == nil {
+		p.Principals = make(map[string][]string)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Effect != PolicyEffectAllow && rule.Effect != PolicyEffectDeny {
+			return nil, fmt.Errorf("%s: rule %d has invalid effect '%s'", filePath, i, rule.Effect)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Policy) RolesOf(principal *Principal) []string {
+	roles := []string{}
+	roles = append(roles, principal.Roles...)
+	roles = append(roles, p.Principals[principal.Name]...)
+
+	if len(roles) == 0 {
+		if principal.Method == AuthMethodAnonymous && p.AnonymousRoles != nil {
+			roles = append(roles, p.AnonymousRoles...)
+		} else {
+			roles = append(roles, p.DefaultRoles...)
+		}
+	}
+
+	return roles
+}
+
+// Authorize returns nil if principal may perform access, or an error describing why not.
+// A principal is allowed if any of its roles is allowed; within a role, deny rules take
+// precedence over allow rules.
+func (p *Policy) Authorize(principal *Principal, access *Access) error {
+	roles := p.RolesOf(principal)
+
+	for _, role := range roles {
+		allowed := false
+		denied := false
+
+		for _, rules := range [][]PolicyRule{builtinPolicyRules, p.Rules} {
+			for i := range rules {
+				if !rules[i].Matches(role, access) {
+					continue
+				}
+
+				if rules[i].Effect == PolicyEffectDeny {
+					denied = true
+				} else {
+					allowed = true
+				}
+			}
+		}
+
+		if allowed && !denied {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("principal '%s' (roles: %s) is not permitted to %s", principal.Name, strings.Join(roles, ","), access.String())
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
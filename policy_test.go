@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := &Policy{
+		Principals: map[string][]string{
+			"alice": {RoleAdmin},
+			"bob":   {RoleOperator},
+			"carol": {RoleEngineer},
+			"dave":  {RoleViewer, RoleOperator},
+		},
+		DefaultRoles: []string{RoleViewer},
+		Rules: []PolicyRule{
+			{
+				Effect:      PolicyEffectDeny,
+				Roles:       []string{RoleOperator},
+				Payloads:    []string{"WebRuntimeDatabaseRequest"},
+				Operations:  []string{OperationWrite},
+				EntityTypes: []string{"Interlock"},
+			},
+			{
+				Effect:   PolicyEffectDeny,
+				Roles:    []string{RoleOperator, RoleEngineer},
+				Fields:   []string{"Safety*"},
+				Subtrees: []string{"area1"},
+			},
+			{
+				Effect:      PolicyEffectAllow,
+				Roles:       []string{RoleOperator},
+				Payloads:    []string{"WebConfigCreateEntityRequest"},
+				EntityTypes: []string{"Sensor"},
+			},
+		},
+	}
+
+	write := func(entityType string, field string, ancestors ...string) *Access {
+		access := &Access{Payload: "WebRuntimeDatabaseRequest", Operation: OperationWrite, EntityType: entityType, Field: field, Ancestors: ancestors}
+		if len(ancestors) > 0 {
+			access.EntityId = ancestors[0]
+		}
+		return access
+	}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		access    *Access
+		allowed   bool
+	}{
+		{"viewer reads", &Principal{Name: "eve"}, &Access{Payload: "WebConfigGetEntityRequest", Operation: OperationRead}, true},
+		{"viewer cannot write", &Principal{Name: "eve"}, write("Sensor", "Value"), false},
+		{"viewer cannot create", &Principal{Name: "eve"}, &Access{Payload: "WebConfigCreateEntityRequest", Operation: OperationWrite, EntityType: "Sensor"}, false},
+		{"operator writes", &Principal{Name: "bob"}, write("Sensor", "Value", "sensor1", "area2"), true},
+		{"operator cannot write interlocks", &Principal{Name: "bob"}, write("Interlock", "Value", "interlock1"), false},
+		{"operator reads interlocks", &Principal{Name: "bob"}, &Access{Payload: "WebRuntimeDatabaseRequest", Operation: OperationRead, EntityType: "Interlock"}, true},
+		{"operator cannot write safety fields in subtree", &Principal{Name: "bob"}, write("Sensor", "SafetyLimit", "sensor1", "area1", "root"), false},
+		{"operator writes safety fields outside subtree", &Principal{Name: "bob"}, write("Sensor", "SafetyLimit", "sensor2", "area2", "root"), true},
+		{"operator creates allowed type", &Principal{Name: "bob"}, &Access{Payload: "WebConfigCreateEntityRequest", Operation: OperationWrite, EntityType: "Sensor"}, true},
+		{"operator cannot create other types", &Principal{Name: "bob"}, &Access{Payload: "WebConfigCreateEntityRequest", Operation: OperationWrite, EntityType: "Area"}, false},
+		{"operator cannot change schemas", &Principal{Name: "bob"}, &Access{Payload: "WebConfigSetEntitySchemaRequest", Operation: OperationWrite}, false},
+		{"engineer changes schemas", &Principal{Name: "carol"}, &Access{Payload: "WebConfigSetEntitySchemaRequest", Operation: OperationWrite}, true},
+		{"engineer cannot restore snapshots", &Principal{Name: "carol"}, &Access{Payload: "WebConfigRestoreSnapshotRequest", Operation: OperationWrite}, false},
+		{"engineer cannot read safety fields in subtree", &Principal{Name: "carol"}, &Access{Payload: "WebRuntimeDatabaseRequest", Operation: OperationRead, Field: "SafetyLimit", Ancestors: []string{"sensor1", "area1"}}, false},
+		{"admin restores snapshots", &Principal{Name: "alice"}, &Access{Payload: "WebConfigRestoreSnapshotRequest", Operation: OperationWrite}, true},
+		{"admin is not bound by role rules", &Principal{Name: "alice"}, write("Interlock", "SafetyLimit", "interlock1", "area1"), true},
+		{"any role may allow", &Principal{Name: "dave"}, write("Sensor", "Value"), true},
+		{"denied in every role", &Principal{Name: "dave"}, write("Interlock", "Value", "interlock1"), false},
+		{"authenticator roles", &Principal{Name: "frank", Roles: []string{RoleEngineer}}, &Access{Payload: "WebConfigSetFieldSchemaRequest", Operation: OperationWrite}, true},
+		{"authenticator roles replace default roles", &Principal{Name: "frank", Roles: []string{"unknown"}}, &Access{Payload: "WebConfigGetEntityRequest", Operation: OperationRead}, false},
+		{"anonymous gets default roles", NewAnonymousPrincipal(), &Access{Payload: "WebConfigGetEntityRequest", Operation: OperationRead}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Authorize(tt.principal, tt.access)
+			if tt.allowed && err != nil {
+				t.Errorf("expected %s to be allowed: %v", tt.access, err)
+			} else if !tt.allowed && err == nil {
+				t.Errorf("expected %s to be denied", tt.access)
+			}
+		})
+	}
+}
+
+func TestPolicyAnonymousRoles(t *testing.T) {
+	read := &Access{Payload: "WebConfigGetEntityRequest", Operation: OperationRead}
+
+	tests := []struct {
+		name      string
+		policy    *Policy
+		principal *Principal
+		allowed   bool
+	}{
+		{"default policy grants anonymous admin", NewDefaultPolicy(), NewAnonymousPrincipal(), true},
+		{"authenticated default policy denies anonymous", NewAuthenticatedDefaultPolicy(), NewAnonymousPrincipal(), false},
+		{"authenticated default policy grants authenticated admin", NewAuthenticatedDefaultPolicy(), &Principal{Name: "alice", Method: AuthMethodBasic}, true},
+		{"anonymous roles replace default roles", &Policy{DefaultRoles: []string{RoleAdmin}, AnonymousRoles: []string{RoleViewer}}, NewAnonymousPrincipal(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Authorize(tt.principal, read)
+			if tt.allowed && err != nil {
+				t.Errorf("expected read to be allowed: %v", err)
+			} else if !tt.allowed && err == nil {
+				t.Errorf("expected read to be denied")
+			}
+		})
+	}
+
+	restricted := &Policy{DefaultRoles: []string{RoleAdmin}, AnonymousRoles: []string{RoleViewer}}
+	if err := restricted.Authorize(NewAnonymousPrincipal(), &Access{Payload: "WebConfigDeleteEntityRequest", Operation: OperationWrite}); err == nil {
+		t.Errorf("expected anonymous principals to be limited to their anonymous roles")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.json")
+	os.WriteFile(valid, []byte(`{"defaultRoles": ["viewer"], "anonymousRoles": [], "rules": [{"effect": "deny", "roles": ["viewer"]}]}`), 0o600)
+
+	policy, err := LoadPolicy(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.Principals == nil || policy.AnonymousRoles == nil || len(policy.Rules) != 1 {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{"rules": [{"effect": "maybe"}]}`), 0o600)
+
+	if _, err := LoadPolicy(invalid); err == nil {
+		t.Errorf("expected a rule with an invalid effect to be rejected")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	jsonpb "google.golang.org/protobuf/encoding/protojson"
+)
+
+const DefaultMaxBatchSize = 1000
+
+// batchItem is a request of a batch, or the reason it could not be parsed
+type batchItem struct {
+	Request web.Message
+	Err     error
+}
+
+// onBatch handles many WebMessages in one HTTP request. They are dispatched in order, and the
+// response at each position of the batch answers the request at the same position. A request
+// that fails does not affect the others.
+//
+// JSON batches are arrays of WebMessages. Protobuf batches are streams of size-delimited
+// WebMessages, as written by protodelim.MarshalTo.
+func (w *RestApiWorker) onBatch(wr http.ResponseWriter, r *http.Request) {
+	items, err := readBatch(r)
+	if err != nil {
+		log.Error("Failed to parse batch: %v", err)
+		writeGatewayErrorResponse(wr, r, &protobufs.WebMessage{}, GatewayErrorMalformedRequest, "could not parse batch: %v", err)
+		return
+	}
+
+	if len(items) > DefaultMaxBatchSize {
+		log.Error("Batch of %d requests exceeds the limit of %d", len(items), DefaultMaxBatchSize)
+		writeGatewayErrorResponse(wr, r, &protobufs.WebMessage{}, GatewayErrorMalformedRequest, "batch of %d requests exceeds the limit of %d", len(items), DefaultMaxBatchSize)
+		return
+	}
+
+	responses := make([]web.Message, len(items))
+	clients := []*RestApiWebClient{}
+	positions := []int{}
+
+	for i, item := range items {
+		if item.Err != nil {
+			log.Error("Failed to parse request %d of batch: %v", i, item.Err)
+			responses[i] = toGatewayError(&protobufs.WebMessage{}, requestParseErrorCode(item.Err), "could not parse request %d: %v", i, item.Err)
+			continue
+		}
+
+		if item.Request.Header == nil {
+			item.Request.Header = &protobufs.WebHeader{}
+		}
+
+		clients = append(clients, &RestApiWebClient{
+			Request:    item.Request,
+			ResponseCh: make(chan web.Message, 1),
+		})
+		positions = append(positions, i)
+	}
+
+	requestTimeout := requestTimeoutOf(r)
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	timedOut := false
+	w.batchCh <- clients
+	for i, client := range clients {
+		if !timedOut {
+			select {
+			case response := <-client.ResponseCh:
+				responses[positions[i]] = response
+				continue
+			case <-timeout.C:
+				log.Error("Timeout waiting for batch responses")
+				timedOut = true
+			}
+		}
+
+		select {
+		case response := <-client.ResponseCh:
+			responses[positions[i]] = response
+		default:
+			responses[positions[i]] = toGatewayError(&protobufs.WebMessage{Header: &protobufs.WebHeader{Id: client.Id()}}, GatewayErrorTimeout, "no response within %v", requestTimeout)
+		}
+	}
+
+	writeBatch(wr, r, responses)
+}
+
+func readBatch(r *http.Request) ([]*batchItem, error) {
+	items := []*batchItem{}
+
+	if requestContentType(r) == ContentTypeProtobuf {
+		reader := bufio.NewReader(r.Body)
+		for {
+			msg := &protobufs.WebMessage{}
+			err := protodelim.UnmarshalFrom(reader, msg)
+			if errors.Is(err, io.EOF) {
+				return items, nil
+			}
+
+			// The size prefix of the next message can't be trusted after a failure
+			if err != nil {
+				return nil, fmt.Errorf("request %d: %v", len(items), err)
+			}
+
+			items = append(items, &batchItem{Request: msg})
+		}
+	}
+
+	raws := []json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&raws); err != nil {
+		return nil, err
+	}
+
+	for _, raw := range raws {
+		msg := &protobufs.WebMessage{}
+		if err := unmarshalJsonWebMessage(raw, msg); err != nil {
+			items = append(items, &batchItem{Err: err})
+			continue
+		}
+
+		items = append(items, &batchItem{Request: msg})
+	}
+
+	return items, nil
+}
+
+func writeBatch(wr http.ResponseWriter, r *http.Request, responses []web.Message) {
+	contentType := responseContentType(r)
+	b := &bytes.Buffer{}
+
+	if contentType == ContentTypeProtobuf {
+		for _, response := range responses {
+			if _, err := protodelim.MarshalTo(b, response); err != nil {
+				log.Error("Failed to marshal response: %v", err)
+				http.Error(wr, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	} else {
+		marshaller := &jsonpb.MarshalOptions{
+			EmitUnpopulated:   true,
+			EmitDefaultValues: true,
+		}
+
+		b.WriteString("[")
+		for i, response := range responses {
+			s, err := marshaller.Marshal(response)
+			if err != nil {
+				log.Error("Failed to marshal response: %v", err)
+				http.Error(wr, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.Write(s)
+		}
+		b.WriteString("]")
+	}
+
+	wr.Header().Set("Content-Type", contentType)
+	wr.Header().Add("Vary", "Accept, Content-Type")
+	wr.WriteHeader(http.StatusOK)
+	wr.Write(b.Bytes())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/log"
+	web "github.com/rqure/qlib/pkg/web/go"
+	jsonpb "google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const ContentTypeJson = "application/json"
+const ContentTypeProtobuf = "application/x-protobuf"
+
+// isProtobufContentType reports whether contentType names the protobuf wire format
+func isProtobufContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == ContentTypeProtobuf || mediaType == "application/protobuf" || mediaType == "application/vnd.google.protobuf"
+}
+
+// requestContentType returns the format of the request body. Anything that isn't protobuf is
+// parsed as JSON, so that clients which don't set a content type keep working.
+func requestContentType(r *http.Request) string {
+	if isProtobufContentType(r.Header.Get("Content-Type")) {
+		return ContentTypeProtobuf
+	}
+
+	return ContentTypeJson
+}
+
+// responseContentType picks the format of the response from the Accept header, falling back
+// to the format of the request
+func responseContentType(r *http.Request) string {
+	best := ""
+	bestQuality := 0.0
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = v
+			}
+		}
+
+		contentType := ""
+		if isProtobufContentType(mediaType) {
+			contentType = ContentTypeProtobuf
+		} else if mediaType == ContentTypeJson {
+			contentType = ContentTypeJson
+		}
+
+		if contentType != "" && quality > bestQuality {
+			best = contentType
+			bestQuality = quality
+		}
+	}
+
+	if best == "" {
+		return requestContentType(r)
+	}
+
+	return best
+}
+
+func unmarshalWebMessage(r *http.Request, b []byte, msg web.Message) error {
+	if requestContentType(r) == ContentTypeProtobuf {
+		return proto.Unmarshal(b, msg)
+	}
+
+	return unmarshalJsonWebMessage(b, msg)
+}
+
+// unmarshalJsonWebMessage parses a JSON request. If the payload's '@type' is not a registered
+// message, the error wraps protoregistry.NotFound.
+func unmarshalJsonWebMessage(b []byte, msg web.Message) error {
+	resolver := &typeResolver{Types: protoregistry.GlobalTypes}
+
+	err := jsonpb.UnmarshalOptions{Resolver: resolver}.Unmarshal(b, msg)
+	if err != nil && resolver.unresolved != "" {
+		return fmt.Errorf("unknown payload type '%s': %w", resolver.unresolved, protoregistry.NotFound)
+	}
+
+	return err
+}
+
+// typeResolver resolves types from the global registry, and remembers the last type URL it
+// could not resolve. protojson does not wrap the resolver's error, so this is how a missing
+// type is told apart from other parse errors.
+type typeResolver struct {
+	*protoregistry.Types
+	unresolved string
+}
+
+func (r *typeResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	mt, err := r.Types.FindMessageByURL(url)
+	if errors.Is(err, protoregistry.NotFound) {
+		r.unresolved = url
+	}
+
+	return mt, err
+}
+
+func writeWebMessage(wr http.ResponseWriter, r *http.Request, msg web.Message, statusCode int) {
+	contentType := responseContentType(r)
+
+	var b []byte
+	var err error
+	if contentType == ContentTypeProtobuf {
+		b, err = proto.Marshal(msg)
+	} else {
+		marshaller := &jsonpb.MarshalOptions{
+			EmitUnpopulated:   true,
+			EmitDefaultValues: true,
+		}
+		b, err = marshaller.Marshal(msg)
+	}
+
+	if err != nil {
+		log.Error("Failed to marshal response: %v", err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", contentType)
+	wr.Header().Add("Vary", "Accept, Content-Type")
+	wr.WriteHeader(statusCode)
+	wr.Write(b)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+)
+
+func TestRequestParseErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code string
+	}{
+		{"unknown payload type", `{"payload": {"@type": "type.googleapis.com/qdb.WebConfigMissingRequest"}}`, GatewayErrorUnknownType},
+		{"invalid json", `{"payload": `, GatewayErrorMalformedRequest},
+		{"invalid field", fmt.Sprintf(`{"payload": {"@type": "%s", "id": 5}}`, typeUrlOf(&protobufs.WebConfigGetEntityRequest{})), GatewayErrorMalformedRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := unmarshalJsonWebMessage([]byte(tt.body), &protobufs.WebMessage{})
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+
+			if code := requestParseErrorCode(err); code != tt.code {
+				t.Errorf("expected %s, got %s (%v)", tt.code, code, err)
+			}
+		})
+	}
+}
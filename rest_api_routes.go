@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	jsonpb "google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ClientIdHeader identifies the client issued by '/make-client-id' on '/v1' routes. The
+// 'clientId' query parameter can be used instead.
+const ClientIdHeader = "X-Client-Id"
+
+// The '/v1' routes are a resource oriented alternative to posting WebMessage envelopes to
+// '/api'. Each route builds the equivalent request payload and dispatches it through the
+// same authentication, authorization and worker pipeline.
+func (w *RestApiWorker) registerResourceRoutes() {
+	http.HandleFunc("GET /v1/entities/{id}", w.onGetEntity)
+	http.HandleFunc("POST /v1/entities", w.onCreateEntity)
+	http.HandleFunc("DELETE /v1/entities/{id}", w.onDeleteEntity)
+	http.HandleFunc("GET /v1/entities/{id}/fields/{field}", w.onReadField)
+	http.HandleFunc("PUT /v1/entities/{id}/fields/{field}", w.onWriteField)
+	http.HandleFunc("GET /v1/types/{type}/schema", w.onGetEntitySchema)
+	http.HandleFunc("GET /v1/types/{type}/entities", w.onGetEntities)
+	http.HandleFunc("POST /v1/snapshots/diff", w.onDiffSnapshots)
+	http.HandleFunc("GET /v1/backups", w.onListBackups)
+	http.HandleFunc("GET /v1/backups/{name}", w.onDownloadBackup)
+	http.HandleFunc("POST /v1/backups/{name}/restore", w.onRestoreBackup)
+}
+
+func (w *RestApiWorker) onGetEntity(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(protobufs.WebConfigGetEntityResponse)
+	if !w.call(wr, r, &protobufs.WebConfigGetEntityRequest{Id: r.PathValue("id")}, rsp) {
+		return
+	}
+
+	if rsp.Status != protobufs.WebConfigGetEntityResponse_SUCCESS {
+		writeResourceError(wr, GatewayErrorNotFound, "entity '%s' does not exist", r.PathValue("id"))
+		return
+	}
+
+	writeResource(wr, http.StatusOK, rsp.Entity)
+}
+
+func (w *RestApiWorker) onCreateEntity(wr http.ResponseWriter, r *http.Request) {
+	req := new(protobufs.WebConfigCreateEntityRequest)
+	if !readResource(wr, r, req) {
+		return
+	}
+
+	rsp := new(protobufs.WebConfigCreateEntityResponse)
+	if !w.call(wr, r, req, rsp) {
+		return
+	}
+
+	if rsp.Status != protobufs.WebConfigCreateEntityResponse_SUCCESS {
+		writeResourceError(wr, GatewayErrorRequestFailed, "could not create entity '%s' of type '%s'", req.Name, req.Type)
+		return
+	}
+
+	wr.Header().Set("Location", "/v1/entities/"+url.PathEscape(rsp.Id))
+	writeResource(wr, http.StatusCreated, rsp)
+}
+
+func (w *RestApiWorker) onDeleteEntity(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(protobufs.WebConfigDeleteEntityResponse)
+	if !w.call(wr, r, &protobufs.WebConfigDeleteEntityRequest{Id: r.PathValue("id")}, rsp) {
+		return
+	}
+
+	if rsp.Status != protobufs.WebConfigDeleteEntityResponse_SUCCESS {
+		writeResourceError(wr, GatewayErrorRequestFailed, "could not delete entity '%s'", r.PathValue("id"))
+		return
+	}
+
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+func (w *RestApiWorker) onReadField(wr http.ResponseWriter, r *http.Request) {
+	req := &protobufs.WebRuntimeDatabaseRequest{
+		RequestType: protobufs.WebRuntimeDatabaseRequest_READ,
+		Requests: []*protobufs.DatabaseRequest{
+			{
+				Id:    r.PathValue("id"),
+				Field: r.PathValue("field"),
+			},
+		},
+	}
+
+	w.callDatabaseRequest(wr, r, req)
+}
+
+// onWriteField accepts the new value either as an 'Any' ({"value": {"@type": ..., "raw": ...}})
+// or as the bare raw value ({"value": 42}), in which case the type is taken from the field schema.
+func (w *RestApiWorker) onWriteField(wr http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Value json.RawMessage `json:"value"`
+	}{}
+
+	if !readJson(wr, r, &body) {
+		return
+	}
+
+	if len(body.Value) == 0 {
+		writeResourceError(wr, GatewayErrorMalformedRequest, "request body has no 'value'")
+		return
+	}
+
+	value := new(anypb.Any)
+	if err := jsonpb.Unmarshal(body.Value, value); err != nil {
+		rsp := new(protobufs.WebConfigGetFieldSchemaResponse)
+		if !w.call(wr, r, &protobufs.WebConfigGetFieldSchemaRequest{Field: r.PathValue("field")}, rsp) {
+			return
+		}
+
+		if rsp.Status != protobufs.WebConfigGetFieldSchemaResponse_SUCCESS {
+			writeResourceError(wr, GatewayErrorNotFound, "field '%s' does not exist", r.PathValue("field"))
+			return
+		}
+
+		value, err = newFieldValue(rsp.Schema.Type, body.Value)
+		if err != nil {
+			writeResourceError(wr, GatewayErrorMalformedRequest, "invalid value for field '%s': %v", r.PathValue("field"), err)
+			return
+		}
+	}
+
+	req := &protobufs.WebRuntimeDatabaseRequest{
+		RequestType: protobufs.WebRuntimeDatabaseRequest_WRITE,
+		Requests: []*protobufs.DatabaseRequest{
+			{
+				Id:    r.PathValue("id"),
+				Field: r.PathValue("field"),
+				Value: value,
+			},
+		},
+	}
+
+	w.callDatabaseRequest(wr, r, req)
+}
+
+func (w *RestApiWorker) callDatabaseRequest(wr http.ResponseWriter, r *http.Request, req *protobufs.WebRuntimeDatabaseRequest) {
+	rsp := new(protobufs.WebRuntimeDatabaseResponse)
+	if !w.call(wr, r, req, rsp) {
+		return
+	}
+
+	if len(rsp.Response) != 1 {
+		writeResourceError(wr, GatewayErrorInternal, "expected 1 result, got %d", len(rsp.Response))
+		return
+	}
+
+	result := rsp.Response[0]
+	if !result.Success {
+		if e := gatewayErrorOf(result.Value); e != nil {
+			writeResourceError(wr, e.Code, "%s", e.Message)
+			return
+		}
+
+		writeResourceError(wr, GatewayErrorNotFound, "field '%s' of entity '%s' could not be accessed", result.Field, result.Id)
+		return
+	}
+
+	writeResource(wr, http.StatusOK, result)
+}
+
+func (w *RestApiWorker) onGetEntitySchema(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(protobufs.WebConfigGetEntitySchemaResponse)
+	if !w.call(wr, r, &protobufs.WebConfigGetEntitySchemaRequest{Type: r.PathValue("type")}, rsp) {
+		return
+	}
+
+	if rsp.Status != protobufs.WebConfigGetEntitySchemaResponse_SUCCESS {
+		writeResourceError(wr, GatewayErrorNotFound, "entity type '%s' does not exist", r.PathValue("type"))
+		return
+	}
+
+	writeResource(wr, http.StatusOK, rsp.Schema)
+}
+
+func (w *RestApiWorker) onGetEntities(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(protobufs.WebRuntimeGetEntitiesResponse)
+	if !w.call(wr, r, &protobufs.WebRuntimeGetEntitiesRequest{EntityType: r.PathValue("type")}, rsp) {
+		return
+	}
+
+	writeResource(wr, http.StatusOK, rsp)
+}
+
+// onDiffSnapshots compares the snapshots 'from' and 'to' in the request body
+func (w *RestApiWorker) onDiffSnapshots(wr http.ResponseWriter, r *http.Request) {
+	req := new(WebGatewayDiffSnapshotsRequest)
+	if !readJson(wr, r, req) {
+		return
+	}
+
+	if len(req.From) == 0 || len(req.To) == 0 {
+		writeResourceError(wr, GatewayErrorMalformedRequest, "request body needs both 'from' and 'to'")
+		return
+	}
+
+	rsp := new(WebGatewayDiffSnapshotsResponse)
+	if !w.callGateway(wr, r, WebGatewayDiffSnapshotsRequestType, req, rsp) {
+		return
+	}
+
+	writeJson(wr, http.StatusOK, rsp)
+}
+
+func (w *RestApiWorker) onListBackups(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(WebGatewayListBackupsResponse)
+	if !w.callGateway(wr, r, WebGatewayListBackupsRequestType, &WebGatewayListBackupsRequest{}, rsp) {
+		return
+	}
+
+	writeJson(wr, http.StatusOK, rsp)
+}
+
+// onDownloadBackup responds with the snapshot stored in the backup, which can be restored
+// with WebConfigRestoreSnapshotRequest
+func (w *RestApiWorker) onDownloadBackup(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(WebGatewayDownloadBackupResponse)
+	if !w.callGateway(wr, r, WebGatewayDownloadBackupRequestType, &WebGatewayDownloadBackupRequest{Name: r.PathValue("name")}, rsp) {
+		return
+	}
+
+	filename := strings.TrimSuffix(rsp.Name, ".gz")
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	wr.WriteHeader(http.StatusOK)
+	wr.Write(rsp.Snapshot)
+}
+
+func (w *RestApiWorker) onRestoreBackup(wr http.ResponseWriter, r *http.Request) {
+	rsp := new(WebGatewayRestoreBackupResponse)
+	if !w.callGateway(wr, r, WebGatewayRestoreBackupRequestType, &WebGatewayRestoreBackupRequest{Name: r.PathValue("name")}, rsp) {
+		return
+	}
+
+	writeJson(wr, http.StatusOK, rsp)
+}
+
+// call dispatches req on behalf of the client making the HTTP request and unmarshals the
+// response into rsp. If the request is rejected, the error is written to wr and false is returned.
+func (w *RestApiWorker) call(wr http.ResponseWriter, r *http.Request, req proto.Message, rsp proto.Message) bool {
+	payload, err := anypb.New(req)
+	if err != nil {
+		log.Error("Failed to create payload: %v", err)
+		writeResourceError(wr, GatewayErrorInternal, "could not create request: %v", err)
+		return false
+	}
+
+	response, ok := w.dispatch(wr, r, payload)
+	if !ok {
+		return false
+	}
+
+	if err := response.UnmarshalTo(rsp); err != nil {
+		log.Error("Could not unmarshal response: %v", err)
+		writeResourceError(wr, GatewayErrorInternal, "unexpected response '%s'", response.GetTypeUrl())
+		return false
+	}
+
+	return true
+}
+
+// callGateway is like call for the gateway message req of messageType
+func (w *RestApiWorker) callGateway(wr http.ResponseWriter, r *http.Request, messageType string, req interface{}, rsp interface{}) bool {
+	payload, err := newGatewayPayload(messageType, req)
+	if err != nil {
+		log.Error("Failed to create payload: %v", err)
+		writeResourceError(wr, GatewayErrorInternal, "could not create request: %v", err)
+		return false
+	}
+
+	response, ok := w.dispatch(wr, r, payload)
+	if !ok {
+		return false
+	}
+
+	if err := unmarshalGatewayPayload(response, rsp); err != nil {
+		log.Error("Could not unmarshal response: %v", err)
+		writeResourceError(wr, GatewayErrorInternal, "unexpected response '%s'", response.GetTypeUrl())
+		return false
+	}
+
+	return true
+}
+
+// dispatch sends payload on behalf of the client making the HTTP request and returns the
+// response payload. If the request is rejected, the error is written to wr and false is returned.
+func (w *RestApiWorker) dispatch(wr http.ResponseWriter, r *http.Request, payload *anypb.Any) (*anypb.Any, bool) {
+	clientId := r.Header.Get(ClientIdHeader)
+	if clientId == "" {
+		clientId = r.URL.Query().Get("clientId")
+	}
+
+	client := &RestApiWebClient{
+		Request: &protobufs.WebMessage{
+			Header: &protobufs.WebHeader{
+				Id:        clientId,
+				Timestamp: timestamppb.Now(),
+			},
+			Payload: payload,
+		},
+		ResponseCh: make(chan web.Message, 1),
+	}
+
+	requestTimeout := requestTimeoutOf(r)
+	response, ok := w.send(client, requestTimeout)
+	if !ok {
+		log.Error("Timeout waiting for response")
+		writeResourceError(wr, GatewayErrorTimeout, "no response within %v", requestTimeout)
+		return nil, false
+	}
+
+	if response.Header != nil && response.Header.AuthenticationStatus == protobufs.WebHeader_UNAUTHENTICATED {
+		if w.authenticator != nil {
+			wr.Header().Set("WWW-Authenticate", w.authenticator.Challenge())
+		}
+
+		writeResourceError(wr, GatewayErrorUnauthenticated, "unknown or expired client id '%s'", clientId)
+		return nil, false
+	}
+
+	if e := gatewayErrorOf(response.Payload); e != nil {
+		writeResourceError(wr, e.Code, "%s", e.Message)
+		return nil, false
+	}
+
+	return response.Payload, true
+}
+
+// newFieldValue converts a bare JSON value into the protobuf message of fieldType
+func newFieldValue(fieldType string, raw json.RawMessage) (*anypb.Any, error) {
+	var messageType protoreflect.MessageType
+	for _, name := range []string{fieldType, "qdb." + fieldType} {
+		if mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name)); err == nil {
+			messageType = mt
+			break
+		}
+	}
+
+	if messageType == nil {
+		return nil, fmt.Errorf("unknown field type '%s'", fieldType)
+	}
+
+	value := messageType.New().Interface()
+	b, err := json.Marshal(map[string]json.RawMessage{"raw": raw})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jsonpb.Unmarshal(b, value); err != nil {
+		return nil, err
+	}
+
+	return anypb.New(value)
+}
+
+func readJson(wr http.ResponseWriter, r *http.Request, v interface{}) bool {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Failed to read request body: %v", err)
+		writeResourceError(wr, GatewayErrorMalformedRequest, "could not read request body: %v", err)
+		return false
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Error("Failed to parse request: %v", err)
+		writeResourceError(wr, GatewayErrorMalformedRequest, "could not parse request: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func readResource(wr http.ResponseWriter, r *http.Request, m proto.Message) bool {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Failed to read request body: %v", err)
+		writeResourceError(wr, GatewayErrorMalformedRequest, "could not read request body: %v", err)
+		return false
+	}
+
+	if err := jsonpb.Unmarshal(b, m); err != nil {
+		log.Error("Failed to parse request: %v", err)
+		writeResourceError(wr, GatewayErrorMalformedRequest, "could not parse request: %v", err)
+		return false
+	}
+
+	return true
+}
+
+func writeResource(wr http.ResponseWriter, statusCode int, m proto.Message) {
+	marshaller := &jsonpb.MarshalOptions{
+		EmitUnpopulated: true,
+	}
+	b, err := marshaller.Marshal(m)
+	if err != nil {
+		log.Error("Failed to marshal response: %v", err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(statusCode)
+	wr.Write(b)
+}
+
+func writeJson(wr http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error("Failed to marshal response: %v", err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(statusCode)
+	wr.Write(b)
+}
+
+// writeResourceError writes a WebGatewayError as the response of a '/v1' route
+func writeResourceError(wr http.ResponseWriter, code string, format string, args ...interface{}) {
+	b, err := json.Marshal(&WebGatewayError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if err != nil {
+		log.Error("Failed to marshal response: %v", err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(gatewayErrorStatusCode(code))
+	wr.Write(b)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,27 +17,30 @@ import (
 	"github.com/rqure/qlib/pkg/signalslots/signal"
 	web "github.com/rqure/qlib/pkg/web/go"
 	jsonpb "google.golang.org/protobuf/encoding/protojson"
-	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const DefaultClientTimeout = 5 * time.Second
 const DefaultRequestTimeout = 5 * time.Second
+const DefaultNotificationStreamHeartbeat = 15 * time.Second
 
 type ClientIdResponse struct {
 	ClientId string
 }
 
 type RestApiWebClient struct {
-	Request    web.Message
-	ResponseCh chan web.Message
-	Token      *RestApiWebClientToken
+	Request      web.Message
+	ResponseCh   chan web.Message
+	Token        *RestApiWebClientToken
+	DisconnectCh chan string
 }
 
 type RestApiWebClientToken struct {
-	ClientId string
-	Timeout  time.Duration
-	ExpireAt time.Time
+	ClientId  string
+	Principal *Principal
+	Timeout   time.Duration
+	ExpireAt  time.Time
 }
 
 func (c *RestApiWebClient) Id() string {
@@ -45,6 +51,14 @@ func (c *RestApiWebClient) Id() string {
 	return c.Request.Header.Id
 }
 
+func (c *RestApiWebClient) Principal() *Principal {
+	if c.Token == nil {
+		return nil
+	}
+
+	return c.Token.Principal
+}
+
 func (c *RestApiWebClient) Read() web.Message {
 	return c.Request
 }
@@ -53,8 +67,17 @@ func (c *RestApiWebClient) Write(msg web.Message) {
 	c.ResponseCh <- msg
 }
 
+// Close asks the RestApiWorker to disconnect the client and expire its token
 func (c *RestApiWebClient) Close() {
+	if c.DisconnectCh == nil {
+		return
+	}
 
+	select {
+	case c.DisconnectCh <- c.Id():
+	default:
+		log.Warn("Could not request disconnection of client %v", c.Id())
+	}
 }
 
 func (c *RestApiWebClient) SetMessageHandler(web.MessageHandler) {
@@ -62,26 +85,56 @@ func (c *RestApiWebClient) SetMessageHandler(web.MessageHandler) {
 }
 
 type RestApiWorker struct {
-	ClientConnected    signalslots.Signal
-	ClientDisconnected signalslots.Signal
-	Received           signalslots.Signal
-
-	activeClients map[string]*RestApiWebClientToken
-	clientCh      chan *RestApiWebClient
+	ClientConnected                signalslots.Signal
+	ClientDisconnected             signalslots.Signal
+	Received                       signalslots.Signal
+	NotificationStreamConnected    signalslots.Signal
+	NotificationStreamDisconnected signalslots.Signal
+
+	authenticator  Authenticator
+	activeClients  map[string]*RestApiWebClientToken
+	activeStreams  map[string]*RestApiNotificationStream
+	clientCh       chan *RestApiWebClient
+	batchCh        chan []*RestApiWebClient
+	disconnectCh   chan string
+	streamCh       chan *RestApiNotificationStream
+	streamClosedCh chan *RestApiNotificationStream
 }
 
-func NewRestApiWorker() *RestApiWorker {
+// NewRestApiWorker creates the REST API worker. When authenticator is nil every client is
+// issued a token as the anonymous principal.
+func NewRestApiWorker(authenticator Authenticator) *RestApiWorker {
 	return &RestApiWorker{
-		activeClients:      make(map[string]*RestApiWebClientToken),
-		clientCh:           make(chan *RestApiWebClient, 1024),
-		ClientConnected:    signal.New(),
-		ClientDisconnected: signal.New(),
-		Received:           signal.New(),
+		authenticator:                  authenticator,
+		activeClients:                  make(map[string]*RestApiWebClientToken),
+		activeStreams:                  make(map[string]*RestApiNotificationStream),
+		clientCh:                       make(chan *RestApiWebClient, 1024),
+		batchCh:                        make(chan []*RestApiWebClient, 1024),
+		disconnectCh:                   make(chan string, 1024),
+		streamCh:                       make(chan *RestApiNotificationStream, 1024),
+		streamClosedCh:                 make(chan *RestApiNotificationStream, 1024),
+		ClientConnected:                signal.New(),
+		ClientDisconnected:             signal.New(),
+		Received:                       signal.New(),
+		NotificationStreamConnected:    signal.New(),
+		NotificationStreamDisconnected: signal.New(),
 	}
 }
 
 func (w *RestApiWorker) Init(context.Context, app.Handle) {
 	http.HandleFunc("/make-client-id", func(wr http.ResponseWriter, r *http.Request) {
+		principal, err := w.authenticate(r)
+		if err != nil {
+			log.Warn("Failed to authenticate client from %v: %v", r.RemoteAddr, err)
+			w.writeUnauthenticated(wr, r, &protobufs.WebMessage{
+				Header: &protobufs.WebHeader{
+					Timestamp:            timestamppb.Now(),
+					AuthenticationStatus: protobufs.WebHeader_UNAUTHENTICATED,
+				},
+			})
+			return
+		}
+
 		clientTimeout := DefaultClientTimeout
 		clientTimeoutStr := r.URL.Query().Get("clientTimeout")
 		if clientTimeoutStr != "" {
@@ -117,9 +170,10 @@ func (w *RestApiWorker) Init(context.Context, app.Handle) {
 			},
 			ResponseCh: make(chan web.Message, 1),
 			Token: &RestApiWebClientToken{
-				ClientId: response.ClientId,
-				Timeout:  clientTimeout,
-				ExpireAt: time.Now().Add(clientTimeout),
+				ClientId:  response.ClientId,
+				Principal: principal,
+				Timeout:   clientTimeout,
+				ExpireAt:  time.Now().Add(clientTimeout),
 			},
 		}
 
@@ -128,24 +182,14 @@ func (w *RestApiWorker) Init(context.Context, app.Handle) {
 		select {
 		case response := <-client.ResponseCh:
 			// Send response back to client
-			marshaller := &jsonpb.MarshalOptions{
-				EmitUnpopulated:   true,
-				EmitDefaultValues: true,
-			}
-			s, err := marshaller.Marshal(response)
-			if err != nil {
-				log.Error("Failed to marshal response: %v", err)
-				http.Error(wr, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			wr.Write([]byte(s))
+			writeWebMessage(wr, r, response, http.StatusOK)
 
 			if !timeout.Stop() {
 				<-timeout.C
 			}
 		case <-timeout.C:
 			log.Error("Timeout waiting for response")
-			http.Error(wr, "Timeout waiting for response", http.StatusInternalServerError)
+			writeGatewayErrorResponse(wr, r, &protobufs.WebMessage{Header: &protobufs.WebHeader{Id: response.ClientId}}, GatewayErrorTimeout, "no response within %v", requestTimeout)
 			return
 		}
 	})
@@ -156,575 +200,329 @@ func (w *RestApiWorker) Init(context.Context, app.Handle) {
 			ResponseCh: make(chan web.Message, 1),
 		}
 
-		// Parse request and assume it is a WebMessage in JSON form
+		// Parse request as a WebMessage in JSON form, or protobuf wire format if the content type says so
 		if r.Body == nil {
 			log.Error("Request body is nil")
-			http.Error(wr, "Request body is nil", http.StatusBadRequest)
+			writeGatewayErrorResponse(wr, r, client.Request, GatewayErrorMalformedRequest, "request body is empty")
 			return
 		}
 
 		rBody, err := io.ReadAll(r.Body)
 		if err != nil {
 			log.Error("Failed to read request body: %v", err)
-			http.Error(wr, err.Error(), http.StatusBadRequest)
+			writeGatewayErrorResponse(wr, r, client.Request, GatewayErrorMalformedRequest, "could not read request body: %v", err)
 			return
 		}
 
-		err = jsonpb.Unmarshal(rBody, client.Request)
+		err = unmarshalWebMessage(r, rBody, client.Request)
 		if err != nil {
 			log.Error("Failed to parse request: %v", err)
-			http.Error(wr, err.Error(), http.StatusBadRequest)
+			writeGatewayErrorResponse(wr, r, &protobufs.WebMessage{}, requestParseErrorCode(err), "could not parse request: %v", err)
 			return
 		}
 
-		requestTimeout := DefaultRequestTimeout
-		requestTimeoutStr := r.URL.Query().Get("requestTimeout")
-		if requestTimeoutStr != "" {
-			log.Trace("Received query parameter: %v", requestTimeoutStr)
-			if timeout, err := time.ParseDuration(requestTimeoutStr); err == nil {
-				requestTimeout = timeout
-			} else {
-				log.Error("Invalid requestTimeout: %v", err)
-			}
+		if client.Request.Header == nil {
+			client.Request.Header = &protobufs.WebHeader{}
 		}
 
 		// Send request to worker thread and wait for response
-		timeout := time.NewTimer(requestTimeout)
-		w.clientCh <- client
-		select {
-		case response := <-client.ResponseCh:
-			// Send response back to client
-			marshaller := &jsonpb.MarshalOptions{
-				EmitUnpopulated:   true,
-				EmitDefaultValues: true,
-			}
-			s, err := marshaller.Marshal(response)
-			if err != nil {
-				log.Error("Failed to marshal response: %v", err)
-				http.Error(wr, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			wr.Write([]byte(s))
-
-			if !timeout.Stop() {
-				<-timeout.C
-			}
-		case <-timeout.C:
+		requestTimeout := requestTimeoutOf(r)
+		response, ok := w.send(client, requestTimeout)
+		if !ok {
 			log.Error("Timeout waiting for response")
-			http.Error(wr, "Timeout waiting for response", http.StatusInternalServerError)
-			return
-		}
-	}))
-
-	http.Handle("/examples/WebConfigCreateEntityRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigCreateEntityRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebConfigDeleteEntityRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigDeleteEntityRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			writeGatewayErrorResponse(wr, r, &protobufs.WebMessage{Header: &protobufs.WebHeader{Id: client.Id()}}, GatewayErrorTimeout, "no response within %v", requestTimeout)
 			return
 		}
 
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebConfigSetEntitySchemaRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigSetEntitySchemaRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebConfigCreateSnapshotRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigCreateSnapshotRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebConfigRestoreSnapshotRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigRestoreSnapshotRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebConfigGetEntityTypesRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigGetEntityTypesRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebConfigGetEntitySchemaRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigGetEntitySchemaRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
+		// Send response back to client
+		if response.Header != nil && response.Header.AuthenticationStatus == protobufs.WebHeader_UNAUTHENTICATED {
+			w.writeUnauthenticated(wr, r, response)
+		} else if e := gatewayErrorOf(response.Payload); e != nil {
+			writeWebMessage(wr, r, response, gatewayErrorStatusCode(e.Code))
+		} else {
+			writeWebMessage(wr, r, response, http.StatusOK)
 		}
-
-		wr.Write([]byte(s))
 	}))
 
-	http.Handle("/examples/WebConfigGetEntityRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigGetEntityRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
-
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	http.HandleFunc("/api/notifications/stream", w.onNotificationStream)
+	http.HandleFunc("POST /api/batch", w.onBatch)
 
-		wr.Write([]byte(s))
-	}))
+	w.registerResourceRoutes()
+	registerOpenApiRoutes()
+	registerExampleRoutes()
+}
 
-	http.Handle("/examples/WebConfigGetFieldSchemaRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigGetFieldSchemaRequest{})
+func (w *RestApiWorker) Deinit(context.Context) {
 
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+}
 
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
+func (w *RestApiWorker) DoWork(ctx context.Context) {
+	for clientId, token := range w.activeClients {
+		if w.activeStreams[clientId] != nil {
+			// An open notification stream keeps its client alive
+			token.ExpireAt = time.Now().Add(token.Timeout)
+		} else if time.Since(token.ExpireAt) > 0 {
+			log.Info("[RestApiWorker::DoWork] Client '%v' has been inactive for %v, disconnecting", clientId, token.Timeout)
+			delete(w.activeClients, clientId)
+			w.ClientDisconnected.Emit(ctx, clientId)
 		}
+	}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	for {
+		select {
+		case client := <-w.clientCh:
+			w.onClient(ctx, client)
+		case batch := <-w.batchCh:
+			// Handled in order, and without other clients' requests in between
+			for _, client := range batch {
+				w.onClient(ctx, client)
+			}
+		case clientId := <-w.disconnectCh:
+			if _, ok := w.activeClients[clientId]; ok {
+				log.Info("[RestApiWorker::DoWork] Disconnecting client: %v", clientId)
+				delete(w.activeClients, clientId)
 
-		wr.Write([]byte(s))
-	}))
+				if stream := w.activeStreams[clientId]; stream != nil {
+					stream.Close()
+				}
 
-	http.Handle("/examples/WebConfigGetRootRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebConfigGetRootRequest{})
+				w.ClientDisconnected.Emit(ctx, clientId)
+			}
+		case stream := <-w.streamCh:
+			if _, ok := w.activeClients[stream.ClientId()]; !ok {
+				stream.Accepted <- false
+				continue
+			}
 
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+			if previous := w.activeStreams[stream.ClientId()]; previous != nil {
+				previous.Close()
+			}
 
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
+			log.Info("[RestApiWorker::DoWork] Notification stream opened for client: %v", stream.ClientId())
+			w.activeStreams[stream.ClientId()] = stream
+			stream.Accepted <- true
+			w.NotificationStreamConnected.Emit(ctx, stream)
+		case stream := <-w.streamClosedCh:
+			if w.activeStreams[stream.ClientId()] == stream {
+				log.Info("[RestApiWorker::DoWork] Notification stream closed for client: %v", stream.ClientId())
+				delete(w.activeStreams, stream.ClientId())
+
+				if token, ok := w.activeClients[stream.ClientId()]; ok {
+					token.ExpireAt = time.Now().Add(token.Timeout)
+				}
+			}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			w.NotificationStreamDisconnected.Emit(ctx, stream)
+		default:
 			return
 		}
+	}
+}
 
-		wr.Write([]byte(s))
-	}))
+func (w *RestApiWorker) onClient(ctx context.Context, client *RestApiWebClient) {
+	if client.Token != nil {
+		log.Info("[RestApiWorker::DoWork] New client connected: %v (principal: %v)", client.Id(), client.Token.Principal.Name)
+		w.activeClients[client.Id()] = client.Token
+		w.ClientConnected.Emit(ctx, client)
+		client.Request.Header.AuthenticationStatus = protobufs.WebHeader_AUTHENTICATED
+		client.Write(client.Request)
+	} else if token, ok := w.activeClients[client.Id()]; ok {
+		token.ExpireAt = time.Now().Add(token.Timeout)
+		client.Token = token
+		client.DisconnectCh = w.disconnectCh
+		client.Request.Header.AuthenticationStatus = protobufs.WebHeader_AUTHENTICATED
+		w.onRequest(ctx, client)
+	} else {
+		if client.Request == nil {
+			client.Request = &protobufs.WebMessage{}
+		}
+
+		if client.Request.Header == nil {
+			client.Request.Header = &protobufs.WebHeader{}
+		}
+
+		client.Request.Header.AuthenticationStatus = protobufs.WebHeader_UNAUTHENTICATED
+		client.Request.Payload = nil
+		client.Write(client.Request)
+	}
+}
 
-	http.Handle("/examples/WebRuntimeDatabaseRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebRuntimeDatabaseRequest{})
+// onNotificationStream serves a client's notifications as Server-Sent Events. A client can
+// resume a stream by sending the id of the last event it received, either through the
+// 'Last-Event-ID' header or the 'lastEventId' query parameter.
+func (w *RestApiWorker) onNotificationStream(wr http.ResponseWriter, r *http.Request) {
+	flusher, ok := wr.(http.Flusher)
+	if !ok {
+		log.Error("Response writer does not support streaming")
+		http.Error(wr, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	clientId := r.URL.Query().Get("clientId")
 
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
+	lastEventIdStr := r.Header.Get("Last-Event-ID")
+	if lastEventIdStr == "" {
+		lastEventIdStr = r.URL.Query().Get("lastEventId")
+	}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
+	var lastEventId uint64
+	if lastEventIdStr != "" {
+		log.Trace("Received last event id: %v", lastEventIdStr)
+		id, err := strconv.ParseUint(lastEventIdStr, 10, 64)
 		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			log.Error("Invalid last event id: %v", err)
+			http.Error(wr, err.Error(), http.StatusBadRequest)
 			return
 		}
+		lastEventId = id
+	}
 
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebRuntimeRegisterNotificationRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebRuntimeRegisterNotificationRequest{})
+	stream := NewRestApiNotificationStream(clientId, lastEventId, lastEventIdStr != "")
 
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
+	timeout := time.NewTimer(DefaultRequestTimeout)
+	w.streamCh <- stream
+	select {
+	case accepted := <-stream.Accepted:
+		if !timeout.Stop() {
+			<-timeout.C
 		}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
+		if !accepted {
+			w.writeUnauthenticated(wr, r, &protobufs.WebMessage{
+				Header: &protobufs.WebHeader{
+					Id:                   clientId,
+					Timestamp:            timestamppb.Now(),
+					AuthenticationStatus: protobufs.WebHeader_UNAUTHENTICATED,
+				},
+			})
 			return
 		}
+	case <-timeout.C:
+		log.Error("Timeout waiting for response")
+		http.Error(wr, "Timeout waiting for response", http.StatusInternalServerError)
+		return
+	}
 
-		wr.Write([]byte(s))
-	}))
+	defer func() {
+		stream.Close()
+		w.streamClosedCh <- stream
+	}()
 
-	http.Handle("/examples/WebRuntimeGetNotificationsRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebRuntimeGetNotificationsRequest{})
+	wr.Header().Set("Content-Type", "text/event-stream")
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.Header().Set("Connection", "keep-alive")
+	wr.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	heartbeat := time.NewTicker(DefaultNotificationStreamHeartbeat)
+	defer heartbeat.Stop()
 
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Timestamp: timestamppb.Now(),
-				Id:        uuid.NewString(),
-			},
-			Payload: payload,
-		}
+	marshaller := &jsonpb.MarshalOptions{
+		EmitUnpopulated: true,
+	}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
+	for {
+		select {
+		case <-r.Context().Done():
 			return
-		}
-
-		wr.Write([]byte(s))
-	}))
-
-	http.Handle("/examples/WebRuntimeUnregisterNotificationRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebRuntimeUnregisterNotificationRequest{})
-
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
+		case <-stream.Closed:
 			return
-		}
-
-		response := &protobufs.WebMessage{
-			Header: &protobufs.WebHeader{
-				Id:        uuid.NewString(),
-				Timestamp: timestamppb.Now(),
-			},
-			Payload: payload,
-		}
+		case <-heartbeat.C:
+			fmt.Fprint(wr, ": keepalive\n\n")
+			flusher.Flush()
+		case event := <-stream.Events:
+			b, err := marshaller.Marshal(event.Notification)
+			if err != nil {
+				log.Error("Failed to marshal notification: %v", err)
+				continue
+			}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
+			fmt.Fprintf(wr, "id: %d\nevent: notification\ndata: %s\n\n", event.Id, b)
+			flusher.Flush()
 		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		wr.Write([]byte(s))
-	}))
+	}
+}
 
-	http.Handle("/examples/WebRuntimeGetDatabaseConnectionStatusRequest", http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
-		payload, err := anypb.New(&protobufs.WebRuntimeGetDatabaseConnectionStatusRequest{})
+// send hands client to the worker thread and waits for the response to its request. It
+// returns false if there was no response within requestTimeout.
+func (w *RestApiWorker) send(client *RestApiWebClient, requestTimeout time.Duration) (web.Message, bool) {
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	w.clientCh <- client
+	select {
+	case response := <-client.ResponseCh:
+		return response, true
+	case <-timeout.C:
+		return nil, false
+	}
+}
 
-		if err != nil {
-			log.Error("Failed to create payload: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
+func requestTimeoutOf(r *http.Request) time.Duration {
+	requestTimeout := DefaultRequestTimeout
+	requestTimeoutStr := r.URL.Query().Get("requestTimeout")
+	if requestTimeoutStr != "" {
+		log.Trace("Received query parameter: %v", requestTimeoutStr)
+		if timeout, err := time.ParseDuration(requestTimeoutStr); err == nil {
+			requestTimeout = timeout
+		} else {
+			log.Error("Invalid requestTimeout: %v", err)
 		}
+	}
 
-		response := &protobufs.WebMessage{
-			Payload: payload,
-			Header: &protobufs.WebHeader{
-				Id:        uuid.NewString(),
-				Timestamp: timestamppb.Now(),
-			},
-		}
+	return requestTimeout
+}
 
-		marshaller := &jsonpb.MarshalOptions{
-			EmitUnpopulated:   true,
-			EmitDefaultValues: true,
-		}
-		s, err := marshaller.Marshal(response)
-		if err != nil {
-			log.Error("Failed to marshal response: %v", err)
-			http.Error(wr, err.Error(), http.StatusInternalServerError)
-			return
-		}
+func (w *RestApiWorker) authenticate(r *http.Request) (*Principal, error) {
+	if w.authenticator == nil {
+		return NewAnonymousPrincipal(), nil
+	}
 
-		wr.Write([]byte(s))
-	}))
+	return w.authenticator.Authenticate(r)
 }
 
-func (w *RestApiWorker) Deinit(context.Context) {
+func (w *RestApiWorker) writeUnauthenticated(wr http.ResponseWriter, r *http.Request, msg web.Message) {
+	if w.authenticator != nil {
+		wr.Header().Set("WWW-Authenticate", w.authenticator.Challenge())
+	}
 
+	writeWebMessage(wr, r, msg, http.StatusUnauthorized)
 }
 
-func (w *RestApiWorker) DoWork(ctx context.Context) {
-	for clientId, token := range w.activeClients {
-		if time.Since(token.ExpireAt) > 0 {
-			log.Info("[RestApiWorker::DoWork] Client '%v' has been inactive for %v, disconnecting", clientId, token.Timeout)
-			delete(w.activeClients, clientId)
-			w.ClientDisconnected.Emit(ctx, clientId)
-		}
+// gatewayErrorStatusCode maps a WebGatewayError code to the HTTP status returned from '/api'
+func gatewayErrorStatusCode(code string) int {
+	switch code {
+	case GatewayErrorUnauthenticated:
+		return http.StatusUnauthorized
+	case GatewayErrorPermissionDenied:
+		return http.StatusForbidden
+	case GatewayErrorNotFound:
+		return http.StatusNotFound
+	case GatewayErrorRequestFailed:
+		return http.StatusUnprocessableEntity
+	case GatewayErrorUnknownType, GatewayErrorMalformedRequest:
+		return http.StatusBadRequest
+	case GatewayErrorStoreDisconnected:
+		return http.StatusServiceUnavailable
+	case GatewayErrorTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
 	}
+}
 
-	for {
-		select {
-		case client := <-w.clientCh:
-			if client.Token != nil {
-				log.Info("[RestApiWorker::DoWork] New client connected: %v", client.Id())
-				w.activeClients[client.Id()] = client.Token
-				w.ClientConnected.Emit(ctx, client)
-				client.Request.Header.AuthenticationStatus = protobufs.WebHeader_AUTHENTICATED
-				client.Write(client.Request)
-			} else if token, ok := w.activeClients[client.Id()]; ok {
-				token.ExpireAt = time.Now().Add(token.Timeout)
-				client.Request.Header.AuthenticationStatus = protobufs.WebHeader_AUTHENTICATED
-				w.onRequest(ctx, client)
-			} else {
-				if client.Request == nil {
-					client.Request = &protobufs.WebMessage{}
-				}
+// requestParseErrorCode distinguishes a payload '@type' the gateway does not know from
+// an otherwise malformed request
+func requestParseErrorCode(err error) string {
+	if errors.Is(err, protoregistry.NotFound) {
+		return GatewayErrorUnknownType
+	}
 
-				if client.Request.Header == nil {
-					client.Request.Header = &protobufs.WebHeader{}
-				}
+	return GatewayErrorMalformedRequest
+}
 
-				client.Request.Header.AuthenticationStatus = protobufs.WebHeader_UNAUTHENTICATED
-				client.Request.Payload = nil
-				client.Write(client.Request)
-			}
-		default:
-			return
-		}
-	}
+func writeGatewayErrorResponse(wr http.ResponseWriter, r *http.Request, msg web.Message, code string, format string, args ...interface{}) {
+	writeWebMessage(wr, r, toGatewayError(msg, code, format, args...), gatewayErrorStatusCode(code))
 }
 
 func (w *RestApiWorker) onRequest(ctx context.Context, client *RestApiWebClient) {
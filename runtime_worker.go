@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
 
 	"github.com/rqure/qlib/pkg/app"
 	"github.com/rqure/qlib/pkg/data"
@@ -12,23 +16,33 @@ import (
 	"github.com/rqure/qlib/pkg/log"
 	"github.com/rqure/qlib/pkg/protobufs"
 	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type RuntimeWorker struct {
 	store            data.Store
 	isStoreConnected bool
+	policy           *Policy
 
-	clientNotificationQueue  map[string]map[string][]data.Notification
-	clientNotificationTokens map[string]map[string]data.NotificationToken
+	notificationQueueConfig   NotificationQueueConfig
+	clientNotificationQueue   map[string]*notificationQueue
+	clientNotificationTokens  map[string]map[string]data.NotificationToken
+	clientNotificationHistory map[string]*notificationHistory
+	clientNotificationStreams map[string]NotificationStream
 }
 
-func NewRuntimeWorker(store data.Store) *RuntimeWorker {
+func NewRuntimeWorker(store data.Store, policy *Policy, notificationQueueConfig NotificationQueueConfig) *RuntimeWorker {
 	return &RuntimeWorker{
-		store:                    store,
-		isStoreConnected:         false,
-		clientNotificationQueue:  make(map[string]map[string][]data.Notification),
-		clientNotificationTokens: make(map[string]map[string]data.NotificationToken),
+		store:                     store,
+		isStoreConnected:          false,
+		policy:                    policy,
+		notificationQueueConfig:   notificationQueueConfig,
+		clientNotificationQueue:   make(map[string]*notificationQueue),
+		clientNotificationTokens:  make(map[string]map[string]data.NotificationToken),
+		clientNotificationHistory: make(map[string]*notificationHistory),
+		clientNotificationStreams: make(map[string]NotificationStream),
 	}
 }
 
@@ -46,8 +60,9 @@ func (w *RuntimeWorker) DoWork(context.Context) {
 
 func (w *RuntimeWorker) OnClientConnected(ctx context.Context, args ...interface{}) {
 	client := args[0].(web.Client)
-	w.clientNotificationQueue[client.Id()] = make(map[string][]data.Notification)
+	w.clientNotificationQueue[client.Id()] = newNotificationQueue(w.notificationQueueConfig)
 	w.clientNotificationTokens[client.Id()] = make(map[string]data.NotificationToken)
+	w.clientNotificationHistory[client.Id()] = &notificationHistory{}
 }
 
 func (w *RuntimeWorker) OnClientDisconnected(ctx context.Context, args ...interface{}) {
@@ -58,8 +73,57 @@ func (w *RuntimeWorker) OnClientDisconnected(ctx context.Context, args ...interf
 		token.Unbind(ctx)
 	}
 
+	if stream := w.clientNotificationStreams[clientId]; stream != nil {
+		stream.Close()
+	}
+
 	delete(w.clientNotificationQueue, clientId)
 	delete(w.clientNotificationTokens, clientId)
+	delete(w.clientNotificationHistory, clientId)
+	delete(w.clientNotificationStreams, clientId)
+}
+
+func (w *RuntimeWorker) OnNotificationStreamConnected(ctx context.Context, args ...interface{}) {
+	stream := args[0].(NotificationStream)
+	clientId := stream.ClientId()
+
+	history := w.clientNotificationHistory[clientId]
+	if history == nil {
+		log.Warn("Client %s has no notification history. Is it likely that it has just diconnected?", clientId)
+		stream.Close()
+		return
+	}
+
+	if previous := w.clientNotificationStreams[clientId]; previous != nil {
+		log.Info("Replacing notification stream for client %s", clientId)
+		previous.Close()
+	}
+
+	if lastEventId, ok := stream.ResumeAfter(); ok {
+		events := history.After(lastEventId)
+		log.Info("Resuming notification stream for client %s after event %d (%d events)", clientId, lastEventId, len(events))
+
+		for _, event := range events {
+			if !stream.Send(event) {
+				log.Warn("Notification stream for client %s cannot keep up with resumed events", clientId)
+				stream.Close()
+				return
+			}
+		}
+
+		// Resumed events cover anything that was queued for polling
+		w.clientNotificationQueue[clientId].Drain()
+	}
+
+	w.clientNotificationStreams[clientId] = stream
+}
+
+func (w *RuntimeWorker) OnNotificationStreamDisconnected(ctx context.Context, args ...interface{}) {
+	stream := args[0].(NotificationStream)
+
+	if w.clientNotificationStreams[stream.ClientId()] == stream {
+		delete(w.clientNotificationStreams, stream.ClientId())
+	}
 }
 
 func (w *RuntimeWorker) OnNewClientMessage(ctx context.Context, args ...interface{}) {
@@ -82,6 +146,12 @@ func (w *RuntimeWorker) OnNewClientMessage(ctx context.Context, args ...interfac
 		w.onRuntimeFieldExistsRequest(ctx, client, msg)
 	} else if msg.Payload.MessageIs(&protobufs.WebRuntimeEntityExistsRequest{}) {
 		w.onRuntimeEntityExistsRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayGetNotificationsRequestType {
+		w.onGatewayGetNotificationsRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayConditionalWriteRequestType {
+		w.onGatewayConditionalWriteRequest(ctx, client, msg)
+	} else if gatewayMessageType(msg.Payload) == WebGatewayGetEntitiesRequestType {
+		w.onGatewayGetEntitiesRequest(ctx, client, msg)
 	}
 }
 
@@ -114,8 +184,28 @@ func (w *RuntimeWorker) onRuntimeDatabaseRequest(ctx context.Context, client web
 		return
 	}
 
+	operation := OperationWrite
+	if req.RequestType == protobufs.WebRuntimeDatabaseRequest_READ {
+		operation = OperationRead
+	}
+
+	principal := principalOf(client)
 	reqs := []data.Request{}
+	paths := map[*protobufs.DatabaseRequest]string{}
 	for _, r := range req.Requests {
+		id, field, err := w.authorizeDatabaseRequest(ctx, principal, operation, r, "WebRuntimeDatabaseRequest")
+		if err != nil {
+			log.Warn("Rejected %s of field '%s' on entity '%s' for client %s: %s", operation, r.Field, r.Id, client.Id(), err.Message)
+			rejectDatabaseRequest(r, err)
+			continue
+		}
+
+		if field != r.Field {
+			paths[r] = r.Field
+		}
+
+		r.Id = id
+		r.Field = field
 		reqs = append(reqs, request.FromPb(r))
 	}
 
@@ -131,6 +221,11 @@ func (w *RuntimeWorker) onRuntimeDatabaseRequest(ctx context.Context, client web
 		log.Error("Could not handle request %v. Unknown request type.", req)
 	}
 
+	// Responses to field paths hold the entity the path resolved to and the path as it was sent
+	for r, path := range paths {
+		r.Field = path
+	}
+
 	msg.Header.Timestamp = timestamppb.Now()
 	if err := msg.Payload.MarshalFrom(rsp); err != nil {
 		log.Error("Could not marshal response: %v", err)
@@ -140,6 +235,161 @@ func (w *RuntimeWorker) onRuntimeDatabaseRequest(ctx context.Context, client web
 	client.Write(msg)
 }
 
+// authorizeDatabaseRequest resolves r's field path, if it has one, and authorizes principal to
+// perform operation on the field it resolves to under each of payloads. It returns the entity
+// and field to read or write.
+func (w *RuntimeWorker) authorizeDatabaseRequest(ctx context.Context, principal *Principal, operation string, r *protobufs.DatabaseRequest, payloads ...string) (string, string, *WebGatewayError) {
+	id, field := r.Id, r.Field
+
+	if isFieldPath(field) {
+		if operation != OperationRead {
+			return "", "", &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: "field paths can only be read"}
+		}
+
+		var err *WebGatewayError
+		id, field, err = resolveFieldPath(ctx, w.store, r.Id, r.Field, w.readAuthorizer(ctx, principal, payloads[0]))
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	for _, payload := range payloads {
+		access := newEntityAccess(ctx, w.store, payload, operation, id, field)
+		if err := w.policy.Authorize(principal, access); err != nil {
+			return "", "", &WebGatewayError{Code: GatewayErrorPermissionDenied, Message: err.Error()}
+		}
+	}
+
+	return id, field, nil
+}
+
+// readAuthorizer authorizes principal to read fields on behalf of payload
+func (w *RuntimeWorker) readAuthorizer(ctx context.Context, principal *Principal, payload string) func(string, string) error {
+	return func(entityId string, field string) error {
+		return w.policy.Authorize(principal, newEntityAccess(ctx, w.store, payload, OperationRead, entityId, field))
+	}
+}
+
+func (w *RuntimeWorker) onGatewayConditionalWriteRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayConditionalWriteRequest)
+	rsp := &WebGatewayConditionalWriteResponse{
+		Results: []WebGatewayConditionalWriteResult{},
+	}
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayConditionalWriteRequestType, err)
+		return
+	}
+
+	principal := principalOf(client)
+	for i, cw := range req.Requests {
+		result, err := w.conditionalWrite(ctx, principal, cw)
+		if err != nil {
+			log.Warn("Conditional write %d from client %s was not applied: %v", i, client.Id(), err)
+			result.Error = err
+		}
+
+		rsp.Results = append(rsp.Results, result)
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayConditionalWriteResponseType, rsp)
+}
+
+// conditionalWrite writes cw's request if the stored value matches its expectations. Requests
+// are handled one at a time, so no other gateway client can write between the check and the
+// write; writers that bypass the gateway can.
+func (w *RuntimeWorker) conditionalWrite(ctx context.Context, principal *Principal, cw WebGatewayConditionalWrite) (WebGatewayConditionalWriteResult, *WebGatewayError) {
+	result := WebGatewayConditionalWriteResult{}
+
+	r := new(protobufs.DatabaseRequest)
+	if err := protojson.Unmarshal(cw.Request, r); err != nil {
+		return result, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: fmt.Sprintf("could not decode request: %v", err)}
+	}
+
+	var expectedValue *anypb.Any
+	if len(cw.ExpectedValue) > 0 {
+		expectedValue = new(anypb.Any)
+		if err := protojson.Unmarshal(cw.ExpectedValue, expectedValue); err != nil {
+			return result, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: fmt.Sprintf("could not decode expected value: %v", err)}
+		}
+	}
+
+	// A conditional write is a write like any other, so rules that deny writing the field with
+	// a WebRuntimeDatabaseRequest apply to it as well
+	if _, _, err := w.authorizeDatabaseRequest(ctx, principal, OperationWrite, r, "WebRuntimeDatabaseRequest", WebGatewayConditionalWriteRequestType); err != nil {
+		return result, err
+	}
+
+	current := &protobufs.DatabaseRequest{Id: r.Id, Field: r.Field}
+	w.store.Read(ctx, request.FromPb(current))
+	if !current.Success {
+		return result, &WebGatewayError{Code: GatewayErrorNotFound, Message: fmt.Sprintf("could not read field '%s' of entity '%s'", r.Field, r.Id)}
+	}
+	result.Current = marshalDatabaseRequest(current)
+
+	if expectedValue != nil && !valuesEqual(current.Value, expectedValue) {
+		return result, &WebGatewayError{Code: GatewayErrorConditionFailed, Message: "the stored value does not match the expected value"}
+	}
+
+	if cw.ExpectedWriteTime != nil && !current.WriteTime.GetRaw().AsTime().Equal(*cw.ExpectedWriteTime) {
+		return result, &WebGatewayError{Code: GatewayErrorConditionFailed, Message: "the stored value was written at a different time than expected"}
+	}
+
+	if write, err := shouldWrite(cw, current.Value, r.Value); err != nil {
+		return result, err
+	} else if !write {
+		result.Suppressed = true
+		return result, nil
+	}
+
+	w.store.Write(ctx, request.FromPb(r))
+	if !r.Success {
+		return result, &WebGatewayError{Code: GatewayErrorRequestFailed, Message: fmt.Sprintf("could not write field '%s' of entity '%s'", r.Field, r.Id)}
+	}
+
+	result.Applied = true
+	result.Current = marshalDatabaseRequest(r)
+	return result, nil
+}
+
+// shouldWrite decides from cw's write mode whether value should replace the stored value
+func shouldWrite(cw WebGatewayConditionalWrite, stored *anypb.Any, value *anypb.Any) (bool, *WebGatewayError) {
+	switch cw.Mode {
+	case "", WriteModeAlways:
+		return true, nil
+	case WriteModeOnChange:
+		return !valuesEqual(stored, value), nil
+	case WriteModeDeadband:
+		if cw.Deadband < 0 || cw.DeadbandPercent < 0 {
+			return false, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: "deadbands cannot be negative"}
+		}
+
+		if cw.Deadband > 0 && cw.DeadbandPercent > 0 {
+			return false, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: "only one of deadband and deadbandPercent can be set"}
+		}
+
+		storedNumber, storedOk := numericValue(stored)
+		number, ok := numericValue(value)
+		if !ok {
+			return false, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: fmt.Sprintf("%s mode requires a numeric value", WriteModeDeadband)}
+		}
+
+		if !storedOk {
+			return true, nil
+		}
+
+		deadband := cw.Deadband
+		if cw.DeadbandPercent > 0 {
+			deadband = math.Abs(storedNumber) * cw.DeadbandPercent / 100
+		}
+
+		return math.Abs(number-storedNumber) > deadband, nil
+	default:
+		return false, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: fmt.Sprintf("unknown write mode '%s'", cw.Mode)}
+	}
+}
+
 func (w *RuntimeWorker) onRuntimeRegisterNotificationRequest(ctx context.Context, client web.Client, msg web.Message) {
 	req := new(protobufs.WebRuntimeRegisterNotificationRequest)
 	rsp := new(protobufs.WebRuntimeRegisterNotificationResponse)
@@ -166,11 +416,76 @@ func (w *RuntimeWorker) onRuntimeRegisterNotificationRequest(ctx context.Context
 		return
 	}
 
+	principal := principalOf(client)
+	authorize := w.readAuthorizer(ctx, principal, "WebRuntimeRegisterNotificationRequest")
+	paths := map[*protobufs.DatabaseNotificationConfig]string{}
 	for _, cfg := range req.Requests {
+		if isFieldPath(cfg.Field) {
+			if cfg.Id == "" {
+				writeGatewayError(client, msg, GatewayErrorMalformedRequest, "field path '%s' can only be registered on an entity id", cfg.Field)
+				return
+			}
+
+			id, field, err := resolveFieldPath(ctx, w.store, cfg.Id, cfg.Field, authorize)
+			if err == nil {
+				if authErr := authorize(id, field); authErr != nil {
+					err = &WebGatewayError{Code: GatewayErrorPermissionDenied, Message: authErr.Error()}
+				}
+			}
+
+			if err != nil {
+				log.Warn("Could not resolve field path '%s' of entity '%s' for client %s: %v", cfg.Field, cfg.Id, client.Id(), err)
+				writeGatewayError(client, msg, err.Code, "%s", err.Message)
+				return
+			}
+
+			// The path is resolved once, so notifications keep following the entity it resolved
+			// to even if the references along the path change afterwards
+			paths[cfg] = cfg.Field
+			cfg.Id = id
+			cfg.Type = ""
+			cfg.Field = field
+		}
+
+		// Registrations by entity type are checked as each notification is delivered
+		if cfg.Id == "" {
+			continue
+		}
+
+		for _, field := range cfg.ContextFields {
+			if err := w.authorizeRead(ctx, authorize, cfg.Id, field); err != nil {
+				log.Warn("Denied context field '%s' of entity '%s' for client %s: %v", field, cfg.Id, client.Id(), err)
+				writeGatewayError(client, msg, err.Code, "%s", err.Message)
+				return
+			}
+		}
+	}
+
+	for _, cfg := range req.Requests {
+		path := paths[cfg]
 		token := w.store.Notify(ctx, notification.FromConfigPb(cfg), notification.NewCallback(func(ctx context.Context, n data.Notification) {
-			if w.clientNotificationQueue[client.Id()][n.GetToken()] != nil {
-				w.clientNotificationQueue[client.Id()][n.GetToken()] = append(w.clientNotificationQueue[client.Id()][n.GetToken()], n)
+			if w.clientNotificationQueue[client.Id()] == nil || !w.clientNotificationQueue[client.Id()].IsRegistered(n.GetToken()) {
+				return
 			}
+
+			pb := w.permittedNotification(ctx, principal, notification.ToPb(n))
+			if pb == nil {
+				return
+			}
+
+			// Like responses to database requests, notifications of a field path name the entity it
+			// resolved to and the path as it was registered
+			if path != "" {
+				if pb.Current != nil {
+					pb.Current.Name = path
+				}
+
+				if pb.Previous != nil {
+					pb.Previous.Name = path
+				}
+			}
+
+			w.onNotification(client, pb)
 		}))
 
 		if w.clientNotificationTokens[client.Id()][token.Id()] != nil {
@@ -178,9 +493,7 @@ func (w *RuntimeWorker) onRuntimeRegisterNotificationRequest(ctx context.Context
 		}
 		w.clientNotificationTokens[client.Id()][token.Id()] = token
 
-		if w.clientNotificationQueue[client.Id()][token.Id()] == nil {
-			w.clientNotificationQueue[client.Id()][token.Id()] = make([]data.Notification, 0)
-		}
+		w.clientNotificationQueue[client.Id()].Register(token.Id())
 
 		log.Info("Registered notification token '%v' for client %s", token.Id(), client.Id())
 
@@ -196,6 +509,67 @@ func (w *RuntimeWorker) onRuntimeRegisterNotificationRequest(ctx context.Context
 	client.Write(msg)
 }
 
+// permittedNotification checks n against the policy again as it is delivered, because the
+// policy may scope rules by subtree or field while registrations by entity type are only
+// authorized by type. It returns nil if principal may not read the field n is about, and
+// removes the values of the context fields principal may not read.
+func (w *RuntimeWorker) permittedNotification(ctx context.Context, principal *Principal, n *protobufs.DatabaseNotification) *protobufs.DatabaseNotification {
+	authorize := w.readAuthorizer(ctx, principal, "WebRuntimeRegisterNotificationRequest")
+
+	if err := authorize(n.GetCurrent().GetId(), n.GetCurrent().GetName()); err != nil {
+		log.Warn("Dropped notification of field '%s' of entity '%s': %v", n.GetCurrent().GetName(), n.GetCurrent().GetId(), err)
+		return nil
+	}
+
+	for _, field := range n.Context {
+		if err := w.authorizeRead(ctx, authorize, field.Id, field.Name); err != nil {
+			field.Value = nil
+		}
+	}
+
+	return n
+}
+
+// authorizeRead authorizes reading field of entityId, following field if it is a field path
+func (w *RuntimeWorker) authorizeRead(ctx context.Context, authorize func(string, string) error, entityId string, field string) *WebGatewayError {
+	if isFieldPath(field) {
+		id, last, err := resolveFieldPath(ctx, w.store, entityId, field, authorize)
+		if err != nil {
+			return err
+		}
+
+		entityId, field = id, last
+	}
+
+	if err := authorize(entityId, field); err != nil {
+		return &WebGatewayError{Code: GatewayErrorPermissionDenied, Message: err.Error()}
+	}
+
+	return nil
+}
+
+// onNotification pushes n to the client's notification stream if one is open, and queues it
+// for polling otherwise.
+func (w *RuntimeWorker) onNotification(client web.Client, n *protobufs.DatabaseNotification) {
+	clientId := client.Id()
+	event := w.clientNotificationHistory[clientId].Add(n)
+
+	if stream := w.clientNotificationStreams[clientId]; stream != nil {
+		if stream.Send(event) {
+			return
+		}
+
+		log.Warn("Notification stream for client %s cannot keep up, closing it", clientId)
+		stream.Close()
+		delete(w.clientNotificationStreams, clientId)
+	}
+
+	if !w.clientNotificationQueue[clientId].Push(event.Notification) {
+		log.Warn("Notification queue of client %s overflowed, disconnecting it", clientId)
+		client.Close()
+	}
+}
+
 func (w *RuntimeWorker) onRuntimeUnregisterNotificationRequest(ctx context.Context, client web.Client, msg web.Message) {
 	req := new(protobufs.WebRuntimeUnregisterNotificationRequest)
 	rsp := new(protobufs.WebRuntimeUnregisterNotificationResponse)
@@ -223,8 +597,8 @@ func (w *RuntimeWorker) onRuntimeUnregisterNotificationRequest(ctx context.Conte
 			delete(w.clientNotificationTokens[client.Id()], token)
 		}
 
-		if w.clientNotificationQueue[client.Id()][token] != nil {
-			delete(w.clientNotificationQueue[client.Id()], token)
+		if w.clientNotificationQueue[client.Id()] != nil {
+			w.clientNotificationQueue[client.Id()].Unregister(token)
 		}
 
 		log.Info("Unregistered notification: %v for client %s", token, client.Id())
@@ -261,11 +635,8 @@ func (w *RuntimeWorker) onRuntimeGetNotificationsRequest(_ context.Context, clie
 		return
 	}
 
-	for tok, ntfs := range w.clientNotificationQueue[client.Id()] {
-		for _, n := range ntfs {
-			rsp.Notifications = append(rsp.Notifications, notification.ToPb(n))
-		}
-		w.clientNotificationQueue[client.Id()][tok] = make([]data.Notification, 0)
+	if w.clientNotificationQueue[client.Id()] != nil {
+		rsp.Notifications = w.clientNotificationQueue[client.Id()].Drain()
 	}
 
 	msg.Header.Timestamp = timestamppb.Now()
@@ -277,6 +648,39 @@ func (w *RuntimeWorker) onRuntimeGetNotificationsRequest(_ context.Context, clie
 	client.Write(msg)
 }
 
+func (w *RuntimeWorker) onGatewayGetNotificationsRequest(_ context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayGetNotificationsRequest)
+	rsp := &WebGatewayGetNotificationsResponse{
+		Notifications:  []json.RawMessage{},
+		DroppedByToken: map[string]uint64{},
+	}
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayGetNotificationsRequestType, err)
+		return
+	}
+
+	if queue := w.clientNotificationQueue[client.Id()]; queue != nil {
+		for _, n := range queue.Drain() {
+			b, err := protojson.Marshal(n)
+			if err != nil {
+				log.Error("Could not marshal notification: %v", err)
+				continue
+			}
+
+			rsp.Notifications = append(rsp.Notifications, b)
+		}
+
+		rsp.DroppedByToken = queue.DrainDropped()
+		for _, dropped := range rsp.DroppedByToken {
+			rsp.Dropped += dropped
+		}
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayGetNotificationsResponseType, rsp)
+}
+
 func (w *RuntimeWorker) onRuntimeGetDatabaseConnectionStatusRequest(_ context.Context, client web.Client, msg web.Message) {
 	req := new(protobufs.WebRuntimeGetDatabaseConnectionStatusRequest)
 	rsp := new(protobufs.WebRuntimeGetDatabaseConnectionStatusResponse)
@@ -348,6 +752,164 @@ func (w *RuntimeWorker) onRuntimeGetEntitiesRequest(ctx context.Context, client
 	client.Write(msg)
 }
 
+func (w *RuntimeWorker) onGatewayGetEntitiesRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayGetEntitiesRequest)
+	rsp := &WebGatewayGetEntitiesResponse{
+		Entities: []WebGatewayEntityResult{},
+	}
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayGetEntitiesRequestType, err)
+		return
+	}
+
+	if err := validateGetEntitiesRequest(req); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+		return
+	}
+
+	var after *entityPageToken
+	if req.PageToken != "" {
+		token, err := decodeEntityPageToken(req.PageToken)
+		if err != nil {
+			writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+			return
+		}
+
+		if token.OrderBy != req.OrderBy || token.Descending != req.Descending {
+			writeGatewayError(client, msg, GatewayErrorMalformedRequest, "page token was issued for a different order")
+			return
+		}
+
+		after = token
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = DefaultEntityPageSize
+	}
+
+	keyOf := func(row *entityRow) *scalar {
+		if req.OrderBy == "" {
+			return nil
+		}
+
+		return row.scalar(req.OrderBy)
+	}
+
+	// Only the orderBy field is read for every entity, so that the entities of earlier pages are
+	// skipped without reading their other fields. Without orderBy, they are skipped by id alone.
+	orderFields := []string{}
+	otherFields := []string{}
+	for _, field := range fieldsOfGetEntitiesRequest(req) {
+		if field == req.OrderBy {
+			orderFields = append(orderFields, field)
+		} else {
+			otherFields = append(otherFields, field)
+		}
+	}
+
+	principal := principalOf(client)
+	rows := []*entityRow{}
+	for _, entityId := range w.store.FindEntities(ctx, req.EntityType) {
+		if after != nil && req.OrderBy == "" && compareEntities(req.Descending, nil, entityId, nil, after.Id) <= 0 {
+			continue
+		}
+
+		row := w.readEntityRow(ctx, principal, entityId, orderFields)
+
+		if after != nil && req.OrderBy != "" && compareEntities(req.Descending, keyOf(row), row.id, after.Key, after.Id) <= 0 {
+			continue
+		}
+
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return compareEntities(req.Descending, keyOf(rows[i]), rows[i].id, keyOf(rows[j]), rows[j].id) < 0
+	})
+
+	// The other fields are read in order until the page is full and one more entity matches,
+	// which tells whether there is a next page
+	page := []*entityRow{}
+	more := false
+	for _, row := range rows {
+		w.readEntityFields(ctx, principal, row, otherFields)
+
+		ok, err := row.matches(req.Where)
+		if err != nil {
+			writeGatewayError(client, msg, GatewayErrorMalformedRequest, "%v", err)
+			return
+		}
+
+		if !ok {
+			continue
+		}
+
+		if len(page) == limit {
+			more = true
+			break
+		}
+
+		page = append(page, row)
+	}
+
+	for _, row := range page {
+		result := WebGatewayEntityResult{
+			Fields: []json.RawMessage{},
+		}
+
+		if ent := getEntityPb(ctx, w.store, row.id); ent != nil {
+			if b, err := protojson.Marshal(ent); err == nil {
+				result.Entity = b
+			}
+		}
+
+		for _, field := range req.Fields {
+			result.Fields = append(result.Fields, marshalDatabaseRequest(row.fields[field]))
+		}
+
+		rsp.Entities = append(rsp.Entities, result)
+	}
+
+	if more {
+		last := page[len(page)-1]
+		token := &entityPageToken{
+			OrderBy:    req.OrderBy,
+			Descending: req.Descending,
+			Key:        keyOf(last),
+			Id:         last.id,
+		}
+		rsp.NextPageToken = token.Encode()
+	}
+
+	writeGatewayResponse(client, msg, WebGatewayGetEntitiesResponseType, rsp)
+}
+
+// readEntityRow reads the fields of entityId that principal is permitted to read
+func (w *RuntimeWorker) readEntityRow(ctx context.Context, principal *Principal, entityId string, fields []string) *entityRow {
+	row := &entityRow{
+		id:     entityId,
+		fields: make(map[string]*protobufs.DatabaseRequest),
+	}
+
+	w.readEntityFields(ctx, principal, row, fields)
+	return row
+}
+
+// readEntityFields adds the fields of row's entity that principal is permitted to read
+func (w *RuntimeWorker) readEntityFields(ctx context.Context, principal *Principal, row *entityRow, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	access := newEntityAccess(ctx, w.store, WebGatewayGetEntitiesRequestType, OperationRead, row.id, "")
+	for field, r := range readPermittedFields(ctx, w.store, w.policy, principal, access, fields) {
+		row.fields[field] = r
+	}
+}
+
 func (w *RuntimeWorker) onRuntimeFieldExistsRequest(ctx context.Context, client web.Client, msg web.Message) {
 	req := new(protobufs.WebRuntimeFieldExistsRequest)
 	rsp := new(protobufs.WebRuntimeFieldExistsResponse)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func newTestValue(t *testing.T, m proto.Message) *anypb.Any {
+	t.Helper()
+
+	v, err := anypb.New(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestShouldWrite(t *testing.T) {
+	float := func(raw float64) *anypb.Any { return newTestValue(t, &protobufs.Float{Raw: raw}) }
+	integer := func(raw int64) *anypb.Any { return newTestValue(t, &protobufs.Int{Raw: raw}) }
+	str := func(raw string) *anypb.Any { return newTestValue(t, &protobufs.String{Raw: raw}) }
+
+	tests := []struct {
+		name    string
+		cw      WebGatewayConditionalWrite
+		stored  *anypb.Any
+		value   *anypb.Any
+		write   bool
+		errCode string
+	}{
+		{"always by default", WebGatewayConditionalWrite{}, float(1), float(1), true, ""},
+		{"always", WebGatewayConditionalWrite{Mode: WriteModeAlways}, float(1), float(1), true, ""},
+		{"on change with same value", WebGatewayConditionalWrite{Mode: WriteModeOnChange}, str("a"), str("a"), false, ""},
+		{"on change with new value", WebGatewayConditionalWrite{Mode: WriteModeOnChange}, str("a"), str("b"), true, ""},
+		{"on change with new type", WebGatewayConditionalWrite{Mode: WriteModeOnChange}, float(1), integer(1), true, ""},
+		{"on change with nothing stored", WebGatewayConditionalWrite{Mode: WriteModeOnChange}, nil, str("a"), true, ""},
+		{"deadband within", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 0.5}, float(10), float(10.5), false, ""},
+		{"deadband exceeded", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 0.5}, float(10), float(9.4), true, ""},
+		{"deadband of zero writes changes", WebGatewayConditionalWrite{Mode: WriteModeDeadband}, integer(3), integer(4), true, ""},
+		{"deadband of zero skips same value", WebGatewayConditionalWrite{Mode: WriteModeDeadband}, integer(3), integer(3), false, ""},
+		{"deadband across numeric types", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 1}, integer(3), float(3.5), false, ""},
+		{"deadband percent within", WebGatewayConditionalWrite{Mode: WriteModeDeadband, DeadbandPercent: 10}, float(-200), float(-181), false, ""},
+		{"deadband percent exceeded", WebGatewayConditionalWrite{Mode: WriteModeDeadband, DeadbandPercent: 10}, float(200), float(221), true, ""},
+		{"deadband with non numeric stored value", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 1}, str("a"), float(1), true, ""},
+		{"deadband with nothing stored", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 1}, nil, float(1), true, ""},
+		{"deadband requires numeric value", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 1}, float(1), str("a"), false, GatewayErrorMalformedRequest},
+		{"negative deadband", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: -1}, float(1), float(5), false, GatewayErrorMalformedRequest},
+		{"negative deadband percent", WebGatewayConditionalWrite{Mode: WriteModeDeadband, DeadbandPercent: -1}, float(1), float(5), false, GatewayErrorMalformedRequest},
+		{"both deadbands", WebGatewayConditionalWrite{Mode: WriteModeDeadband, Deadband: 1, DeadbandPercent: 10}, float(1), float(5), false, GatewayErrorMalformedRequest},
+		{"unknown mode", WebGatewayConditionalWrite{Mode: "sometimes"}, float(1), float(5), false, GatewayErrorMalformedRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write, err := shouldWrite(tt.cw, tt.stored, tt.value)
+
+			if tt.errCode != "" {
+				if err == nil || err.Code != tt.errCode {
+					t.Fatalf("expected a %s error, got %+v", tt.errCode, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			if write != tt.write {
+				t.Errorf("expected write to be %v", tt.write)
+			}
+		})
+	}
+}
+
+func TestGetEntitiesPaging(t *testing.T) {
+	tests := []struct {
+		name    string
+		orderBy string
+		pages   [][]string
+		reads   []int
+	}{
+		// Entities of earlier pages are skipped by id, and only the fields of the page and
+		// of the entity after it are read
+		{"by id", "", [][]string{{"pump"}, {"pump2"}, {"pump3"}}, []int{2, 2, 1}},
+		{"by field", "Speed", [][]string{{"pump2"}, {"pump"}, {"pump3"}}, []int{3, 3, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := newTestSnapshot(t)
+			ss.Entities = append(ss.Entities, newTestEntity("pump2", "Pump", "Pump2", "site2"), newTestEntity("pump3", "Pump", "Pump3", "site2"))
+			ss.Fields = append(ss.Fields, newTestField(t, "pump2", "Speed", 10), newTestField(t, "pump3", "Speed", 70))
+
+			store := newTestStore(ss)
+			w := NewRuntimeWorker(store, NewDefaultPolicy(), NewDefaultNotificationQueueConfig())
+
+			pageToken := ""
+			for i, expected := range tt.pages {
+				payload, err := newGatewayPayload(WebGatewayGetEntitiesRequestType, &WebGatewayGetEntitiesRequest{
+					EntityType: "Pump",
+					Fields:     []string{"Speed"},
+					OrderBy:    tt.orderBy,
+					Limit:      1,
+					PageToken:  pageToken,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				store.reads = nil
+				client := &testClient{}
+				w.OnNewClientMessage(context.Background(), client, &protobufs.WebMessage{Header: &protobufs.WebHeader{}, Payload: payload})
+				if len(client.responses) != 1 {
+					t.Fatalf("page %d: expected one response, got %d", i, len(client.responses))
+				}
+
+				rsp := new(WebGatewayGetEntitiesResponse)
+				if err := unmarshalGatewayPayload(client.responses[0].Payload, rsp); err != nil {
+					t.Fatal(err)
+				}
+
+				ids := []string{}
+				for _, result := range rsp.Entities {
+					ent := new(protobufs.DatabaseEntity)
+					if err := protojson.Unmarshal(result.Entity, ent); err != nil {
+						t.Fatal(err)
+					}
+					ids = append(ids, ent.Id)
+				}
+
+				if !slices.Equal(ids, expected) {
+					t.Errorf("page %d: expected %v, got %v", i, expected, ids)
+				}
+
+				if len(store.reads) != tt.reads[i] {
+					t.Errorf("page %d: expected %d reads, got %v", i, tt.reads[i], store.reads)
+				}
+
+				if last := i == len(tt.pages)-1; last != (rsp.NextPageToken == "") {
+					t.Fatalf("page %d: unexpected next page token '%s'", i, rsp.NextPageToken)
+				}
+				pageToken = rsp.NextPageToken
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rqure/qlib/pkg/data/snapshot"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func (w *ConfigWorker) onGatewayPreviewRestoreRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayPreviewRestoreRequest)
+	rsp := new(WebGatewayPreviewRestoreResponse)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayPreviewRestoreRequestType, err)
+		return
+	}
+
+	ss := new(protobufs.DatabaseSnapshot)
+	if err := protojson.Unmarshal(req.Snapshot, ss); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode snapshot: %v", err)
+		return
+	}
+
+	if req.Merge {
+		ss = reparentSnapshot(ss, req.ParentId)
+	}
+
+	// Fields the client may not read are left out on both sides, so that neither their values
+	// nor whether the restore changes them are revealed
+	current := snapshot.ToPb(w.store.CreateSnapshot(ctx))
+	hidden := unreadableFields(w.policy, principalOf(client), WebGatewayPreviewRestoreRequestType, current)
+
+	rsp.Diff = diffSnapshots(withoutFields(current, hidden), withoutFields(ss, hidden), req.Merge)
+	writeGatewayResponse(client, msg, WebGatewayPreviewRestoreResponseType, rsp)
+}
+
+func (w *ConfigWorker) onGatewayDiffSnapshotsRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayDiffSnapshotsRequest)
+	rsp := new(WebGatewayDiffSnapshotsResponse)
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayDiffSnapshotsRequestType, err)
+		return
+	}
+
+	from := new(protobufs.DatabaseSnapshot)
+	if err := protojson.Unmarshal(req.From, from); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode snapshot 'from': %v", err)
+		return
+	}
+
+	to := new(protobufs.DatabaseSnapshot)
+	if err := protojson.Unmarshal(req.To, to); err != nil {
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode snapshot 'to': %v", err)
+		return
+	}
+
+	rsp.Diff = diffSnapshots(from, to, false)
+	writeGatewayResponse(client, msg, WebGatewayDiffSnapshotsResponseType, rsp)
+}
+
+// snapshotIndex looks up the contents of a snapshot
+type snapshotIndex struct {
+	entities map[string]*protobufs.DatabaseEntity
+	fields   map[string]map[string]*protobufs.DatabaseField
+	schemas  map[string]*protobufs.DatabaseEntitySchema
+}
+
+func newSnapshotIndex(ss *protobufs.DatabaseSnapshot) *snapshotIndex {
+	idx := &snapshotIndex{
+		entities: map[string]*protobufs.DatabaseEntity{},
+		fields:   map[string]map[string]*protobufs.DatabaseField{},
+		schemas:  map[string]*protobufs.DatabaseEntitySchema{},
+	}
+
+	for _, ent := range ss.GetEntities() {
+		idx.entities[ent.Id] = ent
+	}
+
+	for _, field := range ss.GetFields() {
+		if idx.fields[field.Id] == nil {
+			idx.fields[field.Id] = map[string]*protobufs.DatabaseField{}
+		}
+		idx.fields[field.Id][field.Name] = field
+	}
+
+	for _, sch := range ss.GetEntitySchemas() {
+		idx.schemas[sch.Name] = sch
+	}
+
+	return idx
+}
+
+// path returns the names of entityId and its ancestors, separated by '/'. Ancestors that are
+// not part of the snapshot are looked up in fallback, if set.
+func (idx *snapshotIndex) path(entityId string, fallback *snapshotIndex) string {
+	names := []string{}
+
+	for id := entityId; id != "" && len(names) < MaxEntityDepth; {
+		ent := idx.entities[id]
+		if ent == nil && fallback != nil {
+			ent = fallback.entities[id]
+		}
+
+		if ent == nil {
+			break
+		}
+
+		names = append(names, ent.Name)
+		id = ent.GetParent().GetRaw()
+	}
+
+	slices.Reverse(names)
+	return strings.Join(names, "/")
+}
+
+// unreadableFields returns the fields of ss that principal may not read with payload, as
+// 'id.name'. Ancestors are taken from ss, so it should hold the whole database.
+func unreadableFields(policy *Policy, principal *Principal, payload string, ss *protobufs.DatabaseSnapshot) map[string]bool {
+	ancestors := snapshotAncestors(ss, nil)
+
+	types := map[string]string{}
+	for _, ent := range ss.Entities {
+		types[ent.Id] = ent.Type
+	}
+
+	unreadable := map[string]bool{}
+	for _, field := range ss.Fields {
+		access := &Access{
+			Payload:    payload,
+			Operation:  OperationRead,
+			EntityType: types[field.Id],
+			EntityId:   field.Id,
+			Field:      field.Name,
+			Ancestors:  ancestors[field.Id],
+		}
+
+		if policy.Authorize(principal, access) != nil {
+			unreadable[field.Id+"."+field.Name] = true
+		}
+	}
+
+	return unreadable
+}
+
+// withoutFields returns a copy of ss without the fields in fields, given as 'id.name'
+func withoutFields(ss *protobufs.DatabaseSnapshot, fields map[string]bool) *protobufs.DatabaseSnapshot {
+	if len(fields) == 0 {
+		return ss
+	}
+
+	copied := &protobufs.DatabaseSnapshot{Entities: ss.Entities, EntitySchemas: ss.EntitySchemas}
+	for _, field := range ss.Fields {
+		if !fields[field.Id+"."+field.Name] {
+			copied.Fields = append(copied.Fields, field)
+		}
+	}
+
+	return copied
+}
+
+// diffSnapshots describes the changes from one snapshot to another. If merge is set, to is
+// merged into from rather than replacing it, so nothing that is missing from to is removed and
+// the fields of existing schemas keep their type.
+func diffSnapshots(from *protobufs.DatabaseSnapshot, to *protobufs.DatabaseSnapshot, merge bool) *WebGatewaySnapshotDiff {
+	before := newSnapshotIndex(from)
+	after := newSnapshotIndex(to)
+
+	diff := &WebGatewaySnapshotDiff{
+		SchemasAdded:    []string{},
+		SchemasRemoved:  []string{},
+		SchemasChanged:  []WebGatewaySchemaChange{},
+		EntitiesAdded:   []WebGatewayEntityChange{},
+		EntitiesRemoved: []WebGatewayEntityChange{},
+		EntitiesMoved:   []WebGatewayEntityChange{},
+		EntitiesRenamed: []WebGatewayEntityChange{},
+		FieldsChanged:   []WebGatewayFieldChange{},
+		Summary:         []string{},
+	}
+
+	for _, name := range sortedKeys(after.schemas) {
+		previous := before.schemas[name]
+		sch := after.schemas[name]
+		if previous != nil && merge {
+			sch = mergeEntitySchemas(previous, sch)
+		}
+
+		if previous == nil {
+			diff.SchemasAdded = append(diff.SchemasAdded, name)
+		} else if change := diffSchemas(previous, sch); change != nil {
+			diff.SchemasChanged = append(diff.SchemasChanged, *change)
+		}
+	}
+
+	if !merge {
+		for _, name := range sortedKeys(before.schemas) {
+			if after.schemas[name] == nil {
+				diff.SchemasRemoved = append(diff.SchemasRemoved, name)
+			}
+		}
+	}
+
+	for id, ent := range after.entities {
+		path := after.path(id, before)
+
+		previous := before.entities[id]
+		if previous == nil {
+			diff.EntitiesAdded = append(diff.EntitiesAdded, WebGatewayEntityChange{Id: id, Type: ent.Type, Path: path})
+		} else {
+			change := WebGatewayEntityChange{Id: id, Type: ent.Type, Path: path, PreviousPath: before.path(id, nil)}
+			if previous.GetParent().GetRaw() != ent.GetParent().GetRaw() {
+				diff.EntitiesMoved = append(diff.EntitiesMoved, change)
+			}
+
+			if previous.Name != ent.Name {
+				diff.EntitiesRenamed = append(diff.EntitiesRenamed, change)
+			}
+		}
+
+		fields := sortedKeys(after.fields[id])
+		if !merge {
+			for name := range before.fields[id] {
+				if after.fields[id][name] == nil {
+					fields = append(fields, name)
+				}
+			}
+		}
+
+		// The fields of an added entity are all reported, with no previous value
+		diffFields(diff, before, after, id, path, fields)
+	}
+
+	if !merge {
+		for id, ent := range before.entities {
+			if after.entities[id] == nil {
+				// The fields of a removed entity are all reported, with no new value
+				path := before.path(id, nil)
+				diff.EntitiesRemoved = append(diff.EntitiesRemoved, WebGatewayEntityChange{Id: id, Type: ent.Type, Path: path})
+				diffFields(diff, before, after, id, path, sortedKeys(before.fields[id]))
+			}
+		}
+	}
+
+	for _, changes := range [][]WebGatewayEntityChange{diff.EntitiesAdded, diff.EntitiesRemoved, diff.EntitiesMoved, diff.EntitiesRenamed} {
+		slices.SortFunc(changes, func(a WebGatewayEntityChange, b WebGatewayEntityChange) int {
+			return strings.Compare(a.Path+"\x00"+a.Id, b.Path+"\x00"+b.Id)
+		})
+	}
+
+	slices.SortFunc(diff.FieldsChanged, func(a WebGatewayFieldChange, b WebGatewayFieldChange) int {
+		return strings.Compare(a.Path+"\x00"+a.Id+"\x00"+a.Field, b.Path+"\x00"+b.Id+"\x00"+b.Field)
+	})
+
+	diff.Summary = summarizeDiff(diff, before, after)
+	return diff
+}
+
+// diffFields adds the fields of entityId whose value differs between before and after to diff
+func diffFields(diff *WebGatewaySnapshotDiff, before *snapshotIndex, after *snapshotIndex, entityId string, path string, fields []string) {
+	for _, name := range fields {
+		previousValue := before.fields[entityId][name].GetValue()
+		value := after.fields[entityId][name].GetValue()
+		if !valuesEqual(previousValue, value) {
+			diff.FieldsChanged = append(diff.FieldsChanged, WebGatewayFieldChange{
+				Id:       entityId,
+				Path:     path,
+				Field:    name,
+				Previous: marshalValue(previousValue),
+				Value:    marshalValue(value),
+			})
+		}
+	}
+}
+
+// diffSchemas describes how the fields of an entity type changed, or returns nil if they did not
+func diffSchemas(from *protobufs.DatabaseEntitySchema, to *protobufs.DatabaseEntitySchema) *WebGatewaySchemaChange {
+	change := &WebGatewaySchemaChange{
+		Type:          to.Name,
+		FieldsAdded:   []string{},
+		FieldsRemoved: []string{},
+		FieldsChanged: []string{},
+	}
+
+	previous := map[string]string{}
+	for _, f := range from.Fields {
+		previous[f.Name] = f.Type
+	}
+
+	current := map[string]string{}
+	for _, f := range to.Fields {
+		current[f.Name] = f.Type
+
+		if previousType, ok := previous[f.Name]; !ok {
+			change.FieldsAdded = append(change.FieldsAdded, f.Name)
+		} else if previousType != f.Type {
+			change.FieldsChanged = append(change.FieldsChanged, f.Name)
+		}
+	}
+
+	for _, f := range from.Fields {
+		if _, ok := current[f.Name]; !ok {
+			change.FieldsRemoved = append(change.FieldsRemoved, f.Name)
+		}
+	}
+
+	if len(change.FieldsAdded)+len(change.FieldsRemoved)+len(change.FieldsChanged) == 0 {
+		return nil
+	}
+
+	return change
+}
+
+// summarizeDiff describes each change of diff on a line, prefixed with '+' for additions, '-'
+// for removals, '>' for moves and '~' for other changes
+func summarizeDiff(diff *WebGatewaySnapshotDiff, before *snapshotIndex, after *snapshotIndex) []string {
+	lines := []string{}
+
+	for _, name := range diff.SchemasAdded {
+		lines = append(lines, fmt.Sprintf("+ schema %s", name))
+	}
+
+	for _, name := range diff.SchemasRemoved {
+		lines = append(lines, fmt.Sprintf("- schema %s", name))
+	}
+
+	for _, change := range diff.SchemasChanged {
+		fieldType := func(sch *protobufs.DatabaseEntitySchema, name string) string {
+			for _, f := range sch.Fields {
+				if f.Name == name {
+					return f.Type
+				}
+			}
+			return ""
+		}
+
+		details := []string{}
+		for _, name := range change.FieldsAdded {
+			details = append(details, fmt.Sprintf("+ field %s (%s)", name, fieldType(after.schemas[change.Type], name)))
+		}
+
+		for _, name := range change.FieldsRemoved {
+			details = append(details, fmt.Sprintf("- field %s", name))
+		}
+
+		for _, name := range change.FieldsChanged {
+			details = append(details, fmt.Sprintf("~ field %s (%s -> %s)", name, fieldType(before.schemas[change.Type], name), fieldType(after.schemas[change.Type], name)))
+		}
+
+		lines = append(lines, fmt.Sprintf("~ schema %s: %s", change.Type, strings.Join(details, ", ")))
+	}
+
+	for _, change := range diff.EntitiesAdded {
+		lines = append(lines, fmt.Sprintf("+ entity %s (%s)", change.Path, change.Type))
+	}
+
+	for _, change := range diff.EntitiesRemoved {
+		lines = append(lines, fmt.Sprintf("- entity %s (%s)", change.Path, change.Type))
+	}
+
+	for _, change := range diff.EntitiesMoved {
+		lines = append(lines, fmt.Sprintf("> entity %s moved to %s", change.PreviousPath, change.Path))
+	}
+
+	for _, change := range diff.EntitiesRenamed {
+		lines = append(lines, fmt.Sprintf("~ entity %s renamed to %s", change.PreviousPath, after.entities[change.Id].GetName()))
+	}
+
+	for _, change := range diff.FieldsChanged {
+		lines = append(lines, fmt.Sprintf("~ field %s.%s: %s -> %s", change.Path, change.Field,
+			displayValue(before.fields[change.Id][change.Field].GetValue()),
+			displayValue(after.fields[change.Id][change.Field].GetValue())))
+	}
+
+	return lines
+}
+
+func marshalValue(v *anypb.Any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	b, err := protojson.Marshal(v)
+	if err != nil {
+		log.Error("Could not marshal value: %v", err)
+		return nil
+	}
+
+	return b
+}
+
+// displayValue formats a field value for people to read
+func displayValue(v *anypb.Any) string {
+	if v == nil {
+		return "(none)"
+	}
+
+	if s, ok := scalarValue(v); ok {
+		switch s.Kind {
+		case ScalarNumber:
+			return strconv.FormatFloat(s.Number, 'g', -1, 64)
+		case ScalarString:
+			return strconv.Quote(s.String)
+		case ScalarBool:
+			return strconv.FormatBool(s.Bool)
+		case ScalarTime:
+			return s.Time.Format(time.RFC3339Nano)
+		}
+	}
+
+	b, err := protojson.Marshal(v)
+	if err != nil {
+		return v.TypeUrl
+	}
+
+	return string(b)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+	return keys
+}
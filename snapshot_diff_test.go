@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func newTestEntity(id string, entityType string, name string, parentId string, children ...string) *protobufs.DatabaseEntity {
+	ent := &protobufs.DatabaseEntity{Id: id, Type: entityType, Name: name}
+	if parentId != "" {
+		ent.Parent = &protobufs.EntityReference{Raw: parentId}
+	}
+
+	for _, child := range children {
+		ent.Children = append(ent.Children, &protobufs.EntityReference{Raw: child})
+	}
+
+	return ent
+}
+
+func newTestField(t *testing.T, entityId string, name string, raw int64) *protobufs.DatabaseField {
+	value, err := anypb.New(&protobufs.Int{Raw: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &protobufs.DatabaseField{Id: entityId, Name: name, Value: value}
+}
+
+func newTestSnapshot(t *testing.T) *protobufs.DatabaseSnapshot {
+	return &protobufs.DatabaseSnapshot{
+		Entities: []*protobufs.DatabaseEntity{
+			newTestEntity("root", "Root", "Root", "", "site1", "site2"),
+			newTestEntity("site1", "Site", "Site1", "root", "pump"),
+			newTestEntity("site2", "Site", "Site2", "root"),
+			newTestEntity("pump", "Pump", "Pump", "site1"),
+		},
+		Fields: []*protobufs.DatabaseField{
+			newTestField(t, "pump", "Speed", 40),
+		},
+		EntitySchemas: []*protobufs.DatabaseEntitySchema{
+			newTestSchema("Pump", "Speed", "qdb.Int"),
+			newTestSchema("Site"),
+		},
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	entityOf := func(ss *protobufs.DatabaseSnapshot, id string) *protobufs.DatabaseEntity {
+		for _, ent := range ss.Entities {
+			if ent.Id == id {
+				return ent
+			}
+		}
+
+		t.Fatalf("no entity '%s'", id)
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		change   func(ss *protobufs.DatabaseSnapshot)
+		merge    bool
+		expected []string
+	}{
+		{
+			"unchanged",
+			func(ss *protobufs.DatabaseSnapshot) {},
+			false,
+			[]string{},
+		},
+		{
+			"schema added",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.EntitySchemas = append(ss.EntitySchemas, newTestSchema("Valve", "Open", "qdb.Bool"))
+			},
+			false,
+			[]string{"+ schema Valve"},
+		},
+		{
+			"schema removed",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.EntitySchemas = ss.EntitySchemas[:1]
+			},
+			false,
+			[]string{"- schema Site"},
+		},
+		{
+			"schema removals are not reported when merging",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.EntitySchemas = ss.EntitySchemas[:1]
+			},
+			true,
+			[]string{},
+		},
+		{
+			"schema fields changed",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.EntitySchemas[0] = newTestSchema("Pump", "Speed", "qdb.Float", "Running", "qdb.Bool")
+			},
+			false,
+			[]string{"~ schema Pump: + field Running (qdb.Bool), ~ field Speed (qdb.Int -> qdb.Float)"},
+		},
+		{
+			"schema field removals and type changes are not reported when merging",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.EntitySchemas[0] = newTestSchema("Pump", "Running", "qdb.Bool")
+				ss.EntitySchemas[1] = newTestSchema("Site", "Speed", "qdb.Float")
+			},
+			true,
+			[]string{"~ schema Pump: + field Running (qdb.Bool)", "~ schema Site: + field Speed (qdb.Float)"},
+		},
+		{
+			"schema field types are kept when merging",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.EntitySchemas[0] = newTestSchema("Pump", "Speed", "qdb.Float")
+			},
+			true,
+			[]string{},
+		},
+		{
+			"entity added with its fields",
+			func(ss *protobufs.DatabaseSnapshot) {
+				entityOf(ss, "site2").Children = append(entityOf(ss, "site2").Children, &protobufs.EntityReference{Raw: "pump2"})
+				ss.Entities = append(ss.Entities, newTestEntity("pump2", "Pump", "Pump2", "site2"))
+				ss.Fields = append(ss.Fields, newTestField(t, "pump2", "Speed", 10))
+			},
+			false,
+			[]string{"+ entity Root/Site2/Pump2 (Pump)", "~ field Root/Site2/Pump2.Speed: (none) -> 10"},
+		},
+		{
+			"entity removed with its fields",
+			func(ss *protobufs.DatabaseSnapshot) {
+				entityOf(ss, "site1").Children = nil
+				ss.Entities = ss.Entities[:3]
+				ss.Fields = nil
+			},
+			false,
+			[]string{"- entity Root/Site1/Pump (Pump)", "~ field Root/Site1/Pump.Speed: 40 -> (none)"},
+		},
+		{
+			"entity removals are not reported when merging",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.Entities = ss.Entities[:3]
+				ss.Fields = nil
+			},
+			true,
+			[]string{},
+		},
+		{
+			"entity moved",
+			func(ss *protobufs.DatabaseSnapshot) {
+				entityOf(ss, "site1").Children = nil
+				entityOf(ss, "site2").Children = []*protobufs.EntityReference{{Raw: "pump"}}
+				entityOf(ss, "pump").Parent = &protobufs.EntityReference{Raw: "site2"}
+			},
+			false,
+			[]string{"> entity Root/Site1/Pump moved to Root/Site2/Pump"},
+		},
+		{
+			"entity renamed",
+			func(ss *protobufs.DatabaseSnapshot) {
+				entityOf(ss, "pump").Name = "Pump1"
+			},
+			false,
+			[]string{"~ entity Root/Site1/Pump renamed to Pump1"},
+		},
+		{
+			"field changed",
+			func(ss *protobufs.DatabaseSnapshot) {
+				ss.Fields[0] = newTestField(t, "pump", "Speed", 55)
+			},
+			false,
+			[]string{"~ field Root/Site1/Pump.Speed: 40 -> 55"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := newTestSnapshot(t)
+			to := proto.Clone(from).(*protobufs.DatabaseSnapshot)
+			tt.change(to)
+
+			diff := diffSnapshots(from, to, tt.merge)
+			if !slices.Equal(diff.Summary, tt.expected) {
+				t.Errorf("expected summary %q, got %q", tt.expected, diff.Summary)
+			}
+		})
+	}
+}
+
+func TestDiffSnapshotsFieldValues(t *testing.T) {
+	from := newTestSnapshot(t)
+	to := &protobufs.DatabaseSnapshot{
+		Entities: []*protobufs.DatabaseEntity{
+			newTestEntity("root", "Root", "Root", "", "site1", "site2"),
+			newTestEntity("site1", "Site", "Site1", "root"),
+			newTestEntity("site2", "Site", "Site2", "root", "pump2"),
+			newTestEntity("pump2", "Pump", "Pump2", "site2"),
+		},
+		Fields: []*protobufs.DatabaseField{
+			newTestField(t, "pump2", "Speed", 10),
+		},
+		EntitySchemas: from.EntitySchemas,
+	}
+
+	diff := diffSnapshots(from, to, false)
+	if len(diff.FieldsChanged) != 2 {
+		t.Fatalf("expected the fields of the added and removed entities, got %+v", diff.FieldsChanged)
+	}
+
+	for _, change := range diff.FieldsChanged {
+		switch change.Id {
+		case "pump":
+			if change.Previous == nil || change.Value != nil {
+				t.Errorf("expected the removed entity's field to have only a previous value, got %+v", change)
+			}
+		case "pump2":
+			if change.Previous != nil || change.Value == nil {
+				t.Errorf("expected the added entity's field to have only a new value, got %+v", change)
+			}
+		default:
+			t.Errorf("unexpected change %+v", change)
+		}
+	}
+}
+
+func TestPreviewRestoreUnreadableFields(t *testing.T) {
+	ctx := context.Background()
+	policy := &Policy{
+		Principals: map[string][]string{"carol": {RoleEngineer}},
+		Rules: []PolicyRule{
+			{Effect: PolicyEffectDeny, Roles: []string{RoleEngineer}, Fields: []string{"Speed"}, Subtrees: []string{"site1"}},
+		},
+	}
+
+	w := NewConfigWorker(newTestStore(newTestSnapshot(t)), policy)
+	w.OnStoreConnected(ctx)
+
+	// The pump in site1 changes speed and a new pump in site2 is added with a speed of its own
+	ss := newTestSnapshot(t)
+	ss.Fields[0] = newTestField(t, "pump", "Speed", 55)
+	ss.Entities[2].Children = append(ss.Entities[2].Children, &protobufs.EntityReference{Raw: "pump2"})
+	ss.Entities = append(ss.Entities, newTestEntity("pump2", "Pump", "Pump2", "site2"))
+	ss.Fields = append(ss.Fields, newTestField(t, "pump2", "Speed", 10))
+
+	b, err := protojson.Marshal(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := newGatewayPayload(WebGatewayPreviewRestoreRequestType, &WebGatewayPreviewRestoreRequest{Snapshot: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testClient{principal: &Principal{Name: "carol"}}
+	w.OnNewClientMessage(ctx, client, &protobufs.WebMessage{Header: &protobufs.WebHeader{}, Payload: payload})
+	if len(client.responses) != 1 {
+		t.Fatalf("expected one response, got %d", len(client.responses))
+	}
+
+	rsp := new(WebGatewayPreviewRestoreResponse)
+	if err := unmarshalGatewayPayload(client.responses[0].Payload, rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"+ entity Root/Site2/Pump2 (Pump)", "~ field Root/Site2/Pump2.Speed: (none) -> 10"}
+	if !slices.Equal(rsp.Diff.Summary, expected) {
+		t.Errorf("expected summary %q, got %q", expected, rsp.Diff.Summary)
+	}
+}
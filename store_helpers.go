@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/entity"
+	"github.com/rqure/qlib/pkg/data/query"
+	"github.com/rqure/qlib/pkg/data/request"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// MaxEntityDepth bounds walks up the entity tree so a corrupted parent chain cannot loop forever
+const MaxEntityDepth = 256
+
+// triggerSchemaUpdate notifies services that the entity types or schemas have changed
+func triggerSchemaUpdate(ctx context.Context, store data.Store) {
+	roots := query.New(store).
+		Select().
+		From("Root").
+		Execute(ctx)
+
+	for _, root := range roots {
+		root.GetField("SchemaUpdateTrigger").WriteInt(ctx)
+	}
+}
+
+func getEntityPb(ctx context.Context, store data.Store, entityId string) *protobufs.DatabaseEntity {
+	if entityId == "" {
+		return nil
+	}
+
+	ent := store.GetEntity(ctx, entityId)
+	if ent == nil {
+		return nil
+	}
+
+	return entity.ToEntityPb(ent)
+}
+
+// ancestorsOf returns entityId followed by the ids of its parents up to the root
+func ancestorsOf(ctx context.Context, store data.Store, entityId string) []string {
+	ancestors := []string{}
+
+	for id := entityId; id != "" && len(ancestors) < MaxEntityDepth; {
+		ent := getEntityPb(ctx, store, id)
+		if ent == nil {
+			break
+		}
+
+		ancestors = append(ancestors, id)
+		id = ent.GetParent().GetRaw()
+	}
+
+	return ancestors
+}
+
+// newEntityAccess describes an access to field on entityId, including the entity's type and
+// ancestors so that the policy can scope rules by entity type and subtree.
+func newEntityAccess(ctx context.Context, store data.Store, payload string, operation string, entityId string, field string) *Access {
+	access := &Access{
+		Payload:   payload,
+		Operation: operation,
+		EntityId:  entityId,
+		Field:     field,
+	}
+
+	if ent := getEntityPb(ctx, store, entityId); ent != nil {
+		access.EntityType = ent.Type
+		access.Ancestors = ancestorsOf(ctx, store, entityId)
+	}
+
+	return access
+}
+
+// denyDatabaseRequest marks r as failed and replaces its value with a WebGatewayError
+// describing why it was denied.
+func denyDatabaseRequest(r *protobufs.DatabaseRequest, reason error) {
+	rejectDatabaseRequest(r, &WebGatewayError{
+		Code:    GatewayErrorPermissionDenied,
+		Message: reason.Error(),
+	})
+}
+
+// rejectDatabaseRequest marks r as failed and replaces its value with reason
+func rejectDatabaseRequest(r *protobufs.DatabaseRequest, reason *WebGatewayError) {
+	r.Success = false
+	r.Value = nil
+
+	payload, err := newGatewayPayload(WebGatewayErrorType, reason)
+	if err != nil {
+		log.Error("Could not marshal rejection reason: %v", err)
+		return
+	}
+
+	r.Value = payload
+}
+
+// readPermittedFields reads the fields of the entity described by access that principal is
+// permitted to read. Denied fields are not read, and hold the reason they were denied instead.
+func readPermittedFields(ctx context.Context, store data.Store, policy *Policy, principal *Principal, access *Access, fields []string) map[string]*protobufs.DatabaseRequest {
+	results := make(map[string]*protobufs.DatabaseRequest)
+
+	reqs := []data.Request{}
+	for _, field := range fields {
+		r := &protobufs.DatabaseRequest{Id: access.EntityId, Field: field}
+		results[field] = r
+
+		fieldAccess := *access
+		fieldAccess.Field = field
+		if err := policy.Authorize(principal, &fieldAccess); err != nil {
+			denyDatabaseRequest(r, err)
+			continue
+		}
+
+		reqs = append(reqs, request.FromPb(r))
+	}
+
+	store.Read(ctx, reqs...)
+	return results
+}
+
+func marshalDatabaseRequest(r *protobufs.DatabaseRequest) json.RawMessage {
+	b, err := protojson.Marshal(r)
+	if err != nil {
+		log.Error("Could not marshal database request: %v", err)
+		return nil
+	}
+
+	return b
+}
+
+func marshalEntity(ent *protobufs.DatabaseEntity) json.RawMessage {
+	b, err := protojson.Marshal(ent)
+	if err != nil {
+		log.Error("Could not marshal entity: %v", err)
+		return nil
+	}
+
+	return b
+}
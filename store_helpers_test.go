@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/entity"
+	"github.com/rqure/qlib/pkg/data/snapshot"
+	"github.com/rqure/qlib/pkg/protobufs"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// testStore is an in-memory data.Store holding the entities, schemas and fields of a snapshot.
+// Calls that change the store are recorded in calls, and the fields read in reads. Methods
+// it does not implement panic through the nil embedded Store.
+type testStore struct {
+	data.Store
+
+	entities map[string]*protobufs.DatabaseEntity
+	schemas  map[string]*protobufs.DatabaseEntitySchema
+	fields   map[string]*anypb.Any
+	created  int
+	calls    []string
+	reads    []string
+
+	// failSetEntity drops SetEntity calls for these entities, and failWrite writes to these
+	// fields, like writes that did not reach the store
+	failSetEntity map[string]bool
+	failWrite     map[string]bool
+}
+
+func newTestStore(ss *protobufs.DatabaseSnapshot) *testStore {
+	s := &testStore{
+		entities: make(map[string]*protobufs.DatabaseEntity),
+		schemas:  make(map[string]*protobufs.DatabaseEntitySchema),
+		fields:   make(map[string]*anypb.Any),
+	}
+
+	for _, ent := range ss.Entities {
+		s.entities[ent.Id] = proto.Clone(ent).(*protobufs.DatabaseEntity)
+	}
+
+	for _, sch := range ss.EntitySchemas {
+		s.schemas[sch.Name] = proto.Clone(sch).(*protobufs.DatabaseEntitySchema)
+	}
+
+	for _, f := range ss.Fields {
+		s.fields[f.Id+"."+f.Name] = f.Value
+	}
+
+	return s
+}
+
+// requestPb returns the DatabaseRequest that request.FromPb wrapped in r, which a real store
+// reads into and writes from
+func requestPb(r data.Request) *protobufs.DatabaseRequest {
+	pbType := reflect.TypeOf(&protobufs.DatabaseRequest{})
+
+	v := reflect.Indirect(reflect.ValueOf(r))
+	if v.Kind() == reflect.Struct {
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).Type() == pbType {
+				return (*protobufs.DatabaseRequest)(v.Field(i).UnsafePointer())
+			}
+		}
+	}
+
+	panic(fmt.Sprintf("%T does not wrap a DatabaseRequest", r))
+}
+
+func (s *testStore) CreateSnapshot(ctx context.Context) data.Snapshot {
+	ss := &protobufs.DatabaseSnapshot{}
+
+	for _, id := range sortedKeys(s.entities) {
+		ss.Entities = append(ss.Entities, proto.Clone(s.entities[id]).(*protobufs.DatabaseEntity))
+	}
+
+	for _, key := range sortedKeys(s.fields) {
+		id, name, _ := strings.Cut(key, ".")
+		ss.Fields = append(ss.Fields, &protobufs.DatabaseField{Id: id, Name: name, Value: s.fields[key]})
+	}
+
+	for _, name := range sortedKeys(s.schemas) {
+		ss.EntitySchemas = append(ss.EntitySchemas, proto.Clone(s.schemas[name]).(*protobufs.DatabaseEntitySchema))
+	}
+
+	return snapshot.FromPb(ss)
+}
+
+func (s *testStore) GetEntity(ctx context.Context, entityId string) data.Entity {
+	ent, ok := s.entities[entityId]
+	if !ok {
+		return nil
+	}
+
+	return entity.FromEntityPb(proto.Clone(ent).(*protobufs.DatabaseEntity))
+}
+
+func (s *testStore) SetEntity(ctx context.Context, value data.Entity) {
+	ent := proto.Clone(entity.ToEntityPb(value)).(*protobufs.DatabaseEntity)
+	s.calls = append(s.calls, "SetEntity "+ent.Id)
+
+	if !s.failSetEntity[ent.Id] {
+		s.entities[ent.Id] = ent
+	}
+}
+
+func (s *testStore) CreateEntity(ctx context.Context, entityType, parentId, name string) string {
+	s.created++
+	id := fmt.Sprintf("new%d", s.created)
+
+	ent := &protobufs.DatabaseEntity{Id: id, Type: entityType, Name: name}
+	if parent, ok := s.entities[parentId]; ok {
+		ent.Parent = &protobufs.EntityReference{Raw: parentId}
+		parent.Children = append(parent.Children, &protobufs.EntityReference{Raw: id})
+	}
+
+	s.entities[id] = ent
+	s.calls = append(s.calls, "CreateEntity "+id)
+
+	return id
+}
+
+func (s *testStore) DeleteEntity(ctx context.Context, entityId string) {
+	ent, ok := s.entities[entityId]
+	if !ok {
+		return
+	}
+
+	for _, child := range ent.Children {
+		s.DeleteEntity(ctx, child.GetRaw())
+	}
+
+	if parent, ok := s.entities[ent.GetParent().GetRaw()]; ok {
+		parent.Children = slices.DeleteFunc(parent.Children, func(child *protobufs.EntityReference) bool {
+			return child.GetRaw() == entityId
+		})
+	}
+
+	for key := range s.fields {
+		if strings.HasPrefix(key, entityId+".") {
+			delete(s.fields, key)
+		}
+	}
+
+	delete(s.entities, entityId)
+	s.calls = append(s.calls, "DeleteEntity "+entityId)
+}
+
+func (s *testStore) EntityExists(ctx context.Context, entityId string) bool {
+	_, ok := s.entities[entityId]
+	return ok
+}
+
+func (s *testStore) FindEntities(ctx context.Context, entityType string) []string {
+	ids := []string{}
+	for id, ent := range s.entities {
+		if ent.Type == entityType {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	return ids
+}
+
+func (s *testStore) GetEntityTypes(ctx context.Context) []string {
+	types := []string{}
+	for name := range s.schemas {
+		types = append(types, name)
+	}
+	slices.Sort(types)
+
+	return types
+}
+
+func (s *testStore) GetEntitySchema(ctx context.Context, entityType string) data.EntitySchema {
+	sch, ok := s.schemas[entityType]
+	if !ok {
+		return nil
+	}
+
+	return entity.FromSchemaPb(proto.Clone(sch).(*protobufs.DatabaseEntitySchema))
+}
+
+func (s *testStore) SetEntitySchema(ctx context.Context, value data.EntitySchema) {
+	sch := proto.Clone(entity.ToSchemaPb(value)).(*protobufs.DatabaseEntitySchema)
+	s.schemas[sch.Name] = sch
+	s.calls = append(s.calls, "SetEntitySchema "+sch.Name)
+}
+
+func (s *testStore) Read(ctx context.Context, reqs ...data.Request) {
+	for _, req := range reqs {
+		r := requestPb(req)
+		r.Value, r.Success = s.fields[r.Id+"."+r.Field]
+		s.reads = append(s.reads, r.Id+"."+r.Field)
+	}
+}
+
+func (s *testStore) Write(ctx context.Context, reqs ...data.Request) {
+	for _, req := range reqs {
+		r := requestPb(req)
+		s.calls = append(s.calls, "Write "+r.Id+"."+r.Field)
+
+		if s.failWrite[r.Field] {
+			r.Success = false
+			continue
+		}
+
+		s.fields[r.Id+"."+r.Field] = r.Value
+		r.Success = true
+	}
+}
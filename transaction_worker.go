@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/rqure/qlib/pkg/app"
+	"github.com/rqure/qlib/pkg/data"
+	"github.com/rqure/qlib/pkg/data/entity"
+	"github.com/rqure/qlib/pkg/data/request"
+	"github.com/rqure/qlib/pkg/log"
+	"github.com/rqure/qlib/pkg/protobufs"
+	"github.com/rqure/qlib/pkg/signalslots"
+	"github.com/rqure/qlib/pkg/signalslots/signal"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// operationReference matches the strings of an operation that refer to the entity created
+// by an earlier operation of the transaction
+var operationReference = regexp.MustCompile(`^\$(\d+)$`)
+
+// transactionOperations lists the requests that can be part of a transaction. Every other
+// request either cannot be undone (e.g. deleting an entity) or has effects beyond the store.
+var transactionOperations = []proto.Message{
+	&protobufs.WebConfigCreateEntityRequest{},
+	&protobufs.WebConfigSetEntitySchemaRequest{},
+	&protobufs.WebConfigSetFieldSchemaRequest{},
+	&protobufs.WebRuntimeDatabaseRequest{},
+	&protobufs.WebConfigGetEntityRequest{},
+	&protobufs.WebConfigGetEntitySchemaRequest{},
+	&protobufs.WebConfigGetFieldSchemaRequest{},
+	&protobufs.WebRuntimeGetEntitiesRequest{},
+	&protobufs.WebRuntimeFieldExistsRequest{},
+	&protobufs.WebRuntimeEntityExistsRequest{},
+}
+
+// TransactionWorker applies the operations of a WebGatewayTransactionRequest in order. Each
+// operation is dispatched through Dispatched, so it is authorized and handled exactly as if
+// the client had sent it on its own. If an operation fails, the operations applied before it
+// are compensated in reverse order so that the store ends where it started.
+type TransactionWorker struct {
+	Dispatched signalslots.Signal
+
+	store            data.Store
+	isStoreConnected bool
+	policy           *Policy
+	authorization    *AuthorizationWorker
+}
+
+func NewTransactionWorker(store data.Store, policy *Policy, authorization *AuthorizationWorker) *TransactionWorker {
+	return &TransactionWorker{
+		Dispatched:       signal.New(),
+		store:            store,
+		isStoreConnected: false,
+		policy:           policy,
+		authorization:    authorization,
+	}
+}
+
+func (w *TransactionWorker) Init(context.Context, app.Handle) {
+
+}
+
+func (w *TransactionWorker) Deinit(context.Context) {
+
+}
+
+func (w *TransactionWorker) DoWork(context.Context) {
+
+}
+
+func (w *TransactionWorker) OnStoreConnected(context.Context) {
+	w.isStoreConnected = true
+}
+
+func (w *TransactionWorker) OnStoreDisconnected() {
+	w.isStoreConnected = false
+}
+
+func (w *TransactionWorker) OnNewClientMessage(ctx context.Context, args ...interface{}) {
+	client := args[0].(web.Client)
+	msg := args[1].(web.Message)
+
+	if gatewayMessageType(msg.Payload) == WebGatewayTransactionRequestType {
+		w.onGatewayTransactionRequest(ctx, client, msg)
+	}
+}
+
+// transaction records how to undo the operations applied so far
+type transaction struct {
+	created       map[int]string
+	undo          []func()
+	schemaChanged bool
+}
+
+func (w *TransactionWorker) onGatewayTransactionRequest(ctx context.Context, client web.Client, msg web.Message) {
+	req := new(WebGatewayTransactionRequest)
+	rsp := &WebGatewayTransactionResponse{
+		Responses:       []json.RawMessage{},
+		FailedOperation: -1,
+	}
+
+	if err := unmarshalGatewayPayload(msg.Payload, req); err != nil {
+		log.Error("Could not unmarshal request: %v", err)
+		writeGatewayError(client, msg, GatewayErrorMalformedRequest, "could not decode %s: %v", WebGatewayTransactionRequestType, err)
+		return
+	}
+
+	if !w.isStoreConnected {
+		log.Error("Could not handle transaction. Database is not connected.")
+		writeGatewayError(client, msg, GatewayErrorStoreDisconnected, "database is not connected")
+		return
+	}
+
+	if i, err := w.validate(ctx, principalOf(client), req.Operations); err != nil {
+		log.Warn("Rejected transaction from client %s: operation %d: %s", client.Id(), i, err.Message)
+		rsp.FailedOperation = i
+		rsp.Error = err
+		writeGatewayResponse(client, msg, WebGatewayTransactionResponseType, rsp)
+		return
+	}
+
+	tx := &transaction{
+		created: make(map[int]string),
+	}
+
+	for i, raw := range req.Operations {
+		response, err := w.applyOperation(ctx, client, msg, tx, i, raw)
+		if response != nil {
+			if b, err := protojson.Marshal(response); err == nil {
+				rsp.Responses = append(rsp.Responses, b)
+			}
+		}
+
+		if err != nil {
+			log.Warn("Rolling back transaction from client %s: operation %d failed: %v", client.Id(), i, err)
+			w.rollback(ctx, tx)
+
+			rsp.FailedOperation = i
+			rsp.Error = err
+			writeGatewayResponse(client, msg, WebGatewayTransactionResponseType, rsp)
+			return
+		}
+	}
+
+	log.Info("Committed transaction of %d operations from client %s", len(req.Operations), client.Id())
+	rsp.Committed = true
+	writeGatewayResponse(client, msg, WebGatewayTransactionResponseType, rsp)
+}
+
+// validate checks and authorizes every operation before any is applied, so that an invalid or
+// denied operation does not cause the ones before it to be applied and rolled back. It returns
+// the index of the first operation that cannot be applied and the reason why.
+func (w *TransactionWorker) validate(ctx context.Context, principal *Principal, operations []json.RawMessage) (int, *WebGatewayError) {
+	malformed := func(format string, args ...interface{}) *WebGatewayError {
+		return &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: fmt.Sprintf(format, args...)}
+	}
+
+	// Entities created by the transaction don't exist yet, so they are described to the
+	// policy by the type and parent given to the operation that creates them
+	creates := map[int]*Access{}
+
+	for i, raw := range operations {
+		payload, err := resolveOperation(raw, func(n int) (string, error) {
+			if n >= i || creates[n] == nil {
+				return "", fmt.Errorf("'$%d' does not refer to an earlier WebConfigCreateEntityRequest", n)
+			}
+
+			// Leave the reference as is, the entity is only known once it is created
+			return "$" + strconv.Itoa(n), nil
+		})
+		if err != nil {
+			return i, malformed("%v", err)
+		}
+
+		m, err := payload.UnmarshalNew()
+		if err != nil {
+			return i, malformed("could not decode payload '%s': %v", payload.TypeUrl, err)
+		}
+
+		supported := false
+		for _, op := range transactionOperations {
+			supported = supported || payload.MessageIs(op)
+		}
+
+		if !supported {
+			return i, malformed("'%s' cannot be part of a transaction", payload.TypeUrl)
+		}
+
+		exists := func(entityId string) bool {
+			return entityId == "" || operationReference.MatchString(entityId) || w.store.EntityExists(ctx, entityId)
+		}
+
+		switch m := m.(type) {
+		case *protobufs.WebConfigCreateEntityRequest:
+			if !exists(m.ParentId) {
+				return i, malformed("parent entity '%s' does not exist", m.ParentId)
+			}
+
+			creates[i] = &Access{
+				EntityType: m.Type,
+				Ancestors:  w.ancestorsOf(ctx, creates, m.ParentId),
+			}
+		case *protobufs.WebConfigSetEntitySchemaRequest:
+			// The store cannot remove an entity type, so one introduced by the transaction
+			// would be left behind if it were rolled back
+			if m.Schema != nil && w.store.GetEntitySchema(ctx, m.Schema.Name) == nil {
+				return i, malformed("entity type '%s' does not exist, and cannot be created in a transaction", m.Schema.Name)
+			}
+		case *protobufs.WebRuntimeDatabaseRequest:
+			if m.RequestType != protobufs.WebRuntimeDatabaseRequest_READ && m.RequestType != protobufs.WebRuntimeDatabaseRequest_WRITE {
+				return i, malformed("unknown request type '%v'", m.RequestType)
+			}
+
+			for _, r := range m.Requests {
+				if r.Id == "" || !exists(r.Id) {
+					return i, malformed("entity '%s' does not exist", r.Id)
+				}
+			}
+		}
+
+		for _, access := range w.accessesOf(ctx, creates, payload, m) {
+			if err := w.policy.Authorize(principal, access); err != nil {
+				return i, &WebGatewayError{Code: GatewayErrorPermissionDenied, Message: err.Error()}
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+// accessesOf lists the accesses an operation requires, like the AuthorizationWorker and the
+// RuntimeWorker do when the operation is dispatched, but with references to entities created
+// by earlier operations described by creates
+func (w *TransactionWorker) accessesOf(ctx context.Context, creates map[int]*Access, payload *anypb.Any, m proto.Message) []*Access {
+	name := string(payload.MessageName().Name())
+
+	switch m := m.(type) {
+	case *protobufs.WebConfigCreateEntityRequest:
+		return []*Access{{
+			Payload:    name,
+			Operation:  OperationWrite,
+			EntityType: m.Type,
+			Ancestors:  w.ancestorsOf(ctx, creates, m.ParentId),
+		}}
+	case *protobufs.WebConfigGetEntityRequest:
+		return []*Access{w.entityAccess(ctx, creates, name, OperationRead, m.Id, "")}
+	case *protobufs.WebRuntimeDatabaseRequest:
+		operation := OperationRead
+		if m.RequestType == protobufs.WebRuntimeDatabaseRequest_WRITE {
+			operation = OperationWrite
+		}
+
+		// The remaining fields of a field path are authorized by the RuntimeWorker as it
+		// resolves them
+		accesses := []*Access{}
+		for _, r := range m.Requests {
+			accesses = append(accesses, w.entityAccess(ctx, creates, name, operation, r.Id, firstFieldOf(r.Field)))
+		}
+
+		return accesses
+	}
+
+	return w.authorization.accessesOf(ctx, &protobufs.WebMessage{Payload: payload})
+}
+
+// entityAccess is newEntityAccess for an entity that may be created by the transaction
+func (w *TransactionWorker) entityAccess(ctx context.Context, creates map[int]*Access, payload string, operation string, entityId string, field string) *Access {
+	if created := createdBy(creates, entityId); created != nil {
+		return &Access{
+			Payload:    payload,
+			Operation:  operation,
+			EntityType: created.EntityType,
+			EntityId:   entityId,
+			Field:      field,
+			Ancestors:  created.Ancestors,
+		}
+	}
+
+	return newEntityAccess(ctx, w.store, payload, operation, entityId, field)
+}
+
+// ancestorsOf is ancestorsOf for an entity that may be created by the transaction
+func (w *TransactionWorker) ancestorsOf(ctx context.Context, creates map[int]*Access, entityId string) []string {
+	if created := createdBy(creates, entityId); created != nil {
+		return created.Ancestors
+	}
+
+	return ancestorsOf(ctx, w.store, entityId)
+}
+
+// createdBy returns the description of the entity a reference like '$n' refers to, or nil if
+// entityId is not a reference
+func createdBy(creates map[int]*Access, entityId string) *Access {
+	match := operationReference.FindStringSubmatch(entityId)
+	if match == nil {
+		return nil
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil
+	}
+
+	return creates[n]
+}
+
+// applyOperation records how to undo operation i, then dispatches it. It returns the response
+// to the operation, and an error if the operation failed.
+func (w *TransactionWorker) applyOperation(ctx context.Context, client web.Client, msg web.Message, tx *transaction, i int, raw json.RawMessage) (*anypb.Any, *WebGatewayError) {
+	payload, err := resolveOperation(raw, func(n int) (string, error) {
+		return tx.created[n], nil
+	})
+	if err != nil {
+		return nil, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: err.Error()}
+	}
+
+	m, err := payload.UnmarshalNew()
+	if err != nil {
+		return nil, &WebGatewayError{Code: GatewayErrorMalformedRequest, Message: err.Error()}
+	}
+
+	switch m := m.(type) {
+	case *protobufs.WebConfigSetEntitySchemaRequest:
+		tx.schemaChanged = true
+
+		if m.Schema != nil {
+			if sch := w.store.GetEntitySchema(ctx, m.Schema.Name); sch != nil {
+				previous := entity.ToSchemaPb(sch)
+				tx.undo = append(tx.undo, func() {
+					w.store.SetEntitySchema(ctx, entity.FromSchemaPb(previous))
+				})
+			}
+		}
+	case *protobufs.WebConfigSetFieldSchemaRequest:
+		tx.schemaChanged = true
+
+		for _, entityType := range w.store.GetEntityTypes(ctx) {
+			sch := w.store.GetEntitySchema(ctx, entityType)
+			if sch == nil {
+				continue
+			}
+
+			previous := entity.ToSchemaPb(sch)
+			for _, f := range previous.Fields {
+				if f.Name == m.Field {
+					tx.undo = append(tx.undo, func() {
+						w.store.SetEntitySchema(ctx, entity.FromSchemaPb(previous))
+					})
+					break
+				}
+			}
+		}
+	case *protobufs.WebRuntimeDatabaseRequest:
+		if m.RequestType == protobufs.WebRuntimeDatabaseRequest_WRITE {
+			w.recordPreviousValues(ctx, tx, m.Requests)
+		}
+	}
+
+	response, gerr := w.dispatch(ctx, client, msg, payload)
+
+	if req, ok := m.(*protobufs.WebConfigCreateEntityRequest); ok && response != nil {
+		created := new(protobufs.WebConfigCreateEntityResponse)
+		if response.UnmarshalTo(created) == nil && created.Id != "" {
+			log.Trace("Transaction operation %d created entity '%s' (%s)", i, created.Id, req.Name)
+			tx.created[i] = created.Id
+			tx.schemaChanged = true
+			tx.undo = append(tx.undo, func() {
+				w.store.DeleteEntity(ctx, created.Id)
+			})
+		}
+	}
+
+	return response, gerr
+}
+
+// recordPreviousValues reads the current value of every field about to be written, so that
+// they can be written back if the transaction is rolled back
+func (w *TransactionWorker) recordPreviousValues(ctx context.Context, tx *transaction, requests []*protobufs.DatabaseRequest) {
+	createdInTransaction := map[string]bool{}
+	for _, id := range tx.created {
+		createdInTransaction[id] = true
+	}
+
+	previous := []*protobufs.DatabaseRequest{}
+	for _, r := range requests {
+		// Fields of entities created by the transaction go away with the entity
+		if createdInTransaction[r.Id] {
+			continue
+		}
+
+		p := &protobufs.DatabaseRequest{
+			Id:    r.Id,
+			Field: r.Field,
+		}
+		w.store.Read(ctx, request.FromPb(p))
+
+		if p.Success {
+			p.Success = false
+			previous = append(previous, p)
+		}
+	}
+
+	if len(previous) == 0 {
+		return
+	}
+
+	tx.undo = append(tx.undo, func() {
+		reqs := []data.Request{}
+		for _, p := range previous {
+			reqs = append(reqs, request.FromPb(p))
+		}
+
+		w.store.Write(ctx, reqs...)
+	})
+}
+
+// dispatch sends an operation through the usual pipeline and returns its response
+func (w *TransactionWorker) dispatch(ctx context.Context, client web.Client, msg web.Message, payload *anypb.Any) (*anypb.Any, *WebGatewayError) {
+	operationClient := &transactionClient{
+		client: client,
+	}
+
+	w.Dispatched.Emit(ctx, operationClient, &protobufs.WebMessage{
+		Header: &protobufs.WebHeader{
+			Id:                   msg.Header.GetId(),
+			Timestamp:            timestamppb.Now(),
+			AuthenticationStatus: msg.Header.GetAuthenticationStatus(),
+		},
+		Payload: payload,
+	})
+
+	if operationClient.response == nil {
+		return nil, &WebGatewayError{Code: GatewayErrorInternal, Message: "no response to operation"}
+	}
+
+	response := operationClient.response.Payload
+	if e := gatewayErrorOf(response); e != nil {
+		return response, e
+	}
+
+	m, err := response.UnmarshalNew()
+	if err != nil {
+		return response, &WebGatewayError{Code: GatewayErrorInternal, Message: err.Error()}
+	}
+
+	if !operationSucceeded(m) {
+		return response, &WebGatewayError{Code: GatewayErrorRequestFailed, Message: fmt.Sprintf("'%s' failed", payload.TypeUrl)}
+	}
+
+	return response, nil
+}
+
+func (w *TransactionWorker) rollback(ctx context.Context, tx *transaction) {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+
+	if tx.schemaChanged {
+		triggerSchemaUpdate(ctx, w.store)
+	}
+}
+
+// operationSucceeded reports whether a response has a SUCCESS status and, for database
+// requests, whether every field was read or written
+func operationSucceeded(m proto.Message) bool {
+	if rsp, ok := m.(*protobufs.WebRuntimeDatabaseResponse); ok {
+		for _, r := range rsp.Response {
+			if !r.Success {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	fd := m.ProtoReflect().Descriptor().Fields().ByName("status")
+	if fd == nil || fd.Kind() != protoreflect.EnumKind {
+		return true
+	}
+
+	status := fd.Enum().Values().ByNumber(m.ProtoReflect().Get(fd).Enum())
+	return status != nil && status.Name() == "SUCCESS"
+}
+
+// resolveOperation decodes an operation of a transaction, replacing its references to other
+// operations with the value returned by resolve
+func resolveOperation(raw json.RawMessage, resolve func(int) (string, error)) (*anypb.Any, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+
+	v, err := resolveReferences(v, resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := new(anypb.Any)
+	if err := protojson.Unmarshal(b, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+func resolveReferences(v interface{}, resolve func(int) (string, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		match := operationReference.FindStringSubmatch(v)
+		if match == nil {
+			return v, nil
+		}
+
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return resolve(n)
+	case []interface{}:
+		for i := range v {
+			resolved, err := resolveReferences(v[i], resolve)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	case map[string]interface{}:
+		for key := range v {
+			resolved, err := resolveReferences(v[key], resolve)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = resolved
+		}
+	}
+
+	return v, nil
+}
+
+// transactionClient captures the response to an operation of a transaction, on behalf of the
+// client that requested the transaction
+type transactionClient struct {
+	client   web.Client
+	response web.Message
+}
+
+func (c *transactionClient) Id() string {
+	return c.client.Id()
+}
+
+func (c *transactionClient) Principal() *Principal {
+	return principalOf(c.client)
+}
+
+func (c *transactionClient) Read() web.Message {
+	return nil
+}
+
+func (c *transactionClient) Write(msg web.Message) {
+	c.response = msg
+}
+
+func (c *transactionClient) Close() {
+
+}
+
+func (c *transactionClient) SetMessageHandler(web.MessageHandler) {
+
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/rqure/qlib/pkg/data/entity"
+	"github.com/rqure/qlib/pkg/protobufs"
+	web "github.com/rqure/qlib/pkg/web/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// newTestOperation encodes m as an operation of a transaction
+func newTestOperation(t *testing.T, m proto.Message) json.RawMessage {
+	t.Helper()
+
+	b, err := protojson.Marshal(newTestValue(t, m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func newTestWrite(t *testing.T, entityId string, field string, raw int64) *protobufs.WebRuntimeDatabaseRequest {
+	return &protobufs.WebRuntimeDatabaseRequest{
+		RequestType: protobufs.WebRuntimeDatabaseRequest_WRITE,
+		Requests:    []*protobufs.DatabaseRequest{{Id: entityId, Field: field, Value: newTestValue(t, &protobufs.Int{Raw: raw})}},
+	}
+}
+
+func TestTransactionValidate(t *testing.T) {
+	policy := &Policy{
+		Principals: map[string][]string{
+			"bob":   {RoleOperator},
+			"carol": {RoleEngineer},
+		},
+		Rules: []PolicyRule{
+			{
+				Effect:     PolicyEffectDeny,
+				Roles:      []string{RoleEngineer},
+				Payloads:   []string{"WebRuntimeDatabaseRequest"},
+				Operations: []string{OperationWrite},
+				Subtrees:   []string{"site2"},
+			},
+		},
+	}
+
+	store := newTestStore(newTestSnapshot(t))
+	w := NewTransactionWorker(store, policy, NewAuthorizationWorker(store, policy))
+
+	createPump := func(parentId string) *protobufs.WebConfigCreateEntityRequest {
+		return &protobufs.WebConfigCreateEntityRequest{Type: "Pump", Name: "Pump2", ParentId: parentId}
+	}
+
+	tests := []struct {
+		name       string
+		principal  string
+		operations []proto.Message
+		failed     int
+		code       string
+	}{
+		{
+			"valid",
+			"carol",
+			[]proto.Message{createPump("site1"), newTestWrite(t, "$0", "Speed", 10), newTestWrite(t, "pump", "Speed", 20)},
+			-1,
+			"",
+		},
+		{
+			"operation that cannot be undone",
+			"carol",
+			[]proto.Message{newTestWrite(t, "pump", "Speed", 20), &protobufs.WebConfigDeleteEntityRequest{Id: "pump"}},
+			1,
+			GatewayErrorMalformedRequest,
+		},
+		{
+			"reference to a later operation",
+			"carol",
+			[]proto.Message{newTestWrite(t, "$1", "Speed", 10), createPump("site1")},
+			0,
+			GatewayErrorMalformedRequest,
+		},
+		{
+			"reference to an operation that creates no entity",
+			"carol",
+			[]proto.Message{newTestWrite(t, "pump", "Speed", 20), newTestWrite(t, "$0", "Speed", 10)},
+			1,
+			GatewayErrorMalformedRequest,
+		},
+		{
+			"missing parent",
+			"carol",
+			[]proto.Message{createPump("site3")},
+			0,
+			GatewayErrorMalformedRequest,
+		},
+		{
+			"new entity type",
+			"carol",
+			[]proto.Message{&protobufs.WebConfigSetEntitySchemaRequest{Schema: newTestSchema("Valve", "Open", "qdb.Bool")}},
+			0,
+			GatewayErrorMalformedRequest,
+		},
+		{
+			"missing entity",
+			"carol",
+			[]proto.Message{newTestWrite(t, "pump2", "Speed", 20)},
+			0,
+			GatewayErrorMalformedRequest,
+		},
+		{
+			"denied operation",
+			"bob",
+			[]proto.Message{newTestWrite(t, "pump", "Speed", 20), createPump("site1")},
+			1,
+			GatewayErrorPermissionDenied,
+		},
+		{
+			"denied below a created entity",
+			"carol",
+			[]proto.Message{createPump("site2"), newTestWrite(t, "$0", "Speed", 10)},
+			1,
+			GatewayErrorPermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operations := []json.RawMessage{}
+			for _, m := range tt.operations {
+				operations = append(operations, newTestOperation(t, m))
+			}
+
+			failed, err := w.validate(context.Background(), &Principal{Name: tt.principal}, operations)
+			if failed != tt.failed {
+				t.Fatalf("expected operation %d to fail, got %d (%+v)", tt.failed, failed, err)
+			}
+
+			if tt.code == "" && err != nil || tt.code != "" && (err == nil || err.Code != tt.code) {
+				t.Errorf("expected error code '%s', got %+v", tt.code, err)
+			}
+
+			if len(store.calls) != 0 {
+				t.Errorf("expected validate not to change the store, got %v", store.calls)
+			}
+		})
+	}
+}
+
+// transactionTestDispatcher stands in for the workers an operation is dispatched to. Writes to
+// the field 'Fail' fail.
+func transactionTestDispatcher(store *testStore) func(context.Context, ...interface{}) {
+	return func(ctx context.Context, args ...interface{}) {
+		client := args[0].(web.Client)
+		msg := args[1].(web.Message)
+
+		m, err := msg.Payload.UnmarshalNew()
+		if err != nil {
+			return
+		}
+
+		var rsp proto.Message
+		switch m := m.(type) {
+		case *protobufs.WebConfigCreateEntityRequest:
+			rsp = &protobufs.WebConfigCreateEntityResponse{
+				Id:     store.CreateEntity(ctx, m.Type, m.ParentId, m.Name),
+				Status: protobufs.WebConfigCreateEntityResponse_SUCCESS,
+			}
+		case *protobufs.WebConfigSetEntitySchemaRequest:
+			store.SetEntitySchema(ctx, entity.FromSchemaPb(m.Schema))
+			rsp = &protobufs.WebConfigSetEntitySchemaResponse{Status: protobufs.WebConfigSetEntitySchemaResponse_SUCCESS}
+		case *protobufs.WebRuntimeDatabaseRequest:
+			for _, r := range m.Requests {
+				if r.Field != "Fail" {
+					store.fields[r.Id+"."+r.Field] = r.Value
+					store.calls = append(store.calls, "Write "+r.Id+"."+r.Field)
+					r.Success = true
+				}
+			}
+			rsp = &protobufs.WebRuntimeDatabaseResponse{Response: m.Requests}
+		default:
+			return
+		}
+
+		payload, err := anypb.New(rsp)
+		if err != nil {
+			return
+		}
+
+		client.Write(&protobufs.WebMessage{Header: msg.Header, Payload: payload})
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		operations func(t *testing.T) []proto.Message
+		committed  bool
+		failed     int
+		calls      []string
+		speeds     map[string]int64
+		entities   []string
+	}{
+		{
+			"committed",
+			func(t *testing.T) []proto.Message {
+				return []proto.Message{
+					&protobufs.WebConfigCreateEntityRequest{Type: "Pump", Name: "Pump2", ParentId: "site2"},
+					newTestWrite(t, "$0", "Speed", 10),
+					newTestWrite(t, "pump", "Speed", 55),
+				}
+			},
+			true,
+			-1,
+			[]string{"CreateEntity new1", "Write new1.Speed", "Write pump.Speed"},
+			map[string]int64{"pump": 55, "new1": 10},
+			[]string{"new1", "pump", "root", "site1", "site2"},
+		},
+		{
+			"rolled back in reverse order",
+			func(t *testing.T) []proto.Message {
+				return []proto.Message{
+					&protobufs.WebConfigSetEntitySchemaRequest{Schema: newTestSchema("Pump", "Speed", "qdb.Int", "Running", "qdb.Bool")},
+					&protobufs.WebConfigCreateEntityRequest{Type: "Pump", Name: "Pump2", ParentId: "site2"},
+					newTestWrite(t, "pump", "Speed", 55),
+					newTestWrite(t, "$1", "Speed", 10),
+					newTestWrite(t, "pump", "Fail", 1),
+				}
+			},
+			false,
+			4,
+			[]string{
+				"SetEntitySchema Pump", "CreateEntity new1", "Write pump.Speed", "Write new1.Speed",
+				// Fields of the created entity are removed with it, instead of being written back
+				"Write pump.Speed", "DeleteEntity new1", "SetEntitySchema Pump",
+			},
+			map[string]int64{"pump": 40},
+			[]string{"pump", "root", "site1", "site2"},
+		},
+		{
+			"entity created by the failed operation",
+			func(t *testing.T) []proto.Message {
+				return []proto.Message{
+					newTestWrite(t, "pump", "Speed", 55),
+					&protobufs.WebConfigCreateEntityRequest{Type: "Pump", Name: "Pump2", ParentId: "site2"},
+					&protobufs.WebConfigCreateEntityRequest{Type: "Pump", Name: "Pump3", ParentId: "$1"},
+					newTestWrite(t, "$2", "Fail", 1),
+				}
+			},
+			false,
+			3,
+			[]string{"Write pump.Speed", "CreateEntity new1", "CreateEntity new2", "DeleteEntity new2", "DeleteEntity new1", "Write pump.Speed"},
+			map[string]int64{"pump": 40},
+			[]string{"pump", "root", "site1", "site2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := newTestSnapshot(t)
+			store := newTestStore(from)
+
+			policy := NewDefaultPolicy()
+			w := NewTransactionWorker(store, policy, NewAuthorizationWorker(store, policy))
+			w.Dispatched.Connect(transactionTestDispatcher(store))
+			w.OnStoreConnected(ctx)
+
+			operations := []json.RawMessage{}
+			for _, m := range tt.operations(t) {
+				operations = append(operations, newTestOperation(t, m))
+			}
+
+			payload, err := newGatewayPayload(WebGatewayTransactionRequestType, &WebGatewayTransactionRequest{Operations: operations})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &testClient{}
+			w.OnNewClientMessage(ctx, client, &protobufs.WebMessage{Header: &protobufs.WebHeader{}, Payload: payload})
+			if len(client.responses) != 1 {
+				t.Fatalf("expected one response, got %d", len(client.responses))
+			}
+
+			rsp := new(WebGatewayTransactionResponse)
+			if err := unmarshalGatewayPayload(client.responses[0].Payload, rsp); err != nil {
+				t.Fatal(err)
+			}
+
+			if rsp.Committed != tt.committed || rsp.FailedOperation != tt.failed {
+				t.Fatalf("expected committed %v and failed operation %d, got %+v", tt.committed, tt.failed, rsp)
+			}
+
+			if !slices.Equal(store.calls, tt.calls) {
+				t.Errorf("expected calls %q, got %q", tt.calls, store.calls)
+			}
+
+			for id, speed := range tt.speeds {
+				value := new(protobufs.Int)
+				if err := store.fields[id+".Speed"].UnmarshalTo(value); err != nil || value.Raw != speed {
+					t.Errorf("expected %s.Speed to be %d, got %v", id, speed, value)
+				}
+			}
+
+			entities := []string{}
+			for id := range store.entities {
+				entities = append(entities, id)
+			}
+			slices.Sort(entities)
+
+			if !slices.Equal(entities, tt.entities) {
+				t.Errorf("expected entities %v, got %v", tt.entities, entities)
+			}
+
+			if !tt.committed && !proto.Equal(store.schemas["Pump"], from.EntitySchemas[0]) {
+				t.Errorf("expected the Pump schema to be restored, got %v", store.schemas["Pump"])
+			}
+		})
+	}
+}